@@ -0,0 +1,623 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/validator"
+)
+
+// show the current user along with their permissions
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	// read the user fresh from the db so the version is current
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	perms, err := app.permissionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user, "roles": roles, "permissions": perms}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// update the current user's profile, only the name can be changed here
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Name    *string `json:"name"`
+		Version *int    `json:"version"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// if the client sent the version it last saw, make sure nobody changed the record since
+	if input.Version != nil && *input.Version != user.Version {
+		app.editConflictResponse(w, r)
+		return
+	}
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	v := validator.New()
+
+	if data.ValidateUser(v, user, app.models.Users.Hasher.MaxLength()); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.enqueueWebhookEvent("user.updated", envelope{"user": user})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// change the current user's password, this signs out every other session
+func (app *application) updateCurrentUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	data.ValidatePasswordPlaintext(v, input.NewPassword, app.models.Users.Hasher.MaxLength())
+
+	if !v.Valid() {
+		// report the new password errors under the field name the client used
+		if message, found := v.Errors["password"]; found {
+			delete(v.Errors, "password")
+			v.AddError("new_password", message)
+		}
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	match, err := app.passwordMatches(user, input.CurrentPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("current_password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// the new password has to follow the password policy
+	err = app.passwords.Validate(v, input.NewPassword, user.Name, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if message, found := v.Errors["password"]; found {
+		delete(v.Errors, "password")
+		v.AddError("new_password", message)
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.SetPassword(user, input.NewPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// revoke every other session, and any outstanding reset tokens since they're no longer needed
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		err = app.models.Tokens.DeleteAllForUserExcept(scope, user.ID, app.contextGetToken(r))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditPasswordChanged, user.ID, envelope{"method": "current_password"})
+
+	env := envelope{"message": "your password was successfully changed, all other sessions have been signed out"}
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// start changing the current user's email address.
+// the new address is stored as pending and a confirmation token is sent to it
+func (app *application) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	v.Check(input.Password != "", "password", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// require the password so a stolen token can't be used to take over the account
+	match, err := app.passwordMatches(user, input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// check the address isn't taken now, it's checked again by the constraint on confirmation
+	_, err = app.models.Users.GetByEmail(input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.SetPendingEmail(user.ID, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// only the latest request can be confirmed
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeEmailChange)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditTokenIssued, user.ID, envelope{"scope": data.ScopeEmailChange, "email_hash": auditEmailHash(input.Email)})
+
+	// the token goes to the new address, which proves the user controls it
+	app.background(func() {
+		data := map[string]any{
+			"emailChangeToken": token.Plaintext,
+		}
+
+		err := app.mailer.Send(input.Email, "token_email_change.tmpl", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	env := envelope{"message": "an email will be sent to the new address containing confirmation instructions"}
+
+	err = app.writeResponse(w, r, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirm an email change using the token sent to the new address
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	oldEmail := user.Email
+
+	err = app.models.Users.ConfirmPendingEmail(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// let the old address know, in case the change wasn't made by the account owner
+	app.background(func() {
+		data := map[string]any{
+			"newEmail": user.Email,
+		}
+
+		err := app.mailer.Send(oldEmail, "user_email_changed.tmpl", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	app.enqueueWebhookEvent("user.updated", envelope{"user": user})
+	app.audit(r, data.AuditEmailChanged, user.ID, envelope{"old_email_hash": auditEmailHash(oldEmail), "new_email_hash": auditEmailHash(user.Email)})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// schedule the current user's account for deletion once the grace period has passed
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Password != "", "password", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	match, err := app.passwordMatches(user, input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// asking again doesn't push the date back
+	if user.DeletionScheduledAt == nil {
+		deleteAt := time.Now().Add(app.config.accounts.deletionGrace).Truncate(time.Second)
+		user.DeletionScheduledAt = &deleteAt
+
+		err = app.models.Users.SetDeletionSchedule(user)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		app.audit(r, data.AuditUserDeletionScheduled, user.ID, envelope{"deletion_scheduled_at": deleteAt})
+
+		app.background(func() {
+			data := map[string]any{
+				"deletionScheduledAt": user.DeletionScheduledAt.UTC().Format(time.RFC1123),
+			}
+
+			err := app.mailer.Send(user.Email, "user_deletion_scheduled.tmpl", data)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		})
+	}
+
+	env := envelope{
+		"message": "your account is scheduled for deletion, send DELETE /v1/users/me/deletion before then to cancel",
+		"user":    user,
+	}
+
+	err = app.writeResponse(w, r, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// cancel a scheduled deletion of the current user's account
+func (app *application) cancelCurrentUserDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.DeletionScheduledAt == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user.DeletionScheduledAt = nil
+
+	err = app.models.Users.SetDeletionSchedule(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditUserDeletionCancelled, user.ID, nil)
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// export everything stored about the current user as a single json document
+func (app *application) exportCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	perms, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if perms == nil {
+		perms = data.Permissions{}
+	}
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	apiKeys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	identities, err := app.models.Identities.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	movies, err := app.models.Movies.GetAllCreatedBy(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	export := envelope{
+		"exported_at":   time.Now().UTC().Truncate(time.Second),
+		"user":          user,
+		"pending_email": user.PendingEmail,
+		"roles":         roles,
+		"permissions":   perms,
+		"sessions":      sessions,
+		"api_keys":      apiKeys,
+		"identities":    identities,
+		"movies":        movies,
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="greenlight-user-%d.json"`, user.ID))
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"export": export}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// list the current user's active sessions
+func (app *application) listCurrentUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sessions, err := app.models.Tokens.GetSessionsForUser(app.contextGetUser(r).ID, app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revoke one of the current user's sessions, this can be the current one
+func (app *application) deleteCurrentUserSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// scoped to the user so other users' sessions look like they don't exist
+	err = app.models.Tokens.DeleteSessionForUser(app.contextGetUser(r).ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditTokenRevoked, app.contextGetUser(r).ID, envelope{"scope": "session", "token_id": id})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
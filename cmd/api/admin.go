@@ -0,0 +1,405 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// list and search users
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Search    string
+		Activated *bool
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Search = app.readString(qs, "search", "")
+
+	if s := qs.Get("activated"); s != "" {
+		activated, err := strconv.ParseBool(s)
+		if err != nil {
+			v.AddError("activated", "must be true or false")
+		}
+		input.Activated = &activated
+	}
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafeList = []string{"id", "created_at", "name", "email", "-id", "-created_at", "-name", "-email"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(input.Search, input.Activated, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// show a user with their roles, their direct grants and everything they end up with
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	direct, err := app.models.Permissions.GetDirectForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	effective, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// return an empty list rather than null
+	if effective == nil {
+		effective = data.Permissions{}
+	}
+
+	env := envelope{"user": user, "roles": roles, "permissions": direct, "effective_permissions": effective}
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// activate or deactivate a user's account
+func (app *application) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Activated *bool `json:"activated"`
+		Version   *int  `json:"version"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Version != nil && *input.Version != user.Version {
+		app.editConflictResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Activated != nil, "activated", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	deactivated := user.Activated && !*input.Activated
+	user.Activated = *input.Activated
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// sign a deactivated user out, jwts would otherwise keep saying they're activated until they expire
+	if deactivated {
+		err = app.revokeUserSessions(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.enqueueWebhookEvent("user.updated", envelope{"user": user})
+	app.audit(r, data.AuditUserUpdated, user.ID, envelope{"activated": user.Activated})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// grant a user a perm code directly
+func (app *application) grantUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserPermission(w, r, data.AuditPermissionGranted, app.models.Permissions.AddForUser)
+}
+
+// revoke a perm code granted directly, codes from the user's roles stay
+func (app *application) revokeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserPermission(w, r, data.AuditPermissionRevoked, app.models.Permissions.RemoveForUser)
+}
+
+func (app *application) changeUserPermission(w http.ResponseWriter, r *http.Request, action string, change func(int64, ...string) error) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+
+	err := app.models.Permissions.Exists(code)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.checkGrantable(w, r, "permission", []string{code}) {
+		return
+	}
+
+	err = change(user.ID, code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// other instances hear about it from postgres, this one shouldn't have to wait
+	app.permissions.invalidate(user.ID)
+
+	app.audit(r, action, user.ID, envelope{"permission": code})
+
+	perms, err := app.models.Permissions.GetDirectForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"permissions": perms}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// check the request's user has every perm code they're granting or revoking, sending a 422 if not.
+// users:admin is enough to manage other users, but not to hand out more than the admin has
+func (app *application) checkGrantable(w http.ResponseWriter, r *http.Request, key string, codes []string) bool {
+	perms, err := app.userPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	v := validator.New()
+
+	if data.ValidateGrantable(v, key, codes, perms); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	return true
+}
+
+// give a user a role
+func (app *application) grantUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserRole(w, r, data.AuditRoleGranted, app.models.Roles.AddForUser)
+}
+
+// take a role away from a user
+func (app *application) revokeUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserRole(w, r, data.AuditRoleRevoked, app.models.Roles.RemoveForUser)
+}
+
+func (app *application) changeUserRole(w http.ResponseWriter, r *http.Request, action string, change func(int64, ...string) error) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	name := httprouter.ParamsFromContext(r.Context()).ByName("role")
+
+	rolePerms, err := app.models.Roles.GetPermissions(name)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.checkGrantable(w, r, "role", rolePerms) {
+		return
+	}
+
+	err = change(user.ID, name)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.permissions.invalidate(user.ID)
+
+	app.audit(r, action, user.ID, envelope{"role": name})
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// list the roles that can be granted along with their perm codes
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// email a user a password reset token, the same one they'd get by asking for it themselves
+func (app *application) createUserPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	// resetting a password doesn't activate the account, so it'd be no use
+	if !user.Activated {
+		v := validator.New()
+		v.AddError("activated", "user account must be activated")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditTokenIssued, user.ID, envelope{"scope": data.ScopePasswordReset})
+
+	app.background(func() {
+		data := map[string]any{
+			"passwordResetToken": token.Plaintext,
+		}
+
+		err := app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	env := envelope{"message": "an email will be sent to the user containing password reset instructions"}
+	err = app.writeResponse(w, r, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// sign a user out everywhere and delete their api keys
+func (app *application) revokeUserTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.revokeUserSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.APIKeys.DeleteAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditTokenRevoked, user.ID, envelope{"scope": "all"})
+
+	env := envelope{"message": "all of the user's sessions and api keys have been revoked"}
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// delete every session token for a user, deleting the authentication tokens revokes their jwts too
+func (app *application) revokeUserSessions(userID int64) error {
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh, data.ScopeMFA} {
+		err := app.models.Tokens.DeleteAllForUser(scope, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// read the user named by the id param, sending a 404 when there isn't one.
+// ok is false when a response has already been sent
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
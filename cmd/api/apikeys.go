@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/validator"
+)
+
+// create an api key for the current user, limited to a subset of their permissions
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string     `json:"name"`
+		Permissions []string   `json:"permissions"`
+		Expiry      *time.Time `json:"expiry"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	userPerms, err := app.permissionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	key := data.NewAPIKey(user.ID, input.Name, input.Permissions, input.Expiry)
+
+	v := validator.New()
+
+	if data.ValidateAPIKey(v, key, userPerms); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.APIKeys.Insert(key)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditTokenIssued, user.ID, envelope{"scope": "api-key", "api_key_id": key.ID, "permissions": key.Permissions})
+
+	// the plaintext is only included in the response when the key is created
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"api_key": key, "key": key.Plaintext}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.models.APIKeys.GetAllForUser(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"api_keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// scoped to the user so other users' keys look like they don't exist
+	err = app.models.APIKeys.DeleteForUser(app.contextGetUser(r).ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditTokenRevoked, app.contextGetUser(r).ID, envelope{"scope": "api-key", "api_key_id": id})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "api key successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
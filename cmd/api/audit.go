@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/validator"
+
+	"github.com/tomasen/realip"
+)
+
+// record a security event about a user, userID is 0 if it's not about anyone in particular.
+// the actor, ip and user agent are taken from the request.
+// the change has already happened at this point, so failures are logged rather than sent to the client
+func (app *application) audit(r *http.Request, action string, userID int64, details envelope) {
+	event := &data.AuditEvent{
+		Action:    action,
+		IP:        realip.FromRequest(r),
+		UserAgent: r.UserAgent(),
+		Details:   details,
+	}
+
+	if userID > 0 {
+		event.UserID = &userID
+	}
+
+	if user := app.contextGetUser(r); !user.IsAnonymous() {
+		event.ActorID = &user.ID
+	}
+
+	// note which key made the request, since it could be one the user didn't mean to share
+	if key := app.contextGetAPIKey(r); key != nil {
+		if event.Details == nil {
+			event.Details = map[string]any{}
+		}
+		event.Details["api_key_id"] = key.ID
+	}
+
+	err := app.models.Audit.Insert(event)
+	if err != nil {
+		app.logger.Error(err.Error(), "action", action)
+	}
+}
+
+// email addresses are recorded as a hash, event details are never changed so they couldn't be removed
+// when the account is deleted. events about the same address can still be matched up,
+// and checked against an address that's already known
+func auditEmailHash(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(sum[:])
+}
+
+// read the filters shared by the audit list and export
+func (app *application) readAuditFilter(qs url.Values, v *validator.Validator) data.AuditFilter {
+	filter := data.AuditFilter{
+		Actions: app.readCSV(qs, "action", nil),
+		ActorID: app.readOptionalID(qs, "actor_id", v),
+		UserID:  app.readOptionalID(qs, "user_id", v),
+		IP:      app.readString(qs, "ip", ""),
+		Since:   app.readTime(qs, "since", v),
+		Until:   app.readTime(qs, "until", v),
+	}
+
+	for _, action := range filter.Actions {
+		v.Check(validator.PermittedValue(action, data.AuditActions...), "action", "invalid action "+action)
+	}
+
+	if filter.Since != nil && filter.Until != nil {
+		v.Check(filter.Since.Before(*filter.Until), "until", "must be after since")
+	}
+
+	return filter
+}
+
+// read an optional id from the query string, adding an error if it isn't a positive integer
+func (app *application) readOptionalID(qs url.Values, key string, v *validator.Validator) *int64 {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 1 {
+		v.AddError(key, "must be a positive integer")
+		return nil
+	}
+
+	return &id
+}
+
+// read an optional RFC 3339 time from the query string
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) *time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.AddError(key, "must be an RFC 3339 time")
+		return nil
+	}
+
+	return &t
+}
+
+// list audit events, newest first unless asked otherwise
+func (app *application) listAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.AuditFilter
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.AuditFilter = app.readAuditFilter(qs, v)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafeList = []string{"id", "created_at", "action", "-id", "-created_at", "-action"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	events, metadata, err := app.models.Audit.GetAll(input.AuditFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"events": events, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// stream every matching audit event as newline delimited json, oldest first
+func (app *application) exportAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	filter := app.readAuditFilter(r.URL.Query(), v)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// clear the write deadline so the server WriteTimeout doesn't cut off large exports
+	rc := http.NewResponseController(w)
+
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	started := false
+
+	// the headers are only sent once there's something to write, so a failed query still gets an error response
+	start := func() {
+		filename := fmt.Sprintf("audit-%s.ndjson", time.Now().UTC().Format("20060102T150405Z"))
+
+		w.Header().Set("Content-Type", ndjsonMediaType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		w.WriteHeader(http.StatusOK)
+		started = true
+	}
+
+	err = app.models.Audit.Export(r.Context(), filter, func(event *data.AuditEvent) error {
+		if !started {
+			start()
+		}
+
+		return enc.Encode(event)
+	})
+
+	switch {
+	case err != nil && !started:
+		app.serverErrorResponse(w, r, err)
+	case err != nil:
+		// the status has been sent, so all that can be done is to stop and log it
+		app.logger.Error(err.Error(), "method", r.Method, "uri", r.URL.RequestURI())
+	case !started:
+		// nothing matched, which is an empty export rather than an error
+		start()
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/data"
+)
+
+func TestAuditEmailHash(t *testing.T) {
+	hash := auditEmailHash("alice@example.com")
+
+	// sha-256 of "alice@example.com"
+	if want := "ff8d9819fc0e12bf0d24892e45987e249a28dce836a85cad60e28eaaa8c6d976"; hash != want {
+		t.Errorf("got %s, want %s", hash, want)
+	}
+
+	for _, email := range []string{"Alice@Example.com", " alice@example.com "} {
+		if got := auditEmailHash(email); got != hash {
+			t.Errorf("%q: got %s, want %s", email, got, hash)
+		}
+	}
+
+	if strings.Contains(hash, "alice") || auditEmailHash("bob@example.com") == hash {
+		t.Error("hashes should be opaque and differ between addresses")
+	}
+}
+
+func TestDeletedUsersAreAnonymizedInAudit(t *testing.T) {
+	db := newTestDB(t)
+	models := data.NewModels(db)
+
+	newUser := func(email string) *data.User {
+		t.Helper()
+
+		user := &data.User{Name: "Test", Email: email}
+		if err := models.Users.SetPassword(user, "pa55word1234"); err != nil {
+			t.Fatal(err)
+		}
+		if err := models.Users.Insert(user); err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+
+	user := newUser("deleted@example.com")
+	admin := newUser("admin@example.com")
+
+	events := []*data.AuditEvent{
+		// a request the user made
+		{Action: data.AuditPasswordChanged, ActorID: &user.ID, UserID: &user.ID, IP: "10.0.0.1", UserAgent: "user"},
+		// an anonymous request about them
+		{Action: data.AuditLoginFailed, UserID: &user.ID, IP: "10.0.0.2", UserAgent: "anonymous"},
+		// a request an admin made about them
+		{Action: data.AuditRoleGranted, ActorID: &admin.ID, UserID: &user.ID, IP: "10.0.0.3", UserAgent: "admin"},
+	}
+	for _, event := range events {
+		if err := models.Audit.Insert(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// neither user is activated, so both would go; only the first is old enough
+	_, err := db.Exec(`UPDATE users SET created_at = NOW() - INTERVAL '2 days' WHERE id = $1`, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := models.Users.DeleteUnactivated(time.Now().Add(-24*time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != user.ID {
+		t.Fatalf("got deleted ids %v, want [%d]", ids, user.ID)
+	}
+
+	rows, err := db.Query(`SELECT actor_id, user_id, ip, user_agent FROM audit_events ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	type row struct {
+		actorID, userID *int64
+		ip, userAgent   string
+	}
+
+	want := []row{
+		{nil, nil, "", ""},
+		{nil, nil, "", ""},
+		{&admin.ID, nil, "10.0.0.3", "admin"},
+	}
+
+	var got []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.actorID, &r.userID, &r.ip, &r.userAgent); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d", len(got), len(want))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if !equalID(g.actorID, w.actorID) || !equalID(g.userID, w.userID) || g.ip != w.ip || g.userAgent != w.userAgent {
+			t.Errorf("event %d: got %+v, want %+v", i, g, w)
+		}
+	}
+
+	// anything else is still refused
+	if _, err := db.Exec(`UPDATE audit_events SET action = 'nothing'`); err == nil {
+		t.Error("an audit event was changed")
+	}
+	if _, err := db.Exec(`DELETE FROM audit_events`); err == nil {
+		t.Error("audit events were deleted")
+	}
+}
+
+func equalID(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -15,6 +15,18 @@ type contextKey string
 // this is will be the key for getting and setting user info in the context
 const userContextKey = contextKey("user")
 
+// key for the plaintext authentication token the request was made with
+const tokenContextKey = contextKey("token")
+
+// key for the user's permissions, loaded once per request by authenticate
+const permissionsContextKey = contextKey("permissions")
+
+// key for the api key the request was made with
+const apiKeyContextKey = contextKey("apiKey")
+
+// key for the documented operation the request is validated against
+const operationContextKey = contextKey("operation")
+
 // this method returns a copy of the request with the user struct attached to the request context
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -30,3 +42,56 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// returns a copy of the request with the authentication token attached to the request context
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// contextGetToken retrieves the authentication token from the request context,
+// this is empty for anonymous requests
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// returns a copy of the request with the user's permissions attached to the request context.
+// for a jwt these are the ones it carries, for an api key the ones the key is limited to
+func (app *application) contextSetPermissions(r *http.Request, perms data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, perms)
+	return r.WithContext(ctx)
+}
+
+// contextGetPermissions retrieves the permissions set by authenticate,
+// found is false for anonymous requests
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, bool) {
+	perms, found := r.Context().Value(permissionsContextKey).(data.Permissions)
+	return perms, found
+}
+
+// returns a copy of the request with the api key attached to the request context
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIKey retrieves the api key from the request context,
+// this is nil unless the request was authenticated with one
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+// returns a copy of the request with the operation it's validated against attached to the request context
+func (app *application) contextSetOperation(r *http.Request, op apiOperation) *http.Request {
+	ctx := context.WithValue(r.Context(), operationContextKey, op)
+	return r.WithContext(ctx)
+}
+
+// contextGetOperation retrieves the operation set by withOperation,
+// found is false when request validation is off or the operation doesn't need a user
+func (app *application) contextGetOperation(r *http.Request) (apiOperation, bool) {
+	op, found := r.Context().Value(operationContextKey).(apiOperation)
+	return op, found
+}
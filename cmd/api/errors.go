@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // log helper to call a logger error from an http request
@@ -20,7 +22,7 @@ func (app *application) logError(r *http.Request, err error) {
 func (app *application) errResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
 	env := envelope{"error": message}
 
-	err := app.writeJSON(w, status, env, nil)
+	err := app.writeResponse(w, r, status, env, nil)
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
@@ -66,6 +68,18 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	app.errResponse(w, r, http.StatusForbidden, message)
 }
 
+// 403, when registration is by invitation only
+func (app *application) registrationClosedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "registration is by invitation only"
+	app.errResponse(w, r, http.StatusForbidden, message)
+}
+
+// 403, for endpoints that manage the account itself
+func (app *application) apiKeyNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "api keys can't be used to access this resource, use an authentication token instead"
+	app.errResponse(w, r, http.StatusForbidden, message)
+}
+
 // 404
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	msg := "the requested resource could not be found"
@@ -78,18 +92,48 @@ func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.
 	app.errResponse(w, r, http.StatusMethodNotAllowed, msg)
 }
 
+// 406
+const notAcceptableMessage = "the requested resource is not available in any of the formats listed in the Accept header"
+
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request) {
+	app.errResponse(w, r, http.StatusNotAcceptable, notAcceptableMessage)
+}
+
 // 409
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
 	app.errResponse(w, r, http.StatusConflict, message)
 }
 
+// 423, the account can't log in with a password until the lockout ends
+func (app *application) accountLockedResponse(w http.ResponseWriter, r *http.Request, until time.Time) {
+	w.Header().Set("Retry-After", retryAfterSeconds(time.Until(until)))
+
+	message := "this account is locked because of too many failed login attempts, try again later or reset your password"
+	app.errResponse(w, r, http.StatusLocked, message)
+}
+
 // 429
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded, wait a few seconds before trying again"
 	app.errResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+// 429 B, logins are slowed down after failed attempts
+func (app *application) loginThrottledResponse(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	seconds := retryAfterSeconds(wait)
+	w.Header().Set("Retry-After", seconds)
+
+	message := fmt.Sprintf("too many failed login attempts, wait %s seconds before trying again", seconds)
+	app.errResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// 503, totp enrolment needs -totp-key to be set
+func (app *application) totpUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "two-factor authentication isn't available on this server"
+	app.errResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
 // 500
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logError(r, err)
@@ -102,3 +146,8 @@ func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Reque
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
 	app.errResponse(w, r, http.StatusUnprocessableEntity, errors)
 }
+
+// whole seconds for a Retry-After header, rounded up so clients don't retry too early
+func retryAfterSeconds(wait time.Duration) string {
+	return strconv.Itoa(int(max(wait+time.Second-1, time.Second) / time.Second))
+}
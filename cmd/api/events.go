@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/data"
+
+	"github.com/lib/pq"
+)
+
+// max number of missed events replayed to a reconnecting client.
+// a client that missed more is sent a reset event instead, see movieEventsHandler
+const movieEventsReplayLimit = 1000
+
+// how far before the last event a replay starts. ids are assigned before commit,
+// so an event with a lower id can commit after one with a higher id and would be missed
+// by replaying only the ids after it. this should be longer than any transaction that writes movies
+const movieEventsReplayWindow = 30 * time.Second
+
+// remembers the ids of recently seen events, so replayed events that were already sent can be skipped.
+// it holds more ids than a replay can return, so nothing in a replay is forgotten before it's checked
+type recentEventIDs struct {
+	ids  []int64
+	seen map[int64]struct{}
+	next int
+}
+
+func newRecentEventIDs() *recentEventIDs {
+	return &recentEventIDs{
+		ids:  make([]int64, 0, 2*movieEventsReplayLimit),
+		seen: make(map[int64]struct{}, 2*movieEventsReplayLimit),
+	}
+}
+
+// record an id, returning false if it has already been seen.
+// the oldest id is forgotten once it's full
+func (r *recentEventIDs) add(id int64) bool {
+	if _, found := r.seen[id]; found {
+		return false
+	}
+
+	if len(r.ids) < cap(r.ids) {
+		r.ids = append(r.ids, id)
+	} else {
+		delete(r.seen, r.ids[r.next])
+		r.ids[r.next] = id
+		r.next = (r.next + 1) % len(r.ids)
+	}
+
+	r.seen[id] = struct{}{}
+	return true
+}
+
+// fans out movie events received from postgres to every connected stream
+type movieBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan *data.MovieEvent]struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+func newMovieBroker() *movieBroker {
+	return &movieBroker{
+		subscribers: make(map[chan *data.MovieEvent]struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// register a new subscriber channel
+func (b *movieBroker) subscribe() chan *data.MovieEvent {
+	ch := make(chan *data.MovieEvent, 16)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch
+}
+
+// remove a subscriber, this is safe to call more than once
+func (b *movieBroker) unsubscribe(ch chan *data.MovieEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, found := b.subscribers[ch]; found {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// send an event to every subscriber
+// a subscriber that can't keep up is dropped rather than blocking everyone else,
+// the client will reconnect and catch up using Last-Event-ID
+func (b *movieBroker) publish(event *data.MovieEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// drop every subscriber, their clients reconnect and catch up using Last-Event-ID
+func (b *movieBroker) disconnectAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// stop the broker, this ends every open stream
+func (b *movieBroker) close() {
+	b.closeOnce.Do(func() {
+		close(b.done)
+	})
+}
+
+// listen for movie event notifications from postgres and publish them to the broker
+// this blocks until the broker is closed, so it should be run with app.background
+func (app *application) listenMovieEvents() {
+	// log connection state changes from the listener
+	reportProblem := func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	}
+
+	listener := pq.NewListener(app.config.db.dsn, 10*time.Second, time.Minute, reportProblem)
+	defer listener.Close()
+
+	err := listener.Listen(data.MovieEventsChannel)
+	if err != nil {
+		app.logger.Error(err.Error())
+		return
+	}
+
+	// events are replayed from a while before the time of the latest event seen after a reconnect,
+	// or from when the listener started if there hasn't been one yet
+	since := time.Now()
+	seen := newRecentEventIDs()
+
+	// ping the connection every so often to detect a dead connection
+	ticker := time.NewTicker(90 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.events.done:
+			return
+		case <-ticker.C:
+			go listener.Ping()
+		case n := <-listener.Notify:
+			// a nil notification means the connection was re-established,
+			// any events that happened in the meantime have to be read from the table
+			if n == nil {
+				// anything committed from now on will be notified on the new connection
+				reconnected := time.Now()
+
+				events, err := app.models.MovieEvents.GetAllSince(since.Add(-movieEventsReplayWindow), movieEventsReplayLimit+1)
+				if err != nil {
+					app.logger.Error(err.Error())
+					continue
+				}
+
+				// too much happened to publish it all, every stream would have a gap in it.
+				// dropping them makes each client replay from its own last event instead
+				if len(events) > movieEventsReplayLimit {
+					app.logger.Warn("too many movie events missed while reconnecting, disconnecting streams", "events", len(events))
+					app.events.disconnectAll()
+					events = nil
+				}
+
+				for _, event := range events {
+					if seen.add(event.ID) {
+						app.events.publish(event)
+					}
+				}
+
+				since = reconnected
+				continue
+			}
+
+			id, err := strconv.ParseInt(n.Extra, 10, 64)
+			if err != nil {
+				app.logger.Error("invalid movie event payload", "payload", n.Extra)
+				continue
+			}
+
+			event, err := app.models.MovieEvents.Get(id)
+			if err != nil {
+				app.logger.Error(err.Error())
+				continue
+			}
+
+			if seen.add(event.ID) {
+				app.events.publish(event)
+			}
+
+			if event.CreatedAt.After(since) {
+				since = event.CreatedAt
+			}
+		}
+	}
+}
+
+// write a single event in the server-sent events format
+func writeMovieEvent(w http.ResponseWriter, event *data.MovieEvent) error {
+	js, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Action, js)
+	return err
+}
+
+// tell the client its events can't be replayed, it should fetch the movies again
+// and apply the events that follow
+func writeMovieReset(w http.ResponseWriter, id int64) error {
+	js, err := json.Marshal(envelope{"message": "too many events were missed to replay them, reload the movies"})
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: reset\ndata: %s\n\n", id, js)
+	return err
+}
+
+// stream movie changes to the client as server-sent events
+func (app *application) movieEventsHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+
+	// clear the write deadline so the server WriteTimeout doesn't end the stream
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// read the id of the last event the client received, if it's reconnecting.
+	// browsers send the header, the query string is for clients that can't set headers
+	var lastID int64
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	if lastEventID != "" {
+		lastID, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || lastID < 0 {
+			app.badRequestResponse(w, r, errors.New("invalid Last-Event-ID value"))
+			return
+		}
+	}
+
+	// subscribe before replaying so nothing is missed in between
+	events := app.events.subscribe()
+	defer app.events.unsubscribe(events)
+
+	// the replay goes back a little before the client's last event to catch any that committed late,
+	// so a client can get an event it already has and should ignore ids it has seen
+	var missed []*data.MovieEvent
+	var resetID int64
+	if lastID > 0 {
+		missed, err = app.models.MovieEvents.GetAllAfter(lastID, movieEventsReplayWindow, movieEventsReplayLimit+1)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// the client missed too much to replay, so it's told to reload the movies instead.
+		// the reset carries the latest id, so reconnecting later doesn't ask for the same replay again
+		if len(missed) > movieEventsReplayLimit {
+			missed = nil
+
+			resetID, err = app.models.MovieEvents.LatestID()
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// events sent on this stream, the broker can publish ones that were already replayed
+	sent := newRecentEventIDs()
+
+	if resetID > 0 {
+		err = writeMovieReset(w, resetID)
+		if err != nil {
+			return
+		}
+	}
+
+	// replay anything the client missed
+	for _, event := range missed {
+		err = writeMovieEvent(w, event)
+		if err != nil {
+			return
+		}
+		sent.add(event.ID)
+	}
+
+	err = rc.Flush()
+	if err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(app.config.sse.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		// the client went away
+		case <-r.Context().Done():
+			return
+		// the server is shutting down
+		case <-app.events.done:
+			return
+		case event, ok := <-events:
+			// the broker dropped us, the client can reconnect and resume
+			if !ok {
+				return
+			}
+
+			// skip events that were already sent during the replay
+			if !sent.add(event.ID) {
+				continue
+			}
+
+			err = writeMovieEvent(w, event)
+			if err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			// comment lines are ignored by clients but keep the connection alive
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+		}
+
+		err = rc.Flush()
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Bekian/greenlight/internal/data"
+)
+
+func TestMovieBrokerDisconnectAll(t *testing.T) {
+	b := newMovieBroker()
+
+	first := b.subscribe()
+	second := b.subscribe()
+
+	b.disconnectAll()
+
+	for i, ch := range []chan *data.MovieEvent{first, second} {
+		if _, ok := <-ch; ok {
+			t.Errorf("subscriber %d is still open", i)
+		}
+	}
+
+	// the handlers still unsubscribe when their streams end
+	b.unsubscribe(first)
+}
+
+func TestWriteMovieReset(t *testing.T) {
+	rr := httptest.NewRecorder()
+
+	if err := writeMovieReset(rr, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "id: 42\nevent: reset\ndata: {\"message\":\"too many events were missed to replay them, reload the movies\"}\n\n"
+	if got := rr.Body.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// response formats the api can write, in order of server preference
+const (
+	formatJSON        = "json"
+	formatCompactJSON = "compact-json"
+	formatXML         = "xml"
+	formatMsgPack     = "msgpack"
+	formatCSV         = "csv"
+)
+
+// media types accepted for each format, the first one is sent as the Content-Type
+var formatMediaTypes = []struct {
+	format     string
+	mediaTypes []string
+}{
+	{formatJSON, []string{"application/json"}},
+	{formatCompactJSON, []string{"application/json"}}, // selected with the compact=true parameter
+	{formatXML, []string{"application/xml", "text/xml"}},
+	{formatMsgPack, []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"}},
+	{formatCSV, []string{"text/csv"}},
+}
+
+// newline delimited json, used by exports that are streamed a record at a time
+const ndjsonMediaType = "application/x-ndjson"
+
+var formatContentTypes = map[string]string{
+	formatJSON:        "application/json",
+	formatCompactJSON: "application/json",
+	formatXML:         "application/xml; charset=utf-8",
+	formatMsgPack:     "application/msgpack",
+	formatCSV:         "text/csv; charset=utf-8",
+}
+
+// a single media range from an Accept header
+type mediaRange struct {
+	mediaType string // e.g. "application/json", "text/*" or "*/*"
+	compact   bool
+	q         float64
+}
+
+// parse an Accept header into media ranges, ranges that can't be parsed are skipped
+func parseAccept(header string) []mediaRange {
+	var ranges []mediaRange
+
+	for part := range strings.SplitSeq(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		mr := mediaRange{mediaType: mediaType, q: 1}
+
+		if q, ok := params["q"]; ok {
+			mr.q, err = strconv.ParseFloat(q, 64)
+			if err != nil || mr.q < 0 || mr.q > 1 {
+				continue
+			}
+		}
+
+		mr.compact = params["compact"] == "true"
+		ranges = append(ranges, mr)
+	}
+
+	return ranges
+}
+
+// how well a media range matches a format's media type, higher is more specific, -1 is no match
+func (mr mediaRange) match(format, mediaType string) int {
+	// compact json must be asked for explicitly
+	if format == formatCompactJSON {
+		if mr.mediaType == mediaType && mr.compact {
+			return 3
+		}
+		return -1
+	}
+
+	switch {
+	case mr.mediaType == mediaType && !mr.compact:
+		return 2
+	case mr.mediaType == mediaType:
+		return -1
+	case strings.HasSuffix(mr.mediaType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mr.mediaType, "*")):
+		return 1
+	case mr.mediaType == "*/*":
+		return 0
+	}
+
+	return -1
+}
+
+// pick the best format from the request's Accept header, out of the provided candidates.
+// a missing Accept header means anything is acceptable
+func negotiateFormat(r *http.Request, candidates ...string) (string, bool) {
+	header := r.Header.Get("Accept")
+	if header == "" {
+		return candidates[0], true
+	}
+
+	ranges := parseAccept(header)
+
+	best, bestQ := "", 0.0
+
+	for _, fm := range formatMediaTypes {
+		if !slices.Contains(candidates, fm.format) {
+			continue
+		}
+
+		// the q value comes from the most specific matching range
+		for _, mediaType := range fm.mediaTypes {
+			specificity, q := -1, 0.0
+			for _, mr := range ranges {
+				if s := mr.match(fm.format, mediaType); s > specificity {
+					specificity, q = s, mr.q
+				}
+			}
+
+			if specificity >= 0 && q > bestQ {
+				best, bestQ = fm.format, q
+			}
+		}
+	}
+
+	return best, best != ""
+}
+
+// the formats a response can be written in, csv only works for list responses
+func responseFormats(data envelope) []string {
+	formats := []string{formatJSON, formatCompactJSON, formatXML, formatMsgPack}
+	if csvListKey(data) != "" {
+		formats = append(formats, formatCSV)
+	}
+
+	return formats
+}
+
+// reject requests that don't accept any format we can produce.
+// csv is only produced by list routes, which apiRouter checks per route with rejectCSVOnly
+func (app *application) negotiate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+
+		header := r.Header.Get("Accept")
+		if header != "" {
+			_, ok := negotiateFormat(r, formatJSON, formatCompactJSON, formatXML, formatMsgPack, formatCSV)
+
+			// event streams and ndjson exports are written by their own handlers
+			streaming := slices.ContainsFunc(parseAccept(header), func(mr mediaRange) bool {
+				return (mr.mediaType == "text/event-stream" || mr.mediaType == ndjsonMediaType) && mr.q > 0
+			})
+
+			if !ok && !streaming {
+				app.notAcceptableResponse(w, r)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reject requests that only accept csv, for routes that don't return a list.
+// this runs before the handler, otherwise a change could be made and then answered with a 406
+func (app *application) rejectCSVOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "" {
+			_, ok := negotiateFormat(r, formatJSON, formatCompactJSON, formatXML, formatMsgPack)
+			if !ok {
+				app.notAcceptableResponse(w, r)
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// whether an operation's response can be written as csv,
+// which needs a GET whose response has exactly one list in it, see csvListKey
+func csvOperation(op apiOperation) bool {
+	if op.method != http.MethodGet || op.stream || op.ndjson {
+		return false
+	}
+
+	properties, _ := op.response["properties"].(schema)
+
+	lists := 0
+	for _, property := range properties {
+		if property, ok := property.(schema); ok && property["type"] == "array" {
+			lists++
+		}
+	}
+
+	return lists == 1
+}
+
+// encode data in the provided format
+func encodeResponse(format string, data envelope) ([]byte, error) {
+	switch format {
+	case formatCompactJSON:
+		js, err := json.Marshal(data)
+		return append(js, '\n'), err
+	case formatJSON:
+		// empty string is an empty line prefix, tab prefixes each element.
+		js, err := json.MarshalIndent(data, "", "\t")
+		return append(js, '\n'), err
+	}
+
+	// the other formats are written from the json representation,
+	// so they use the same field names and Runtime format as json responses
+	value, err := toJSONValue(data)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+
+	switch format {
+	case formatXML:
+		err = encodeXML(buf, value)
+	case formatMsgPack:
+		err = encodeMsgPack(buf, value)
+	case formatCSV:
+		err = encodeCSV(buf, value, csvListKey(data))
+	default:
+		err = errors.New("unknown response format " + format)
+	}
+
+	return buf.Bytes(), err
+}
+
+// a json object that remembers the order of its keys
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	key   string
+	value any
+}
+
+func (o jsonObject) get(key string) (any, bool) {
+	for _, m := range o {
+		if m.key == key {
+			return m.value, true
+		}
+	}
+
+	return nil, false
+}
+
+// round trip data through encoding/json into ordered values.
+// objects become jsonObject, arrays []any, and numbers json.Number
+func toJSONValue(data any) (any, error) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	return decodeJSONValue(dec)
+}
+
+func decodeJSONValue(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		obj := jsonObject{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+
+			obj = append(obj, jsonMember{key: key.(string), value: value})
+		}
+		_, err = dec.Token()
+		return obj, err
+	case json.Delim('['):
+		list := []any{}
+		for dec.More() {
+			value, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+
+			list = append(list, value)
+		}
+		_, err = dec.Token()
+		return list, err
+	}
+
+	return tok, nil
+}
+
+// xml element names can't start with a digit or contain characters like "/" or "$"
+var xmlNameRX = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+func encodeXML(w io.Writer, value any) error {
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+
+	err = encodeXMLElement(enc, "response", value)
+	if err != nil {
+		return err
+	}
+
+	err = enc.Flush()
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// write a value as an element, keys that aren't valid element names
+// are written as <entry key="...">
+func encodeXMLElement(enc *xml.Encoder, name string, value any) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if !xmlNameRX.MatchString(name) {
+		start = xml.StartElement{
+			Name: xml.Name{Local: "entry"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: name}},
+		}
+	}
+
+	err := enc.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+
+	switch value := value.(type) {
+	case jsonObject:
+		for _, m := range value {
+			err = encodeXMLElement(enc, m.key, m.value)
+			if err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, item := range value {
+			err = encodeXMLElement(enc, "item", item)
+			if err != nil {
+				return err
+			}
+		}
+	case nil:
+		// empty element
+	default:
+		err = enc.EncodeToken(xml.CharData(scalarString(value)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return enc.EncodeToken(start.End())
+}
+
+// scalar json values as text
+func scalarString(value any) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	case nil:
+		return ""
+	}
+
+	// nested values are written as compact json
+	js, _ := json.Marshal(fromJSONValue(value))
+	return string(js)
+}
+
+// convert an ordered value back into plain maps so it can be marshalled
+func fromJSONValue(value any) any {
+	switch value := value.(type) {
+	case jsonObject:
+		m := make(map[string]any, len(value))
+		for _, member := range value {
+			m[member.key] = fromJSONValue(member.value)
+		}
+		return m
+	case []any:
+		list := make([]any, len(value))
+		for i := range value {
+			list[i] = fromJSONValue(value[i])
+		}
+		return list
+	}
+
+	return value
+}
+
+// the envelope key holding the list for a csv response.
+// this is the only slice in the envelope, other values like metadata are left out
+func csvListKey(data envelope) string {
+	key := ""
+
+	for k, v := range data {
+		rv := reflect.ValueOf(v)
+		// []byte is written as a base64 string rather than a list
+		if rv.Kind() != reflect.Slice || rv.Type().Elem().Kind() == reflect.Uint8 {
+			continue
+		}
+
+		// more than one list is ambiguous
+		if key != "" {
+			return ""
+		}
+		key = k
+	}
+
+	return key
+}
+
+// write the list under key as csv, with a header row built from the fields of every row
+func encodeCSV(w io.Writer, value any, key string) error {
+	envelope, _ := value.(jsonObject)
+	list, _ := envelope.get(key)
+	rows, _ := list.([]any)
+
+	var columns []string
+	for _, row := range rows {
+		obj, ok := row.(jsonObject)
+		if !ok {
+			return errors.New("csv responses require a list of objects")
+		}
+
+		for _, m := range obj {
+			if !slices.Contains(columns, m.key) {
+				columns = append(columns, m.key)
+			}
+		}
+	}
+
+	cw := csv.NewWriter(w)
+
+	err := cw.Write(columns)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		obj := row.(jsonObject)
+		record := make([]string, len(columns))
+
+		for i, column := range columns {
+			value, _ := obj.get(column)
+
+			// lists of scalars like genres are joined into a single cell
+			if list, ok := value.([]any); ok && !slices.ContainsFunc(list, isCompound) {
+				parts := make([]string, len(list))
+				for j := range list {
+					parts[j] = scalarString(list[j])
+				}
+				record[i] = escapeCSVFormula(strings.Join(parts, ";"))
+				continue
+			}
+
+			// numbers are left alone, a negative one isn't a formula
+			if _, ok := value.(json.Number); ok {
+				record[i] = scalarString(value)
+				continue
+			}
+
+			record[i] = escapeCSVFormula(scalarString(value))
+		}
+
+		err = cw.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// spreadsheet apps run cells starting with these as formulas
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// prefix a cell that would be run as a formula with a quote, so user data like a movie title
+// is shown as text when an export is opened in a spreadsheet
+func escapeCSVFormula(cell string) string {
+	if cell != "" && strings.ContainsRune(csvFormulaPrefixes, rune(cell[0])) {
+		return "'" + cell
+	}
+
+	return cell
+}
+
+func isCompound(value any) bool {
+	switch value.(type) {
+	case jsonObject, []any:
+		return true
+	}
+
+	return false
+}
+
+// a minimal messagepack encoder for the values produced by toJSONValue
+func encodeMsgPack(w *bytes.Buffer, value any) error {
+	switch value := value.(type) {
+	case nil:
+		w.WriteByte(0xc0)
+	case bool:
+		if value {
+			w.WriteByte(0xc3)
+		} else {
+			w.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			writeMsgPackInt(w, i)
+			return nil
+		}
+
+		f, err := value.Float64()
+		if err != nil {
+			return err
+		}
+		w.WriteByte(0xcb)
+		binary.Write(w, binary.BigEndian, math.Float64bits(f))
+	case string:
+		n := len(value)
+		switch {
+		case n < 32:
+			w.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			w.Write([]byte{0xd9, byte(n)})
+		case n <= math.MaxUint16:
+			w.WriteByte(0xda)
+			binary.Write(w, binary.BigEndian, uint16(n))
+		default:
+			w.WriteByte(0xdb)
+			binary.Write(w, binary.BigEndian, uint32(n))
+		}
+		w.WriteString(value)
+	case []any:
+		writeMsgPackHeader(w, len(value), 0x90, 0xdc, 0xdd)
+		for _, item := range value {
+			err := encodeMsgPack(w, item)
+			if err != nil {
+				return err
+			}
+		}
+	case jsonObject:
+		writeMsgPackHeader(w, len(value), 0x80, 0xde, 0xdf)
+		for _, m := range value {
+			err := encodeMsgPack(w, m.key)
+			if err != nil {
+				return err
+			}
+
+			err = encodeMsgPack(w, m.value)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("unsupported value for messagepack")
+	}
+
+	return nil
+}
+
+// write an array or map header using the fix, 16 or 32 bit form
+func writeMsgPackHeader(w *bytes.Buffer, n int, fix, b16, b32 byte) {
+	switch {
+	case n < 16:
+		w.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		w.WriteByte(b16)
+		binary.Write(w, binary.BigEndian, uint16(n))
+	default:
+		w.WriteByte(b32)
+		binary.Write(w, binary.BigEndian, uint32(n))
+	}
+}
+
+func writeMsgPackInt(w *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		w.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		w.WriteByte(byte(i))
+	case i > 0 && i <= math.MaxUint16:
+		w.WriteByte(0xcd)
+		binary.Write(w, binary.BigEndian, uint16(i))
+	case i > 0 && i <= math.MaxUint32:
+		w.WriteByte(0xce)
+		binary.Write(w, binary.BigEndian, uint32(i))
+	default:
+		w.WriteByte(0xd3)
+		binary.Write(w, binary.BigEndian, i)
+	}
+}
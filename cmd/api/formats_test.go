@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	all := []string{formatJSON, formatCompactJSON, formatXML, formatMsgPack, formatCSV}
+
+	tests := []struct {
+		accept     string
+		candidates []string
+		want       string
+		ok         bool
+	}{
+		{"", all, formatJSON, true},
+		{"*/*", all, formatJSON, true},
+		{"application/json", all, formatJSON, true},
+		{"application/json; compact=true", all, formatCompactJSON, true},
+		{"text/xml", all, formatXML, true},
+		{"application/xml;q=0.5, application/msgpack", all, formatMsgPack, true},
+		{"text/*", all, formatXML, true},
+		{"text/csv", all, formatCSV, true},
+		{"text/csv", all[:4], "", false},
+		{"text/csv, application/json;q=0.1", all[:4], formatJSON, true},
+		{"application/json;q=0", all, "", false},
+		{"image/png", all, "", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+
+		got, ok := negotiateFormat(r, tt.candidates...)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Accept %q: got %q, %v, want %q, %v", tt.accept, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCSVOperation(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{http.MethodGet, "/v1/movies", true},
+		{http.MethodGet, "/v1/webhooks", true},
+		{http.MethodGet, "/v1/admin/invitations", true},
+		{http.MethodGet, "/v1/movies/:id", false},
+		{http.MethodPost, "/v1/movies", false},
+		{http.MethodDelete, "/v1/movies/:id", false},
+		{http.MethodGet, "/v1/events/movies", false},
+		{http.MethodGet, "/v1/admin/audit/export", false},
+	}
+
+	for _, tt := range tests {
+		op, found := findOperation(tt.method, tt.path)
+		if !found {
+			t.Fatalf("%s %s isn't documented", tt.method, tt.path)
+		}
+
+		if got := csvOperation(op); got != tt.want {
+			t.Errorf("%s %s: got %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRejectCSVOnly(t *testing.T) {
+	app := newTestApplication(t)
+
+	// writes are turned away before the handler can make any changes
+	router := app.router()
+
+	for _, route := range []struct{ method, path string }{
+		{http.MethodPost, "/v1/movies"},
+		{http.MethodPatch, "/v1/movies/1"},
+		{http.MethodDelete, "/v1/movies/1"},
+		{http.MethodPost, "/v1/users"},
+	} {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(route.method, route.path, nil)
+		r.Header.Set("Accept", "text/csv")
+
+		router.ServeHTTP(rr, r)
+
+		if rr.Code != http.StatusNotAcceptable {
+			t.Errorf("%s %s: got status %d, want %d", route.method, route.path, rr.Code, http.StatusNotAcceptable)
+		}
+	}
+
+	called := false
+	handler := app.rejectCSVOnly(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	for _, accept := range []string{"", "application/json", "text/csv, application/xml;q=0.5"} {
+		called = false
+
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+
+		handler(httptest.NewRecorder(), r)
+
+		if !called {
+			t.Errorf("Accept %q: handler wasn't called", accept)
+		}
+	}
+}
+
+func TestCSVListKey(t *testing.T) {
+	tests := []struct {
+		name string
+		data envelope
+		want string
+	}{
+		{"one list", envelope{"movies": []string{"a"}, "metadata": map[string]int{"total": 1}}, "movies"},
+		{"empty list", envelope{"movies": []int{}}, "movies"},
+		{"no list", envelope{"movie": map[string]string{"title": "a"}}, ""},
+		{"two lists", envelope{"roles": []string{"a"}, "permissions": []string{"b"}}, ""},
+		// bytes are a base64 string in json
+		{"bytes", envelope{"movies": []string{"a"}, "key": []byte("secret")}, "movies"},
+	}
+
+	for _, tt := range tests {
+		if got := csvListKey(tt.data); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCSVEscapesFormulas(t *testing.T) {
+	data := envelope{"movies": []map[string]any{
+		{"title": "=HYPERLINK(\"http://example.com\")", "year": -1, "genres": []string{"+drama"}},
+		{"title": "@SUM(A1)", "year": 2000, "genres": []string{"drama", "-x"}},
+		{"title": "Casablanca", "year": 1942, "genres": []string{}},
+	}}
+
+	body, err := encodeResponse(formatCSV, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "genres,title,year\n" +
+		"'+drama,\"'=HYPERLINK(\"\"http://example.com\"\")\",-1\n" +
+		"drama;-x,'@SUM(A1),2000\n" +
+		",Casablanca,1942\n"
+
+	if string(body) != want {
+		t.Errorf("got\n%s\nwant\n%s", body, want)
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/validator"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+// errors returned from resolvers, these match the messages in errors.go
+var (
+	errGraphQLAuthenticationRequired = errors.New("you must be authenticated to use this resource")
+	errGraphQLInactiveAccount        = errors.New("your user account must be activated to access this resource")
+	errGraphQLNotPermitted           = errors.New("your user account doesn't have the necessary permissions to access this resource")
+	errGraphQLServerError            = errors.New("the server encountered a problem and could not process your request")
+)
+
+// per request state shared by resolvers, so permissions are only loaded once per query
+type graphqlRequest struct {
+	user     *data.User
+	once     sync.Once
+	perms    data.Permissions
+	permsErr error
+}
+
+const graphqlRequestContextKey = contextKey("graphql")
+
+// get the per request state from a resolver context
+func graphqlRequestFromContext(ctx context.Context) *graphqlRequest {
+	req, ok := ctx.Value(graphqlRequestContextKey).(*graphqlRequest)
+	if !ok {
+		panic("missing graphql request value in context")
+	}
+
+	return req
+}
+
+// same rules as requireActivatedUser, for resolvers that only need a signed in user
+func graphqlRequireActivatedUser(ctx context.Context) error {
+	req := graphqlRequestFromContext(ctx)
+
+	switch {
+	case req.user.IsAnonymous():
+		return errGraphQLAuthenticationRequired
+	case !req.user.Activated:
+		return errGraphQLInactiveAccount
+	}
+
+	return nil
+}
+
+// get the request user's perms, loading them the first time they're needed
+// if authenticate hasn't already
+func (app *application) graphqlPermissions(ctx context.Context) (data.Permissions, error) {
+	req := graphqlRequestFromContext(ctx)
+
+	req.once.Do(func() {
+		req.perms, req.permsErr = app.permissionsForUser(req.user.ID)
+	})
+	if req.permsErr != nil {
+		app.logger.Error(req.permsErr.Error())
+		return nil, errGraphQLServerError
+	}
+
+	return req.perms, nil
+}
+
+// same rules as requirePerm, applied to a single field
+func (app *application) graphqlRequirePerm(ctx context.Context, code string) error {
+	err := graphqlRequireActivatedUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	perms, err := app.graphqlPermissions(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !perms.Include(code) {
+		return errGraphQLNotPermitted
+	}
+
+	return nil
+}
+
+// build the schema, resolvers are backed by app.models
+func (app *application) graphqlSchema() (graphql.Schema, error) {
+	metadataType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Metadata",
+		Fields: graphql.Fields{
+			"currentPage":  &graphql.Field{Type: graphql.Int, Resolve: resolveMetadata(func(m data.Metadata) int { return m.CurrentPage })},
+			"pageSize":     &graphql.Field{Type: graphql.Int, Resolve: resolveMetadata(func(m data.Metadata) int { return m.PageSize })},
+			"firstPage":    &graphql.Field{Type: graphql.Int, Resolve: resolveMetadata(func(m data.Metadata) int { return m.FirstPage })},
+			"lastPage":     &graphql.Field{Type: graphql.Int, Resolve: resolveMetadata(func(m data.Metadata) int { return m.LastPage })},
+			"totalRecords": &graphql.Field{Type: graphql.Int, Resolve: resolveMetadata(func(m data.Metadata) int { return m.TotalRecords })},
+		},
+	})
+
+	movieType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Movie",
+		Fields: graphql.Fields{
+			"id":    &graphql.Field{Type: graphql.NewNonNull(graphql.ID), Resolve: resolveMovie(func(m *data.Movie) any { return m.ID })},
+			"title": &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: resolveMovie(func(m *data.Movie) any { return m.Title })},
+			"year":  &graphql.Field{Type: graphql.Int, Resolve: resolveMovie(func(m *data.Movie) any { return m.Year })},
+			// runtime uses the same "<n> mins" format as the json api
+			"runtime": &graphql.Field{Type: graphql.String, Resolve: resolveMovie(func(m *data.Movie) any {
+				return fmt.Sprintf("%d mins", m.Runtime)
+			})},
+			"genres":  &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(graphql.String)), Resolve: resolveMovie(func(m *data.Movie) any { return m.Genres })},
+			"version": &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Resolve: resolveMovie(func(m *data.Movie) any { return m.Version })},
+			// the id of the user who added the movie, null if unknown
+			"createdBy": &graphql.Field{Type: graphql.ID, Resolve: resolveMovie(func(m *data.Movie) any {
+				if m.CreatedBy == nil {
+					return nil
+				}
+				return *m.CreatedBy
+			})},
+		},
+	})
+
+	movieListType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "MovieList",
+		Fields: graphql.Fields{
+			"movies":   &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(movieType)))},
+			"metadata": &graphql.Field{Type: graphql.NewNonNull(metadataType)},
+		},
+	})
+
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id":        &graphql.Field{Type: graphql.NewNonNull(graphql.ID), Resolve: resolveUser(func(u *data.User) any { return u.ID })},
+			"createdAt": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime), Resolve: resolveUser(func(u *data.User) any { return u.CreatedAt })},
+			"name":      &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: resolveUser(func(u *data.User) any { return u.Name })},
+			"email":     &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: resolveUser(func(u *data.User) any { return u.Email })},
+			"activated": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean), Resolve: resolveUser(func(u *data.User) any { return u.Activated })},
+			"permissions": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+				// users are only reachable through me, so these are the request's perms
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					perms, err := app.graphqlPermissions(p.Context)
+					if err != nil {
+						return nil, err
+					}
+
+					return []string(perms), nil
+				},
+			},
+		},
+	})
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"movie": &graphql.Field{
+				Type: movieType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					err := app.graphqlRequirePerm(p.Context, "movies:read")
+					if err != nil {
+						return nil, err
+					}
+
+					// ids are strings in graphql, invalid ones are treated as not found
+					id, err := strconv.ParseInt(fmt.Sprint(p.Args["id"]), 10, 64)
+					if err != nil {
+						return nil, nil
+					}
+
+					movie, err := app.models.Movies.Get(id)
+					if err != nil {
+						switch {
+						case errors.Is(err, data.ErrRecordNotFound):
+							return nil, nil
+						default:
+							app.logger.Error(err.Error())
+							return nil, errGraphQLServerError
+						}
+					}
+
+					return movie, nil
+				},
+			},
+			"movies": &graphql.Field{
+				Type: movieListType,
+				Args: graphql.FieldConfigArgument{
+					"title":    &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: ""},
+					"genres":   &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+					"page":     &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 1},
+					"pageSize": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 20},
+					"sort":     &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: "id"},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					err := app.graphqlRequirePerm(p.Context, "movies:read")
+					if err != nil {
+						return nil, err
+					}
+
+					genres := []string{}
+					if list, ok := p.Args["genres"].([]any); ok {
+						for _, genre := range list {
+							genres = append(genres, genre.(string))
+						}
+					}
+
+					v := validator.New()
+
+					// every arg has a default, but a missing one is a field error rather than a panic
+					title, ok := p.Args["title"].(string)
+					v.Check(ok, "title", "must be provided")
+					page, ok := p.Args["page"].(int)
+					v.Check(ok, "page", "must be provided")
+					pageSize, ok := p.Args["pageSize"].(int)
+					v.Check(ok, "pageSize", "must be provided")
+					sort, ok := p.Args["sort"].(string)
+					v.Check(ok, "sort", "must be provided")
+
+					if !v.Valid() {
+						return nil, validationError(v)
+					}
+
+					filters := data.Filters{
+						Page:         page,
+						PageSize:     pageSize,
+						Sort:         sort,
+						SortSafeList: []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"},
+					}
+
+					// use the same validation as the json endpoint
+					if data.ValidateFilters(v, filters); !v.Valid() {
+						return nil, validationError(v)
+					}
+
+					movies, metadata, err := app.models.Movies.GetAll(title, genres, filters)
+					if err != nil {
+						app.logger.Error(err.Error())
+						return nil, errGraphQLServerError
+					}
+
+					return map[string]any{"movies": movies, "metadata": metadata}, nil
+				},
+			},
+			"me": &graphql.Field{
+				Type: userType,
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					err := graphqlRequireActivatedUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+
+					req := graphqlRequestFromContext(p.Context)
+
+					// a user authenticated with a jwt only has an id and activation state
+					user, err := app.models.Users.Get(req.user.ID)
+					if err != nil {
+						app.logger.Error(err.Error())
+						return nil, errGraphQLServerError
+					}
+
+					return user, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: queryType})
+}
+
+// small helpers so each field resolver is a one liner
+func resolveMovie(fn func(*data.Movie) any) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (any, error) {
+		return fn(p.Source.(*data.Movie)), nil
+	}
+}
+
+func resolveUser(fn func(*data.User) any) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (any, error) {
+		return fn(p.Source.(*data.User)), nil
+	}
+}
+
+func resolveMetadata(fn func(data.Metadata) int) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (any, error) {
+		return fn(p.Source.(data.Metadata)), nil
+	}
+}
+
+// flatten validator errors into a single error message
+func validationError(v *validator.Validator) error {
+	messages := make([]string, 0, len(v.Errors))
+	for key, message := range v.Errors {
+		messages = append(messages, key+": "+message)
+	}
+
+	return errors.New(strings.Join(messages, ", "))
+}
+
+// measure the depth and complexity of an operation.
+// every field costs 1, and fields below a paginated list are multiplied by the page size.
+// introspection fields are ignored so clients can still load the schema
+func graphqlCost(doc *ast.Document, operationName string, variables map[string]any) (depth, complexity int, err error) {
+	var operation *ast.OperationDefinition
+	fragments := make(map[string]*ast.FragmentDefinition)
+
+	for _, def := range doc.Definitions {
+		switch def := def.(type) {
+		case *ast.OperationDefinition:
+			if operationName == "" || (def.Name != nil && def.Name.Value == operationName) {
+				operation = def
+			}
+		case *ast.FragmentDefinition:
+			fragments[def.Name.Value] = def
+		}
+	}
+
+	if operation == nil {
+		return 0, 0, errors.New("operation not found")
+	}
+
+	// variables that aren't supplied take the default declared by the operation
+	defaults := make(map[string]ast.Value)
+	for _, def := range operation.VariableDefinitions {
+		if def.DefaultValue != nil {
+			defaults[def.Variable.Name.Value] = def.DefaultValue
+		}
+	}
+
+	// fragments already being expanded, this guards against fragment cycles
+	visiting := make(map[string]bool)
+
+	var walk func(set *ast.SelectionSet, level int) (int, int)
+	walk = func(set *ast.SelectionSet, level int) (int, int) {
+		if set == nil {
+			return level, 0
+		}
+
+		maxDepth, total := level, 0
+
+		for _, selection := range set.Selections {
+			var d, c int
+
+			switch selection := selection.(type) {
+			case *ast.Field:
+				if strings.HasPrefix(selection.Name.Value, "__") {
+					continue
+				}
+
+				d, c = walk(selection.SelectionSet, level+1)
+
+				// the root movies field returns a page of movies, so everything below it runs once per movie
+				if level == 0 && selection.Name.Value == "movies" {
+					c *= graphqlPageSize(selection, variables, defaults)
+				}
+
+				c++
+			case *ast.InlineFragment:
+				d, c = walk(selection.SelectionSet, level)
+			case *ast.FragmentSpread:
+				name := selection.Name.Value
+				fragment, ok := fragments[name]
+				if !ok || visiting[name] {
+					continue
+				}
+
+				visiting[name] = true
+				d, c = walk(fragment.SelectionSet, level)
+				visiting[name] = false
+			}
+
+			maxDepth = max(maxDepth, d)
+			total += c
+		}
+
+		return maxDepth, total
+	}
+
+	depth, complexity = walk(operation.SelectionSet, 0)
+	return depth, complexity, nil
+}
+
+// read the pageSize argument of a field, falling back to the default page size.
+// a variable that isn't supplied uses its default from the operation, if it has one
+func graphqlPageSize(field *ast.Field, variables map[string]any, defaults map[string]ast.Value) int {
+	for _, arg := range field.Arguments {
+		if arg.Name.Value != "pageSize" {
+			continue
+		}
+
+		value := arg.Value
+		if variable, ok := value.(*ast.Variable); ok {
+			// json numbers decode as float64
+			if supplied, found := variables[variable.Name.Value]; found {
+				if n, ok := supplied.(float64); ok && n > 0 {
+					return int(n)
+				}
+				break
+			}
+
+			value = defaults[variable.Name.Value]
+		}
+
+		if value, ok := value.(*ast.IntValue); ok {
+			n, err := strconv.Atoi(value.Value)
+			if err == nil && n > 0 {
+				return n
+			}
+		}
+	}
+
+	return 20
+}
+
+// execute a read-only graphql query
+func (app *application) graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Query         string         `json:"query"`
+		OperationName string         `json:"operationName"`
+		Variables     map[string]any `json:"variables"`
+		Extensions    map[string]any `json:"extensions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Query != "", "query", "must be provided")
+	v.Check(len(input.Query) <= 10_000, "query", "must not be more than 10000 bytes long")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// parse and validate the document before running anything
+	doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{Body: []byte(input.Query), Name: "GraphQL request"})})
+	if err != nil {
+		app.graphqlErrorResponse(w, r, gqlerrors.FormatErrors(err))
+		return
+	}
+
+	result := graphql.ValidateDocument(&app.graphql, doc, nil)
+	if !result.IsValid {
+		app.graphqlErrorResponse(w, r, result.Errors)
+		return
+	}
+
+	depth, complexity, err := graphqlCost(doc, input.OperationName, input.Variables)
+	if err != nil {
+		app.graphqlErrorResponse(w, r, gqlerrors.FormatErrors(err))
+		return
+	}
+
+	if depth > app.config.graphql.maxDepth {
+		err = fmt.Errorf("query depth %d exceeds the maximum of %d", depth, app.config.graphql.maxDepth)
+		app.graphqlErrorResponse(w, r, gqlerrors.FormatErrors(err))
+		return
+	}
+
+	if complexity > app.config.graphql.maxComplexity {
+		err = fmt.Errorf("query complexity %d exceeds the maximum of %d", complexity, app.config.graphql.maxComplexity)
+		app.graphqlErrorResponse(w, r, gqlerrors.FormatErrors(err))
+		return
+	}
+
+	req := &graphqlRequest{user: app.contextGetUser(r)}
+
+	// authenticate already loaded the permissions
+	if perms, found := app.contextGetPermissions(r); found {
+		req.once.Do(func() { req.perms = perms })
+	}
+
+	ctx := context.WithValue(r.Context(), graphqlRequestContextKey, req)
+
+	res := graphql.Execute(graphql.ExecuteParams{
+		Schema:        app.graphql,
+		AST:           doc,
+		OperationName: input.OperationName,
+		Args:          input.Variables,
+		Context:       ctx,
+	})
+
+	env := envelope{"data": res.Data}
+	if res.HasErrors() {
+		env["errors"] = res.Errors
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// graphql errors use their own "errors" shape instead of the usual error envelope
+func (app *application) graphqlErrorResponse(w http.ResponseWriter, r *http.Request, errs []gqlerrors.FormattedError) {
+	err := app.writeResponse(w, r, http.StatusBadRequest, envelope{"errors": errs}, nil)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
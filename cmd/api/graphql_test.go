@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Bekian/greenlight/internal/data"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+func TestGraphQLCost(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		variables      map[string]any
+		wantDepth      int
+		wantComplexity int
+	}{
+		{
+			name:           "default page size",
+			query:          `{ movies { movies { id title } } }`,
+			wantDepth:      3,
+			wantComplexity: 20*3 + 1,
+		},
+		{
+			name:           "literal page size",
+			query:          `{ movies(pageSize: 5) { movies { id title } } }`,
+			wantDepth:      3,
+			wantComplexity: 5*3 + 1,
+		},
+		{
+			name:           "supplied variable",
+			query:          `query($n: Int) { movies(pageSize: $n) { movies { id } } }`,
+			variables:      map[string]any{"n": float64(50)},
+			wantDepth:      3,
+			wantComplexity: 50*2 + 1,
+		},
+		{
+			name:           "variable default",
+			query:          `query($n: Int = 100) { movies(pageSize: $n) { movies { id } } }`,
+			wantDepth:      3,
+			wantComplexity: 100*2 + 1,
+		},
+		{
+			name:           "supplied variable overrides its default",
+			query:          `query($n: Int = 100) { movies(pageSize: $n) { movies { id } } }`,
+			variables:      map[string]any{"n": float64(10)},
+			wantDepth:      3,
+			wantComplexity: 10*2 + 1,
+		},
+		{
+			name:           "variable without a default",
+			query:          `query($n: Int) { movies(pageSize: $n) { movies { id } } }`,
+			wantDepth:      3,
+			wantComplexity: 20*2 + 1,
+		},
+		{
+			name:           "fragments",
+			query:          `{ movies(pageSize: 2) { ...page } } fragment page on MovieList { movies { id } metadata { totalRecords } }`,
+			wantDepth:      3,
+			wantComplexity: 2*4 + 1,
+		},
+		{
+			name:           "introspection is free",
+			query:          `{ __schema { types { name } } me { id } }`,
+			wantDepth:      2,
+			wantComplexity: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parser.Parse(parser.ParseParams{Source: tt.query})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			depth, complexity, err := graphqlCost(doc, "", tt.variables)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if depth != tt.wantDepth {
+				t.Errorf("got depth %d, want %d", depth, tt.wantDepth)
+			}
+			if complexity != tt.wantComplexity {
+				t.Errorf("got complexity %d, want %d", complexity, tt.wantComplexity)
+			}
+		})
+	}
+}
+
+func TestGraphQLMeRequiresActivatedUser(t *testing.T) {
+	app := &application{}
+
+	schema, err := app.graphqlSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		user *data.User
+		want error
+	}{
+		{"anonymous", data.AnonymousUser, errGraphQLAuthenticationRequired},
+		{"not activated", &data.User{ID: 1}, errGraphQLInactiveAccount},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), graphqlRequestContextKey, &graphqlRequest{user: tt.user})
+
+			res := graphql.Do(graphql.Params{Schema: schema, RequestString: `{ me { id permissions } }`, Context: ctx})
+
+			if len(res.Errors) != 1 || res.Errors[0].Message != tt.want.Error() {
+				t.Errorf("got errors %v, want %q", res.Errors, tt.want)
+			}
+		})
+	}
+}
+
+func TestGraphQLMoviesMissingArgs(t *testing.T) {
+	app := &application{}
+
+	schema, err := app.graphqlSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolve := schema.QueryType().Fields()["movies"].Resolve
+
+	req := &graphqlRequest{user: &data.User{ID: 1, Activated: true}, perms: data.Permissions{"movies:read"}}
+	// the perms are already loaded, so nothing is read from the database
+	req.once.Do(func() {})
+
+	ctx := context.WithValue(context.Background(), graphqlRequestContextKey, req)
+
+	for _, arg := range []string{"title", "page", "pageSize", "sort"} {
+		t.Run(arg, func(t *testing.T) {
+			args := map[string]any{"title": "", "page": 1, "pageSize": 20, "sort": "id"}
+			// graphql-go fills in the defaults, but a resolver shouldn't panic if one is missing
+			delete(args, arg)
+
+			_, err := resolve(graphql.ResolveParams{Args: args, Context: ctx})
+
+			if want := arg + ": must be provided"; err == nil || err.Error() != want {
+				t.Errorf("got error %v, want %q", err, want)
+			}
+		})
+	}
+}
@@ -14,7 +14,7 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// marshal above map into json
-	err := app.writeJSON(w, http.StatusOK, env, nil)
+	err := app.writeResponse(w, r, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
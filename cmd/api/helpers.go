@@ -17,11 +17,16 @@ import (
 
 // read id param from request context and convert
 func (app *application) readIDParam(r *http.Request) (int64, error) {
+	return app.readNamedIDParam(r, "id")
+}
+
+// read an id param with the provided name, used for routes with more than one id
+func (app *application) readNamedIDParam(r *http.Request, name string) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
 
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	id, err := strconv.ParseInt(params.ByName(name), 10, 64)
 	if err != nil || id < 1 {
-		return 0, errors.New("invalid id parameter")
+		return 0, fmt.Errorf("invalid %s parameter", name)
 	}
 
 	return id, nil
@@ -30,27 +35,35 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 // define an envelope type
 type envelope map[string]any
 
-// writejson writes provided data into a json response
-// book diff: i renamed the js variable to json to avoid confusion
-func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
-	// empty string is an empty line prefix, tab prefixes each element.
-	json, err := json.MarshalIndent(data, "", "\t")
+// writeResponse writes provided data in the format negotiated from the Accept header,
+// this is tab indented json unless the client asks for something else
+func (app *application) writeResponse(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) error {
+	format, ok := negotiateFormat(r, responseFormats(data)...)
+	if !ok {
+		// errors fall back to json, there's no better way to report them
+		if status >= 400 {
+			format = formatJSON
+		} else {
+			status = http.StatusNotAcceptable
+			data = envelope{"error": notAcceptableMessage}
+			format = formatJSON
+		}
+	}
+
+	body, err := encodeResponse(format, data)
 	if err != nil {
 		return err
 	}
 
-	// append newline for pretty UwU
-	json = append(json, '\n')
-
 	// add headers from header map
 	for key, value := range headers {
 		// i think this key value syntax on the method is a bit odd but w.e.
 		w.Header()[key] = value
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", formatContentTypes[format])
 	w.WriteHeader(status)
-	w.Write(json)
+	w.Write(body)
 	return nil
 }
 
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/validator"
+)
+
+// registration modes, set with -registration-mode
+const (
+	registrationOpen            = "open"             // anyone can register
+	registrationInviteOnly      = "invite-only"      // only invited users can register
+	registrationDomainAllowlist = "domain-allowlist" // anyone with an email at an allowed domain can register
+)
+
+// check the registration mode lets someone sign up with the email without an invitation,
+// adding the reason to the validator if not
+func (app *application) validateRegistration(v *validator.Validator, email string) {
+	switch app.config.registration.mode {
+	case registrationInviteOnly:
+		v.AddError("email", "registration is by invitation only")
+	case registrationDomainAllowlist:
+		domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+		v.Check(slices.Contains(app.config.registration.allowedDomains, domain), "email", "must be an address at an allowed domain")
+	}
+}
+
+// invite someone to register, their account gets the roles and perms attached to the invitation
+func (app *application) createInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email       string   `json:"email"`
+		Roles       []string `json:"roles"`
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// invited users get the default role unless they're given others.
+	// anyone can register with the default role, so only roles picked by the inviter are checked below
+	chosenRoles := input.Roles != nil
+	if !chosenRoles {
+		input.Roles = []string{app.config.roles.defaultRole}
+	}
+
+	inviter := app.contextGetUser(r)
+
+	invitation := data.NewInvitation(input.Email, inviter.ID, input.Roles, input.Permissions, app.config.registration.inviteTTL)
+
+	v := validator.New()
+
+	if data.ValidateInvitation(v, invitation); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	inviterPerms, err := app.userPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// unknown roles and perms would be silently dropped when the invitation is accepted,
+	// and the inviter can't hand out perms they don't have, see checkGrantable
+	for _, name := range invitation.Roles {
+		rolePerms, err := app.models.Roles.GetPermissions(name)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("roles", fmt.Sprintf("the %q role doesn't exist", name))
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return
+		case chosenRoles:
+			data.ValidateGrantable(v, "roles", rolePerms, inviterPerms)
+		}
+	}
+
+	data.ValidateGrantable(v, "permissions", invitation.Permissions, inviterPerms)
+
+	for _, code := range invitation.Permissions {
+		err = app.models.Permissions.Exists(code)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("permissions", fmt.Sprintf("the %q permission doesn't exist", code))
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	_, err = app.models.Users.GetByEmail(invitation.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// the context user only has an id when authenticated with a jwt, the email needs their name
+	inviter, err = app.models.Users.Get(inviter.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Invitations.Insert(invitation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditInvitationCreated, 0, envelope{
+		"invitation_id": invitation.ID,
+		"email_hash":    auditEmailHash(invitation.Email),
+		"roles":         invitation.Roles,
+		"permissions":   invitation.Permissions,
+	})
+
+	app.background(func() {
+		data := map[string]any{
+			"invitationToken": invitation.Plaintext,
+			"inviterName":     inviter.Name,
+			"expiry":          invitation.Expiry.UTC().Format(time.RFC1123),
+		}
+
+		err := app.mailer.Send(invitation.Email, "user_invitation.tmpl", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"invitation": invitation}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// list the invitations that haven't been accepted and haven't expired
+func (app *application) listInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	invitations, err := app.models.Invitations.GetAllPending()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"invitations": invitations}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// withdraw an invitation, accepted ones can't be withdrawn
+func (app *application) deleteInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Invitations.DeletePending(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditInvitationDeleted, 0, envelope{"invitation_id": id})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "invitation successfully withdrawn"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// create an activated account from an invitation, this works whatever the registration mode is
+func (app *application) acceptInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Name           string `json:"name"`
+		Password       string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// the email is needed to check the password policy before the account is created
+	invitation, err := app.models.Invitations.GetForToken(input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired invitation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user := &data.User{
+		Name:  input.Name,
+		Email: invitation.Email,
+	}
+
+	err = app.models.Users.SetPassword(user, input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data.ValidateUser(v, user, app.models.Users.Hasher.MaxLength())
+
+	err = app.passwords.Validate(v, input.Password, input.Name, invitation.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	invitation, err = app.models.Invitations.Accept(input.TokenPlaintext, user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired invitation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.enqueueWebhookEvent("user.created", envelope{"user": user})
+	app.audit(r, data.AuditUserRegistered, user.ID, envelope{
+		"method":        "invitation",
+		"invitation_id": invitation.ID,
+		"roles":         invitation.Roles,
+		"permissions":   invitation.Permissions,
+	})
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
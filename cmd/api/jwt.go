@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/jwt"
+
+	"github.com/lib/pq"
+)
+
+// issuer claim on every access token
+const jwtIssuer = "greenlight"
+
+// stateless tokens that were revoked before they expired.
+// this is kept in memory so verifying a token doesn't need the database
+type tokenDenyList struct {
+	mu     sync.RWMutex
+	hashes map[[sha256.Size]byte]time.Time
+}
+
+func newTokenDenyList() *tokenDenyList {
+	return &tokenDenyList{hashes: make(map[[sha256.Size]byte]time.Time)}
+}
+
+func (l *tokenDenyList) add(hash [sha256.Size]byte, expiry time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.hashes[hash] = expiry
+}
+
+func (l *tokenDenyList) contains(token string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	_, found := l.hashes[sha256.Sum256([]byte(token))]
+	return found
+}
+
+// drop revocations for tokens that have expired, they'd be rejected anyway
+func (l *tokenDenyList) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for hash, expiry := range l.hashes {
+		if now.After(expiry) {
+			delete(l.hashes, hash)
+		}
+	}
+}
+
+// parse the configured keys into a signer
+func newJWTSigner(configured []string) (*jwt.Signer, error) {
+	var keys []*jwt.Key
+
+	for _, s := range configured {
+		key, err := jwt.ParseKey(s)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return jwt.NewSigner(jwtIssuer, keys)
+}
+
+// issue a signed access token carrying the user's activation state and permissions.
+// the token is still stored so it shows up as a session and can be revoked.
+// changes to the user's permissions only apply once it expires, so it lives for the short jwtTTL
+// and clients get a new one with their refresh token
+func (app *application) newJWTSession(user *data.User, family, ip, userAgent string) (*data.Token, error) {
+	perms, err := app.permissionsForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiry := now.Add(app.config.tokens.jwtTTL).Truncate(time.Second)
+
+	signed, err := app.jwt.Sign(jwt.Claims{
+		Subject:     strconv.FormatInt(user.ID, 10),
+		ID:          rand.Text(),
+		IssuedAt:    now.Unix(),
+		ExpiresAt:   expiry.Unix(),
+		Activated:   user.Activated,
+		Permissions: perms,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return app.models.Tokens.NewStatelessSession(signed, user.ID, expiry, family, ip, userAgent)
+}
+
+// load the current revocations into the deny list
+func (app *application) loadTokenRevocations() error {
+	revocations, err := app.models.Tokens.GetRevocations()
+	if err != nil {
+		return err
+	}
+
+	for _, revocation := range revocations {
+		app.revoked.add(revocation.Hash, revocation.Expiry)
+	}
+
+	return nil
+}
+
+// listen for revocations of stateless tokens from postgres and add them to the deny list.
+// this blocks until the context is cancelled, so it should be run with app.background
+func (app *application) listenTokenRevocations(ctx context.Context) {
+	reportProblem := func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	}
+
+	listener := pq.NewListener(app.config.db.dsn, 10*time.Second, time.Minute, reportProblem)
+	defer listener.Close()
+
+	err := listener.Listen(data.TokenRevocationsChannel)
+	if err != nil {
+		app.logger.Error(err.Error())
+		return
+	}
+
+	// revocations made between the first load and listening would otherwise be missed
+	err = app.loadTokenRevocations()
+	if err != nil {
+		app.logger.Error(err.Error())
+	}
+
+	ticker := time.NewTicker(90 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			go listener.Ping()
+			app.revoked.prune(time.Now())
+		case n := <-listener.Notify:
+			// a nil notification means the connection was re-established,
+			// anything revoked in the meantime has to be read from the table
+			if n == nil {
+				err := app.loadTokenRevocations()
+				if err != nil {
+					app.logger.Error(err.Error())
+				}
+				continue
+			}
+
+			hash, expiry, err := parseRevocationPayload(n.Extra)
+			if err != nil {
+				app.logger.Error("invalid token revocation payload", "payload", n.Extra)
+				continue
+			}
+
+			app.revoked.add(hash, expiry)
+		}
+	}
+}
+
+// parse a "<hex hash> <unix expiry>" notification payload
+func parseRevocationPayload(payload string) ([sha256.Size]byte, time.Time, error) {
+	var hash [sha256.Size]byte
+
+	hexHash, unix, _ := strings.Cut(payload, " ")
+
+	n, err := hex.Decode(hash[:], []byte(hexHash))
+	if err != nil {
+		return hash, time.Time{}, err
+	}
+	if n != sha256.Size {
+		return hash, time.Time{}, errors.New("short hash")
+	}
+
+	expiry, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return hash, time.Time{}, err
+	}
+
+	return hash, time.Unix(expiry, 0), nil
+}
+
+// serve the public keys used to sign access tokens
+func (app *application) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	if app.jwt == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "public, max-age=300")
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope(app.jwt.JWKS()), headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
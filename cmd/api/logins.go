@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/data"
+
+	"github.com/tomasen/realip"
+)
+
+// failed logins allowed before each attempt has to wait
+const loginFreeAttempts = 3
+
+// the longest wait between attempts before the account is locked
+const loginMaxDelay = time.Minute
+
+// check whether a login from the ip can be attempted, writing a response if not.
+// ips that keep failing are refused for a while, whichever accounts they try
+func (app *application) ipLoginAllowed(w http.ResponseWriter, r *http.Request, ip string) bool {
+	failures, err := app.models.Logins.CountIPFailures(ip, app.config.login.ipWindow)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if failures >= app.config.login.ipMaxAttempts {
+		app.loginThrottledResponse(w, r, app.config.login.ipWindow)
+		return false
+	}
+
+	return true
+}
+
+// check whether a password login for the user can be attempted, writing a response if not.
+// this has to happen before the password is checked, so guesses made while locked out tell the attacker nothing
+func (app *application) loginAllowed(w http.ResponseWriter, r *http.Request, user *data.User) (*data.LoginLockout, bool) {
+	lockout, err := app.getLoginLockout(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if lockout == nil {
+		return nil, true
+	}
+
+	now := time.Now()
+
+	switch {
+	case lockout.Locked(now):
+		app.accountLockedResponse(w, r, *lockout.LockedUntil)
+		return nil, false
+	case now.Before(lockout.NextAttemptAt):
+		app.loginThrottledResponse(w, r, lockout.NextAttemptAt.Sub(now))
+		return nil, false
+	}
+
+	return lockout, true
+}
+
+// like loginAllowed, but for logins that start from an email address.
+// a 423 or 429 would only ever be sent for registered emails, so refused attempts get the same 401 as a wrong password.
+// they count against the ip but not the account, which would keep extending the lockout
+func (app *application) emailLoginAllowed(w http.ResponseWriter, r *http.Request, user *data.User, details envelope) (*data.LoginLockout, bool) {
+	lockout, err := app.getLoginLockout(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if lockout == nil {
+		return nil, true
+	}
+
+	now := time.Now()
+
+	if lockout.Locked(now) || now.Before(lockout.NextAttemptAt) {
+		err = app.models.Logins.RecordIPFailure(realip.FromRequest(r), app.config.login.ipWindow)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return nil, false
+		}
+
+		app.audit(r, data.AuditLoginFailed, user.ID, details)
+
+		app.invalidCredentialsResponse(w, r)
+		return nil, false
+	}
+
+	return lockout, true
+}
+
+// get the user's failed logins, nil if there haven't been any
+func (app *application) getLoginLockout(user *data.User) (*data.LoginLockout, error) {
+	lockout, err := app.models.Logins.GetLockout(user.ID)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		return nil, nil
+	}
+
+	return lockout, err
+}
+
+// count a failed login against the ip, and the account if it's known, then send the same response as a wrong password.
+// details say how the user tried to log in, and which email was tried if there's no account for it
+func (app *application) failedLoginResponse(w http.ResponseWriter, r *http.Request, user *data.User, details envelope) {
+	var userID int64
+	var err error
+
+	if user != nil {
+		userID = user.ID
+		err = app.recordFailedLogin(r, user)
+	} else {
+		err = app.models.Logins.RecordIPFailure(realip.FromRequest(r), app.config.login.ipWindow)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditLoginFailed, userID, details)
+
+	app.invalidCredentialsResponse(w, r)
+}
+
+// count a wrong password, making the next attempt wait longer each time
+// until the account is locked and the user is emailed
+func (app *application) recordFailedLogin(r *http.Request, user *data.User) error {
+	ip := realip.FromRequest(r)
+
+	err := app.models.Logins.RecordIPFailure(ip, app.config.login.ipWindow)
+	if err != nil {
+		return err
+	}
+
+	attempts, err := app.models.Logins.RecordFailure(user.ID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	switch {
+	case attempts >= app.config.login.maxAttempts:
+		until := now.Add(app.config.login.lockout)
+
+		// the user is only emailed once per lockout, however many failures raced to lock it
+		locked, err := app.models.Logins.Lock(user.ID, now, until)
+		if err != nil || !locked {
+			return err
+		}
+
+		app.logger.Warn("account locked after failed logins", "user_id", user.ID, "ip", ip)
+		app.audit(r, data.AuditUserLocked, user.ID, envelope{"locked_until": until})
+
+		app.background(func() {
+			data := map[string]any{
+				"lockedUntil": until.UTC().Format(time.RFC1123),
+				"ip":          ip,
+			}
+
+			err := app.mailer.Send(user.Email, "user_account_locked.tmpl", data)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		})
+	case attempts > loginFreeAttempts:
+		// 1s, 2s, 4s and so on, the shift is capped so it can't overflow
+		delay := min(time.Second<<min(attempts-loginFreeAttempts-1, 16), loginMaxDelay)
+
+		err = app.models.Logins.Delay(user.ID, now.Add(delay))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// end a user's login lockout and forget their failed logins
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Logins.Reset(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditUserUnlocked, user.ID, nil)
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "the account is unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/data"
+)
+
+func TestLockedLoginsLookLikeWrongPasswords(t *testing.T) {
+	app := newTestApplication(t)
+	app.models = data.NewModels(newTestDB(t))
+	app.config.login.ipWindow = time.Hour
+
+	user := &data.User{Name: "Test", Email: "locked@example.com"}
+	if err := app.models.Users.SetPassword(user, "pa55word1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Users.Insert(user); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.models.Logins.RecordFailure(user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	locked, err := app.models.Logins.Lock(user.ID, now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("the account wasn't locked")
+	}
+
+	// a second failure racing the first shouldn't lock it again, or the user would get another email
+	locked, err = app.models.Logins.Lock(user.ID, now, now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked {
+		t.Error("an already locked account was locked again")
+	}
+
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/v1/tokens/authentication", nil)
+
+	if _, ok := app.emailLoginAllowed(rr, r, user, envelope{"method": "password"}); ok {
+		t.Fatal("a locked account was allowed to log in")
+	}
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+	if rr.Header().Get("Retry-After") != "" {
+		t.Error("the response has a Retry-After header")
+	}
+
+	// an authenticated user isn't finding out anything, they're told why
+	rr = httptest.NewRecorder()
+
+	if _, ok := app.loginAllowed(rr, r, user); ok {
+		t.Fatal("a locked account was allowed to log in")
+	}
+
+	if rr.Code != http.StatusLocked {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusLocked)
+	}
+}
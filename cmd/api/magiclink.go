@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/validator"
+
+	"github.com/tomasen/realip"
+)
+
+// how long an emailed login token and code can be used for
+const loginTokenTTL = 15 * time.Minute
+
+// email a passwordless login token and code.
+// the response is the same whether or not the email is registered, so it can't be used to find accounts
+func (app *application) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "if the email address is registered, an email will be sent to it containing login instructions"}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// unknown and unactivated accounts get the same response, but no email
+	if user == nil || !user.Activated {
+		err = app.writeResponse(w, r, http.StatusAccepted, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// only the latest email works, this also stops earlier codes being guessed
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeLogin, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, loginTokenTTL, data.ScopeLogin)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	code, err := app.models.Tokens.NewLoginCode(user.ID, loginTokenTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditTokenIssued, user.ID, envelope{"scope": data.ScopeLogin})
+
+	app.background(func() {
+		data := map[string]any{
+			"loginToken": token.Plaintext,
+			"loginCode":  code.Plaintext,
+		}
+
+		err := app.mailer.Send(user.Email, "token_login.tmpl", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	err = app.writeResponse(w, r, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// exchange an emailed login token, or the email address and code, for a session.
+// every failure gets the same response as a wrong password
+func (app *application) createLoginAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token string `json:"token"`
+		Email string `json:"email"`
+		Code  string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if input.Token != "" {
+		data.ValidateTokenPlaintext(v, input.Token)
+		v.Check(input.Email == "" && input.Code == "", "token", "must not be provided with an email and code")
+	} else {
+		data.ValidateEmail(v, input.Email)
+		data.ValidateLoginCode(v, input.Code)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ip := realip.FromRequest(r)
+
+	if !app.ipLoginAllowed(w, r, ip) {
+		return
+	}
+
+	var user *data.User
+	var method string
+
+	if input.Token != "" {
+		method = "magic_link"
+
+		// the link proves the user can read their email, so a lockout from password guesses doesn't apply
+		userID, err := app.models.Tokens.UseLoginToken(input.Token)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.failedLoginResponse(w, r, nil, envelope{"method": method})
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		user, err = app.models.Users.Get(userID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		method = "login_code"
+
+		user, err = app.models.Users.GetByEmail(input.Email)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.failedLoginResponse(w, r, nil, envelope{"method": method, "email_hash": auditEmailHash(input.Email)})
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		// codes are short enough to guess, so wrong ones count towards the lockout like wrong passwords
+		lockout, ok := app.emailLoginAllowed(w, r, user, envelope{"method": method})
+		if !ok {
+			return
+		}
+
+		err = app.models.Tokens.UseLoginCode(user.ID, input.Code)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.failedLoginResponse(w, r, user, envelope{"method": method})
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if lockout != nil {
+			err = app.models.Logins.Reset(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	}
+
+	app.startSession(w, r, user, method)
+}
@@ -3,11 +3,13 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	"log"
 	"log/slog"
+	"math"
 	"os"
 	"runtime"
 	"strings"
@@ -15,9 +17,15 @@ import (
 	"time"
 
 	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/jwt"
 	"github.com/Bekian/greenlight/internal/mailer"
+	"github.com/Bekian/greenlight/internal/oidc"
+	"github.com/Bekian/greenlight/internal/password"
+	"github.com/Bekian/greenlight/internal/totp"
 	"github.com/Bekian/greenlight/internal/vcs"
+	"github.com/Bekian/greenlight/internal/webhook"
 
+	"github.com/graphql-go/graphql"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
@@ -52,15 +60,94 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	sse struct {
+		heartbeat time.Duration // interval between heartbeat comments on event streams
+	}
+	webhooks struct {
+		pollInterval time.Duration // how often the queue is checked for due deliveries
+		timeout      time.Duration // timeout for a single delivery attempt
+		maxAttempts  int           // attempts before a delivery is marked dead
+	}
+	graphql struct {
+		maxDepth      int // deepest allowed field nesting in a query
+		maxComplexity int // highest allowed query cost, see graphqlCost
+	}
+	openapi struct {
+		validate bool // validate requests against the openapi spec
+	}
+	tokens struct {
+		accessTTL  time.Duration // lifetime of authentication tokens
+		jwtTTL     time.Duration // lifetime of jwt authentication tokens, short since they carry the user's permissions
+		refreshTTL time.Duration // lifetime of refresh tokens, each refresh issues a new one
+		format     string        // format of authentication tokens, opaque or jwt
+		jwtKeys    []string      // "<kid>:<alg>:<base64 key>", the first key signs
+	}
+	accounts struct {
+		deletionGrace time.Duration // how long a deleted account can still be restored
+	}
+	maintenance struct {
+		interval             time.Duration // time between maintenance runs
+		jitter               time.Duration // random extra delay added to each interval
+		batchSize            int           // rows deleted per statement
+		unactivatedAge       time.Duration // accounts never activated are deleted after this, 0 keeps them
+		movieEventsRetention time.Duration // how long movie events can still be resumed from
+		deliveriesRetention  time.Duration // how long finished webhook deliveries stay in the log
+	}
+	roles struct {
+		defaultRole string // role given to new users
+	}
+	registration struct {
+		mode           string        // open, invite-only or domain-allowlist
+		allowedDomains []string      // email domains that can register in domain-allowlist mode
+		inviteTTL      time.Duration // how long an invitation can be accepted for
+	}
+	permissions struct {
+		cacheTTL time.Duration // how long a user's perms are cached, 0 disables the cache
+	}
+	passwords struct {
+		minLength    int    // in characters, at least 8
+		minScore     int    // lowest strength score from 0 to 4, see password.Score
+		breachedFile string // sorted have i been pwned sha-1 list, empty to skip the check
+		hash         string // algorithm for new hashes, argon2id or bcrypt
+		bcryptCost   int
+		argon2id     struct {
+			memory      uint // in KiB
+			iterations  uint
+			parallelism uint
+		}
+	}
+	login struct {
+		maxAttempts   int           // failed logins before an account is locked
+		lockout       time.Duration // how long a locked account stays locked
+		ipMaxAttempts int           // failed logins from one ip before it's refused
+		ipWindow      time.Duration // period failed logins from an ip are counted over
+	}
+	oidc struct {
+		configFile string // json file listing the identity providers, see oidc.Config
+	}
+	mfa struct {
+		totpKey string // base64 key totp secrets are encrypted with at rest, empty turns off totp enrolment
+	}
 }
 
 // app struct for dep injection across the app
 type application struct {
-	config config
-	logger *slog.Logger
-	models data.Models
-	mailer *mailer.Mailer
-	wg     sync.WaitGroup
+	config      config
+	logger      *slog.Logger
+	models      data.Models
+	mailer      *mailer.Mailer
+	webhooks    *webhook.Client
+	jwt         *jwt.Signer               // nil unless jwt authentication tokens are enabled
+	oidc        map[string]*oidc.Provider // identity providers for single sign-on, by name
+	passwords   *password.Policy          // rules for new passwords
+	revoked     *tokenDenyList            // revoked jwt authentication tokens
+	permissions *permissionCache          // nil unless permission caching is enabled
+	clock       func() time.Time          // current time for totp codes, replaceable in tests
+	totpKey     []byte                    // encrypts totp secrets at rest, nil if totp enrolment is off
+	events      *movieBroker
+	graphql     graphql.Schema
+	openapi     envelope
+	wg          sync.WaitGroup
 }
 
 // DIFF Note: several CLI flag default values use local environment variables for security.
@@ -102,6 +189,80 @@ func main() {
 		return nil
 	})
 
+	// flag for server-sent event streams
+	flag.DurationVar(&cfg.sse.heartbeat, "sse-heartbeat", 15*time.Second, "Server-sent events heartbeat interval")
+
+	// flags for webhook deliveries
+	flag.DurationVar(&cfg.webhooks.pollInterval, "webhooks-poll-interval", 5*time.Second, "Webhook delivery queue poll interval")
+	flag.DurationVar(&cfg.webhooks.timeout, "webhooks-timeout", 10*time.Second, "Webhook delivery timeout")
+	flag.IntVar(&cfg.webhooks.maxAttempts, "webhooks-max-attempts", 8, "Webhook delivery attempts before giving up")
+
+	// flags for graphql query limits
+	flag.IntVar(&cfg.graphql.maxDepth, "graphql-max-depth", 6, "GraphQL maximum query depth")
+	flag.IntVar(&cfg.graphql.maxComplexity, "graphql-max-complexity", 1000, "GraphQL maximum query complexity")
+
+	// flag for openapi request validation
+	flag.BoolVar(&cfg.openapi.validate, "openapi-validate", false, "Validate requests against the OpenAPI spec")
+
+	// flags for token lifetimes
+	flag.DurationVar(&cfg.tokens.accessTTL, "token-access-ttl", 24*time.Hour, "Authentication token lifetime")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "token-refresh-ttl", 30*24*time.Hour, "Refresh token lifetime")
+	flag.StringVar(&cfg.tokens.format, "token-format", "opaque", "Authentication token format (opaque|jwt)")
+	flag.DurationVar(&cfg.tokens.jwtTTL, "token-jwt-ttl", 5*time.Minute, "JWT authentication token lifetime, used instead of -token-access-ttl")
+
+	// signing keys for jwt authentication tokens, use the env var to keep them out of the process list
+	cfg.tokens.jwtKeys = strings.Fields(os.Getenv("GREENLIGHT_JWT_KEYS"))
+	flag.Func("jwt-keys", "JWT signing keys as <kid>:<alg>:<base64 key> (space separated, the first key signs)", func(s string) error {
+		cfg.tokens.jwtKeys = strings.Fields(s)
+		return nil
+	})
+
+	// flags for account deletion
+	flag.DurationVar(&cfg.accounts.deletionGrace, "account-deletion-grace", 30*24*time.Hour, "Grace period before a deleted account is purged")
+
+	// flags for the maintenance reaper
+	flag.DurationVar(&cfg.maintenance.interval, "maintenance-interval", time.Hour, "Interval between maintenance runs")
+	flag.DurationVar(&cfg.maintenance.jitter, "maintenance-jitter", 5*time.Minute, "Maximum random delay added to each maintenance interval")
+	flag.IntVar(&cfg.maintenance.batchSize, "maintenance-batch-size", 1000, "Rows deleted per maintenance batch")
+	flag.DurationVar(&cfg.maintenance.unactivatedAge, "maintenance-unactivated-age", 30*24*time.Hour, "Age after which accounts that were never activated are deleted (0 keeps them)")
+	flag.DurationVar(&cfg.maintenance.movieEventsRetention, "maintenance-movie-events-retention", 7*24*time.Hour, "How long movie events are kept")
+	flag.DurationVar(&cfg.maintenance.deliveriesRetention, "maintenance-deliveries-retention", 30*24*time.Hour, "How long finished webhook deliveries are kept")
+
+	flag.StringVar(&cfg.roles.defaultRole, "default-role", "viewer", "Role given to new users")
+
+	// flags for who can register without an invitation
+	flag.StringVar(&cfg.registration.mode, "registration-mode", registrationOpen, "Who can register: open, invite-only or domain-allowlist")
+	flag.Func("registration-allowed-domains", "Email domains that can register in domain-allowlist mode (space separated)", func(s string) error {
+		cfg.registration.allowedDomains = strings.Fields(strings.ToLower(s))
+		return nil
+	})
+	flag.DurationVar(&cfg.registration.inviteTTL, "registration-invite-ttl", 7*24*time.Hour, "How long invitations can be accepted for")
+
+	// cached perms are dropped as soon as postgres reports a change, the ttl is a backstop
+	flag.DurationVar(&cfg.permissions.cacheTTL, "permissions-cache-ttl", 0, "How long user permissions are cached in memory (0 disables)")
+
+	flag.IntVar(&cfg.passwords.minLength, "password-min-length", 8, "Minimum password length in characters (at least 8)")
+	flag.IntVar(&cfg.passwords.minScore, "password-min-score", 3, "Minimum password strength score (0-4)")
+	flag.StringVar(&cfg.passwords.breachedFile, "password-breached-file", os.Getenv("GREENLIGHT_PASSWORD_BREACHED_FILE"), "Have I Been Pwned SHA-1 password list, ordered by hash")
+
+	// existing hashes made with other settings are upgraded when their users next log in
+	flag.StringVar(&cfg.passwords.hash, "password-hash", "argon2id", "Password hashing algorithm (argon2id|bcrypt)")
+	flag.IntVar(&cfg.passwords.bcryptCost, "password-bcrypt-cost", 12, "bcrypt cost")
+	flag.UintVar(&cfg.passwords.argon2id.memory, "password-argon2id-memory", 64*1024, "argon2id memory in KiB")
+	flag.UintVar(&cfg.passwords.argon2id.iterations, "password-argon2id-iterations", 3, "argon2id iterations")
+	flag.UintVar(&cfg.passwords.argon2id.parallelism, "password-argon2id-parallelism", 2, "argon2id parallelism")
+
+	flag.IntVar(&cfg.login.maxAttempts, "login-max-attempts", 10, "Failed logins before an account is locked")
+	flag.DurationVar(&cfg.login.lockout, "login-lockout", 15*time.Minute, "How long a locked account stays locked")
+	flag.IntVar(&cfg.login.ipMaxAttempts, "login-ip-max-attempts", 100, "Failed logins from one IP before it's refused")
+	flag.DurationVar(&cfg.login.ipWindow, "login-ip-window", 15*time.Minute, "Period failed logins from one IP are counted over")
+
+	// single sign-on is off unless identity providers are configured
+	flag.StringVar(&cfg.oidc.configFile, "oidc-config", os.Getenv("GREENLIGHT_OIDC_CONFIG"), "OpenID Connect providers config file (JSON)")
+
+	// key for totp secrets at rest, changing it invalidates every enrolment
+	flag.StringVar(&cfg.mfa.totpKey, "totp-key", os.Getenv("GREENLIGHT_TOTP_KEY"), "Base64 encoded 32-byte key TOTP secrets are encrypted with (TOTP enrolment is off without one)")
+
 	// flag to display version number and exit
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
@@ -157,10 +318,119 @@ func main() {
 
 	// declare app object and pass in it's properties
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer,
+		config:   cfg,
+		logger:   logger,
+		models:   data.NewModels(db),
+		mailer:   mailer,
+		webhooks: webhook.New(cfg.webhooks.timeout, "greenlight-webhooks/"+version),
+		events:   newMovieBroker(),
+		revoked:  newTokenDenyList(),
+		clock:    time.Now,
+		openapi:  openAPISpec(),
+	}
+
+	// set up jwt signing when jwt authentication tokens are enabled
+	switch cfg.tokens.format {
+	case "opaque":
+	case "jwt":
+		if cfg.tokens.jwtTTL <= 0 {
+			logger.Error("jwt token ttl must be positive")
+			os.Exit(1)
+		}
+
+		app.jwt, err = newJWTSigner(cfg.tokens.jwtKeys)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	default:
+		logger.Error("invalid token format, must be opaque or jwt", "format", cfg.tokens.format)
+		os.Exit(1)
+	}
+
+	// without a key nobody can enrol in totp, but users who already have can't be locked out
+	if cfg.mfa.totpKey != "" {
+		app.totpKey, err = totp.ParseKey(cfg.mfa.totpKey)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	} else {
+		enrolled, err := app.models.MFA.AnyTOTPEnabled()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		if enrolled {
+			logger.Error("users have totp enabled, -totp-key or GREENLIGHT_TOTP_KEY must be set")
+			os.Exit(1)
+		}
+	}
+
+	if cfg.maintenance.interval <= 0 || cfg.maintenance.batchSize < 1 {
+		logger.Error("maintenance interval and batch size must be positive")
+		os.Exit(1)
+	}
+
+	switch cfg.registration.mode {
+	case registrationOpen, registrationInviteOnly:
+	case registrationDomainAllowlist:
+		if len(cfg.registration.allowedDomains) == 0 {
+			logger.Error("domain-allowlist registration needs at least one allowed domain")
+			os.Exit(1)
+		}
+	default:
+		logger.Error("invalid registration mode, must be open, invite-only or domain-allowlist", "mode", cfg.registration.mode)
+		os.Exit(1)
+	}
+
+	if cfg.registration.inviteTTL <= 0 {
+		logger.Error("invitation ttl must be positive")
+		os.Exit(1)
+	}
+
+	// the default role has to exist, or new users would get no permissions
+	err = app.models.Roles.Exists(cfg.roles.defaultRole)
+	if err != nil {
+		logger.Error("default role can't be used", "role", cfg.roles.defaultRole, "error", err.Error())
+		os.Exit(1)
+	}
+
+	// cache perms when enabled, publishing the hit and miss counts to metrics
+	if cfg.permissions.cacheTTL > 0 {
+		app.permissions = newPermissionCache(cfg.permissions.cacheTTL)
+
+		expvar.Publish("permissions_cache", expvar.Func(func() any {
+			return app.permissions.stats()
+		}))
+	}
+
+	// set up password hashing and the password policy
+	app.models.Users.Hasher, err = newPasswordHasher(cfg)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	app.passwords, err = newPasswordPolicy(cfg)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// load the identity providers for single sign-on
+	app.oidc, err = loadOIDCProviders(cfg.oidc.configFile)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// build the graphql schema, this needs the app for its resolvers
+	app.graphql, err = app.graphqlSchema()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
 
 	err = app.serve()
@@ -197,3 +467,52 @@ func openDB(cfg config) (*sql.DB, error) {
 	// success
 	return db, nil
 }
+
+// build the password hasher from the config
+func newPasswordHasher(cfg config) (*password.Hasher, error) {
+	hasher := password.DefaultHasher()
+
+	a := cfg.passwords.argon2id
+	if a.memory > math.MaxUint32 || a.iterations > math.MaxUint32 || a.parallelism > math.MaxUint8 {
+		return nil, errors.New("argon2id parameters are out of range")
+	}
+
+	hasher.Algorithm = cfg.passwords.hash
+	hasher.BcryptCost = cfg.passwords.bcryptCost
+	hasher.Argon2id.Memory = uint32(a.memory)
+	hasher.Argon2id.Iterations = uint32(a.iterations)
+	hasher.Argon2id.Parallelism = uint8(a.parallelism)
+
+	err := hasher.Check()
+	if err != nil {
+		return nil, err
+	}
+
+	return hasher, nil
+}
+
+// build the password policy from the config, opening the breached password list if there is one
+func newPasswordPolicy(cfg config) (*password.Policy, error) {
+	if cfg.passwords.minLength < 8 {
+		return nil, errors.New("password-min-length must be at least 8")
+	}
+
+	if cfg.passwords.minScore < 0 || cfg.passwords.minScore > 4 {
+		return nil, errors.New("password-min-score must be between 0 and 4")
+	}
+
+	policy := &password.Policy{
+		MinLength: cfg.passwords.minLength,
+		MinScore:  cfg.passwords.minScore,
+	}
+
+	if cfg.passwords.breachedFile != "" {
+		list, err := password.OpenBreachedList(cfg.passwords.breachedFile)
+		if err != nil {
+			return nil, err
+		}
+		policy.Breached = list
+	}
+
+	return policy, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"math/rand/v2"
+	"time"
+)
+
+// maintenance metrics, published under /debug/vars
+var (
+	maintenanceRuns    = expvar.NewInt("maintenance_runs")
+	maintenanceLastRun = expvar.NewInt("maintenance_last_run") // unix time the last run finished
+	maintenanceDeleted = expvar.NewMap("maintenance_deleted")  // rows deleted, by task
+	maintenanceErrors  = expvar.NewMap("maintenance_errors")   // failed batches, by task
+)
+
+// a maintenance task deletes up to limit stale rows, returning how many it deleted
+type maintenanceTask struct {
+	name string
+	run  func(limit int) (int64, error)
+}
+
+// the tasks run on every maintenance pass
+func (app *application) maintenanceTasks() []maintenanceTask {
+	cfg := app.config.maintenance
+
+	tasks := []maintenanceTask{
+		{"expired_tokens", app.models.Tokens.DeleteExpired},
+		{"token_revocations", app.models.Tokens.DeleteExpiredRevocations},
+		{"oidc_logins", app.models.Identities.DeleteExpiredLogins},
+		{"expired_invitations", app.models.Invitations.DeleteExpired},
+		{"deleted_users", app.deleteScheduledUsers},
+		{"login_failures", func(limit int) (int64, error) {
+			return app.models.Logins.DeleteFailuresBefore(time.Now().Add(-app.config.login.ipWindow), limit)
+		}},
+		{"movie_events", func(limit int) (int64, error) {
+			return app.models.MovieEvents.DeleteBefore(time.Now().Add(-cfg.movieEventsRetention), limit)
+		}},
+		{"webhook_deliveries", func(limit int) (int64, error) {
+			return app.models.Deliveries.DeleteFinishedBefore(time.Now().Add(-cfg.deliveriesRetention), limit)
+		}},
+	}
+
+	// deleting accounts is opt out, an age of 0 keeps them
+	if cfg.unactivatedAge > 0 {
+		tasks = append(tasks, maintenanceTask{"unactivated_users", app.deleteUnactivatedUsers})
+	}
+
+	return tasks
+}
+
+// run the maintenance tasks every interval, plus up to jitter so instances don't all run at once,
+// until the context is cancelled. this should be run with app.background
+func (app *application) runMaintenance(ctx context.Context) {
+	cfg := app.config.maintenance
+	tasks := app.maintenanceTasks()
+
+	timer := time.NewTimer(maintenanceDelay(0, cfg.jitter))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			for _, task := range tasks {
+				app.runMaintenanceTask(ctx, task)
+			}
+
+			maintenanceRuns.Add(1)
+			maintenanceLastRun.Set(time.Now().Unix())
+
+			timer.Reset(maintenanceDelay(cfg.interval, cfg.jitter))
+		}
+	}
+}
+
+// run a task in batches until it runs out of rows or the context is cancelled.
+// a batch that's already started is allowed to finish, so shutdown waits for at most one
+func (app *application) runMaintenanceTask(ctx context.Context, task maintenanceTask) {
+	batchSize := app.config.maintenance.batchSize
+
+	var total int64
+
+	for ctx.Err() == nil {
+		n, err := task.run(batchSize)
+		if err != nil {
+			maintenanceErrors.Add(task.name, 1)
+			app.logger.Error(err.Error(), "task", task.name)
+			break
+		}
+
+		total += n
+		maintenanceDeleted.Add(task.name, n)
+
+		if n < int64(batchSize) {
+			break
+		}
+	}
+
+	if total > 0 {
+		app.logger.Info("maintenance task finished", "task", task.name, "deleted", total)
+	}
+}
+
+// delete accounts whose deletion grace period has passed
+func (app *application) deleteScheduledUsers(limit int) (int64, error) {
+	ids, err := app.models.Users.PurgeScheduledDeletions(limit)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		app.enqueueWebhookEvent("user.deleted", envelope{"user": envelope{"id": id}})
+	}
+
+	return int64(len(ids)), nil
+}
+
+// delete accounts that were never activated, announcing them like any other deleted user
+func (app *application) deleteUnactivatedUsers(limit int) (int64, error) {
+	before := time.Now().Add(-app.config.maintenance.unactivatedAge)
+
+	ids, err := app.models.Users.DeleteUnactivated(before, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		app.enqueueWebhookEvent("user.deleted", envelope{"user": envelope{"id": id}})
+	}
+
+	return int64(len(ids)), nil
+}
+
+// interval plus a random part of jitter
+func maintenanceDelay(interval, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+
+	return interval + rand.N(jitter)
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/totp"
+	"github.com/Bekian/greenlight/internal/validator"
+)
+
+// issuer shown by authenticator apps
+const totpIssuer = "Greenlight"
+
+// how long the user has to enter their code after their password
+const mfaTokenTTL = 5 * time.Minute
+
+// wrong codes allowed before pending logins are cancelled and the password is needed again
+const mfaMaxFailedAttempts = 5
+
+// check a totp code or a recovery code against the user's enrolment.
+// a code is only accepted once, a recovery code is used up
+func (app *application) verifySecondFactor(enrolment *data.TOTP, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		err := app.models.MFA.UseRecoveryCode(enrolment.UserID, recoveryCode)
+		switch {
+		case err == nil:
+			return true, nil
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	step, ok, err := app.validateTOTP(enrolment, code)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	err = app.models.MFA.UseTOTPStep(enrolment.UserID, step)
+	switch {
+	case err == nil:
+		return true, nil
+	// the code was already used
+	case errors.Is(err, data.ErrRecordNotFound):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// check a totp code against the enrolment's secret at the current time,
+// returning the matching step so it can be marked as used
+func (app *application) validateTOTP(enrolment *data.TOTP, code string) (int64, bool, error) {
+	secret, err := totp.DecryptSecret(app.totpKey, enrolment.Secret)
+	if err != nil {
+		return 0, false, err
+	}
+
+	step, ok := totp.Validate(secret, code, app.clock())
+	return step, ok, nil
+}
+
+// count a wrong code, cancelling pending logins once there have been too many
+func (app *application) recordFailedSecondFactor(userID int64) error {
+	attempts, err := app.models.MFA.RecordFailedAttempt(userID)
+	if err != nil {
+		return err
+	}
+
+	if attempts < mfaMaxFailedAttempts {
+		return nil
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeMFA, userID)
+	if err != nil {
+		return err
+	}
+
+	return app.models.MFA.ResetFailedAttempts(userID)
+}
+
+// the second step of logging in for users with two-factor authentication
+func (app *application) createMFAAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	// report token errors under the field name the client used
+	data.ValidateTokenPlaintext(v, input.MFAToken)
+	if message, found := v.Errors["token"]; found {
+		delete(v.Errors, "token")
+		v.AddError("mfa_token", message)
+	}
+
+	v.Check(input.Code != "" || input.RecoveryCode != "", "code", "must be provided")
+	v.Check(input.Code == "" || input.RecoveryCode == "", "code", "must not be provided with a recovery code")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeMFA, input.MFAToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("mfa_token", "invalid or expired mfa token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	enrolment, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil {
+		switch {
+		// two-factor authentication was turned off after the password was checked
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("mfa_token", "invalid or expired mfa token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ok, err := app.verifySecondFactor(enrolment, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// say which kind of code was used in the audit log
+	method := "totp"
+	if input.RecoveryCode != "" {
+		method = "recovery_code"
+	}
+
+	if !ok {
+		err = app.recordFailedSecondFactor(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.audit(r, data.AuditLoginFailed, user.ID, envelope{"method": method})
+
+		v.AddError("code", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// the mfa token can only be used once
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeMFA, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env, err := app.newSessionTokens(r, user, data.NewTokenFamily())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditLoginSucceeded, user.ID, envelope{"method": method})
+
+	err = app.writeResponse(w, r, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// show whether two-factor authentication is enabled for the current user
+func (app *application) showMFAHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	enabled := false
+
+	enrolment, err := app.models.MFA.GetTOTP(user.ID)
+	switch {
+	case err == nil:
+		enabled = enrolment.Enabled
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	remaining, err := app.models.MFA.CountRecoveryCodes(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"mfa": envelope{"totp_enabled": enabled, "recovery_codes_remaining": remaining}}
+
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// start enrolling in totp, this returns the secret to add to an authenticator app
+func (app *application) createTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if app.totpKey == nil {
+		app.totpUnavailableResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Password != "", "password", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	match, err := app.passwordMatches(user, input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	secret := totp.GenerateSecret()
+
+	// only the encrypted secret is stored, the user sees it once here
+	encrypted, err := totp.EncryptSecret(app.totpKey, secret)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.MFA.StartTOTP(user.ID, encrypted)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			v.AddError("totp", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"totp": envelope{
+		"secret":           secret,
+		"provisioning_uri": totp.ProvisioningURI(totpIssuer, user.Email, secret),
+	}}
+
+	err = app.writeResponse(w, r, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// finish enrolling by confirming a code from the authenticator app,
+// this enables two-factor authentication and returns the recovery codes
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if app.totpKey == nil {
+		app.totpUnavailableResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Code != "", "code", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	enrolment, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("totp", "enrolment must be started first")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if enrolment.Enabled {
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	step, ok, err := app.validateTOTP(enrolment, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		v.AddError("code", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	codes := data.GenerateRecoveryCodes()
+
+	err = app.models.MFA.EnableTOTP(user.ID, step, codes)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			v.AddError("totp", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditMFAEnabled, user.ID, nil)
+
+	// the recovery codes are only stored hashed, so this is the only time they're shown
+	env := envelope{
+		"message":        "two-factor authentication is enabled, store the recovery codes somewhere safe",
+		"recovery_codes": codes,
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// turn off two-factor authentication, this needs the password and a code
+func (app *application) deleteTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Password != "", "password", "must be provided")
+	v.Check(input.Code == "" || input.RecoveryCode == "", "code", "must not be provided with a recovery code")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	enrolment, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// wrong passwords and codes count towards the login lockout, so a stolen session
+	// can't be used to guess them any faster than logging in would allow
+	if _, ok := app.loginAllowed(w, r, user); !ok {
+		return
+	}
+
+	match, err := app.passwordMatches(user, input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		err = app.recordFailedLogin(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// an enrolment that was never confirmed can be removed with just the password
+	if enrolment.Enabled {
+		if v.Check(input.Code != "" || input.RecoveryCode != "", "code", "must be provided"); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		ok, err := app.verifySecondFactor(enrolment, input.Code, input.RecoveryCode)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !ok {
+			err = app.recordFailedSecondFactor(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			err = app.recordFailedLogin(r, user)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			v.AddError("code", "is incorrect")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	err = app.models.MFA.DeleteTOTP(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if enrolment.Enabled {
+		app.audit(r, data.AuditMFADisabled, user.ID, nil)
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "two-factor authentication is disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/totp"
+)
+
+func TestValidateTOTP(t *testing.T) {
+	app := newTestApplication(t)
+
+	now := time.Unix(1700000000, 0)
+	app.clock = func() time.Time { return now }
+
+	secret := totp.GenerateSecret()
+	encrypted, err := totp.EncryptSecret(app.totpKey, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := totp.Step(now)
+
+	tests := []struct {
+		name   string
+		step   int64
+		wantOK bool
+	}{
+		{"current step", current, true},
+		{"one step behind", current - 1, true},
+		{"one step ahead", current + 1, true},
+		{"two steps behind", current - 2, false},
+		{"two steps ahead", current + 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := totp.Code(secret, tt.step)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			step, ok, err := app.validateTOTP(&data.TOTP{Secret: encrypted}, code)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ok != tt.wantOK {
+				t.Errorf("got %v, want %v", ok, tt.wantOK)
+			}
+			if ok && step != tt.step {
+				t.Errorf("got step %d, want %d", step, tt.step)
+			}
+		})
+	}
+
+	t.Run("wrong key", func(t *testing.T) {
+		code, _ := totp.Code(secret, current)
+
+		other := newTestApplication(t)
+		other.totpKey = make([]byte, totp.KeySize)
+
+		if _, _, err := other.validateTOTP(&data.TOTP{Secret: encrypted}, code); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestVerifySecondFactorRejectsReplays(t *testing.T) {
+	app := newTestApplication(t)
+	app.models = data.NewModels(newTestDB(t))
+
+	now := time.Unix(1700000000, 0)
+	app.clock = func() time.Time { return now }
+
+	user := &data.User{Name: "Test", Email: "totp@example.com"}
+	if err := app.models.Users.SetPassword(user, "pa55word1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Users.Insert(user); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := totp.GenerateSecret()
+	encrypted, err := totp.EncryptSecret(app.totpKey, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.MFA.StartTOTP(user.ID, encrypted); err != nil {
+		t.Fatal(err)
+	}
+	// enrolment is confirmed with a code from a minute ago
+	if err := app.models.MFA.EnableTOTP(user.ID, totp.Step(now)-2, data.GenerateRecoveryCodes()); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(step int64) bool {
+		t.Helper()
+
+		enrolment, err := app.models.MFA.GetTOTP(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		code, err := totp.Code(secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ok, err := app.verifySecondFactor(enrolment, code, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	current := totp.Step(now)
+
+	if !verify(current) {
+		t.Fatal("the current code was rejected")
+	}
+	if verify(current) {
+		t.Error("the same code was accepted twice")
+	}
+	// still inside the skew window, but older than the code already used
+	if verify(current - 1) {
+		t.Error("an earlier code was accepted after a later one")
+	}
+
+	now = now.Add(totp.Period)
+
+	if !verify(current + 1) {
+		t.Error("the next step's code was rejected")
+	}
+}
+
+func TestTOTPEnrolmentNeedsKey(t *testing.T) {
+	app := newTestApplication(t)
+	app.totpKey = nil
+
+	handlers := map[string]http.HandlerFunc{
+		"create":  app.createTOTPHandler,
+		"confirm": app.confirmTOTPHandler,
+	}
+
+	for name, handler := range handlers {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/v1/users/me/mfa/totp", strings.NewReader(`{"password": "pa55word1234"}`))
+
+		handler(rr, r)
+
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: got status %d, want %d", name, rr.Code, http.StatusServiceUnavailable)
+		}
+	}
+}
@@ -5,12 +5,14 @@ import (
 	"expvar"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/jwt"
 	"github.com/Bekian/greenlight/internal/validator"
 
 	"github.com/tomasen/realip"
@@ -123,6 +125,13 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// split the auth header into its parts,
 		// if its not in the format we expect return 401
 		headerParts := strings.Split(authorizationHeader, " ")
+
+		// machine clients use an api key instead of a token
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			app.authenticateAPIKey(w, r, headerParts[1], next)
+			return
+		}
+
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
@@ -131,6 +140,32 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// get the token from the header parts
 		token := headerParts[1]
 
+		// jwts carry everything needed to authenticate the request, so the db isn't used
+		if app.jwt != nil && jwt.LooksLikeJWT(token) {
+			claims, err := app.jwt.Verify(token, time.Now())
+			if err != nil || app.revoked.contains(token) {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			id, err := strconv.ParseInt(claims.Subject, 10, 64)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			// only the id and activation state are known,
+			// handlers that need the rest of the user read it from the db
+			user := &data.User{ID: id, Activated: claims.Activated}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetToken(r, token)
+			r = app.contextSetPermissions(r, claims.Permissions)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// init a validator instance so we can validate the token
 		v := validator.New()
 
@@ -142,7 +177,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		// get the user that matches the auth token,
 		// otherwise use invalid auth token response
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, lastUsed, err := app.models.Users.GetForSession(token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -153,14 +188,75 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		// record when the session was last used, a failure here shouldn't fail the request
+		if data.NeedsTouch(lastUsed, time.Now()) {
+			err = app.models.Tokens.Touch(token)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		}
+
+		// load the perms once here, handlers and requirePerm read them from the context
+		perms, err := app.permissionsForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		// use contextSetUser helper to add user to context
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
+		r = app.contextSetPermissions(r, perms)
 
 		// call next handler
 		next.ServeHTTP(w, r)
 	})
 }
 
+// authenticate a request made with an api key,
+// the key is limited to the permissions the user still has as well as the ones it was created with
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, plaintext string, next http.Handler) {
+	v := validator.New()
+
+	if data.ValidateAPIKeyPlaintext(v, plaintext); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	key, user, err := app.models.APIKeys.GetForPlaintext(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	userPerms, err := app.permissionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// the key can only use the perms its user still has
+	perms := key.Permissions.Intersect(userPerms)
+
+	if data.NeedsTouch(key.LastUsedAt, time.Now()) {
+		err = app.models.APIKeys.Touch(key.ID)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+	r = app.contextSetPermissions(r, perms)
+
+	next.ServeHTTP(w, r)
+}
+
 // middleware to check if a user isnt anonymous
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -195,23 +291,43 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// reject requests made with an api key, for endpoints that manage the account itself.
+// otherwise a key limited to a few permissions could be used to create a broader one
+func (app *application) rejectAPIKeys(next http.HandlerFunc) http.HandlerFunc {
+	// this is the innermost check for account endpoints, so the request is validated after it
+	next = app.validateOperation(next)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.apiKeyNotAllowedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
 // first param is perm code that the user must have to use the endpoint
 // DIFF Note: 16.4 is called "requirePermission"
 func (app *application) requirePerm(code string, next http.HandlerFunc) http.HandlerFunc {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		// get user from context
-		user := app.contextGetUser(r)
+	return app.requireAnyPerm([]string{code}, next)
+}
+
+// like requirePerm, but any one of the perm codes is enough.
+// used where a handler narrows things down further with a policy, e.g. movies:write:own
+func (app *application) requireAnyPerm(codes []string, next http.HandlerFunc) http.HandlerFunc {
+	// the request is only validated once the user is known to be allowed to make it
+	next = app.validateOperation(next)
 
-		// get perms from user
-		// DIFF Note: perms is "permisisons"
-		perms, err := app.models.Permissions.GetAllForUser(user.ID)
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		perms, err := app.userPermissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
 
-		// check if slice has the required perm code
-		if !perms.Include(code) {
+		// check if slice has one of the required perm codes
+		if !slices.ContainsFunc(codes, perms.Include) {
 			app.notPermittedResponse(w, r)
 			return
 		}
@@ -224,6 +340,18 @@ func (app *application) requirePerm(code string, next http.HandlerFunc) http.Han
 	return app.requireActivatedUser(fn)
 }
 
+// get the perms for the request's user
+func (app *application) userPermissions(r *http.Request) (data.Permissions, error) {
+	// authenticate already loaded them
+	// DIFF Note: perms is "permisisons"
+	perms, found := app.contextGetPermissions(r)
+	if found {
+		return perms, nil
+	}
+
+	return app.permissionsForUser(app.contextGetUser(r).ID)
+}
+
 // temporary middleware wrapper to allow all cors requests
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
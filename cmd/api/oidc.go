@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/oidc"
+	"github.com/Bekian/greenlight/internal/validator"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// how long the user has to log in at the identity provider
+const oidcLoginTTL = 10 * time.Minute
+
+// provider names are used in urls
+var oidcProviderNameRX = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// read the identity providers from the config file, no file means single sign-on is off
+func loadOIDCProviders(path string) (map[string]*oidc.Provider, error) {
+	providers := make(map[string]*oidc.Provider)
+
+	if path == "" {
+		return providers, nil
+	}
+
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []oidc.Config
+
+	err = json.Unmarshal(file, &configs)
+	if err != nil {
+		return nil, fmt.Errorf("oidc config: %w", err)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	for _, cfg := range configs {
+		switch {
+		case !oidcProviderNameRX.MatchString(cfg.Name):
+			return nil, fmt.Errorf("oidc config: invalid provider name %q", cfg.Name)
+		case providers[cfg.Name] != nil:
+			return nil, fmt.Errorf("oidc config: duplicate provider %q", cfg.Name)
+		case cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "":
+			return nil, fmt.Errorf("oidc config: provider %q needs an issuer, client_id and redirect_url", cfg.Name)
+		}
+
+		providers[cfg.Name] = oidc.NewProvider(cfg, client)
+	}
+
+	return providers, nil
+}
+
+// get the provider named in the url
+func (app *application) readOIDCProvider(r *http.Request) (*oidc.Provider, bool) {
+	provider, found := app.oidc[httprouter.ParamsFromContext(r.Context()).ByName("provider")]
+	return provider, found
+}
+
+// list the identity providers users can log in with
+func (app *application) listOIDCProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	providers := []envelope{}
+
+	for _, name := range slices.Sorted(maps.Keys(app.oidc)) {
+		providers = append(providers, envelope{"name": name, "issuer": app.oidc[name].Issuer})
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"providers": providers}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// start logging in at an identity provider, the client sends the user to the returned url.
+// the provider redirects back to its redirect_url with a code and state for the callback
+func (app *application) createOIDCAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	provider, found := app.readOIDCProvider(r)
+	if !found {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	verifier, challenge := oidc.NewPKCE()
+
+	login := &data.OIDCLogin{
+		State:        rand.Text(),
+		Provider:     provider.Name,
+		Nonce:        rand.Text(),
+		CodeVerifier: verifier,
+		Expiry:       time.Now().Add(oidcLoginTTL),
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), login.State, login.Nonce, challenge)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Identities.InsertLogin(login)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"authorization_url": authURL}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// finish logging in at an identity provider.
+// the identity is linked to an existing user by its verified email the first time it's used,
+// and users are created for unknown emails if the provider allows signups
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider, found := app.readOIDCProvider(r)
+	if !found {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+
+	v := validator.New()
+
+	// the provider redirects with an error instead of a code if the user didn't log in
+	if message := qs.Get("error"); message != "" {
+		v.AddError("code", "the identity provider returned an error: "+message)
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	code, state := qs.Get("code"), qs.Get("state")
+
+	v.Check(code != "", "code", "must be provided")
+	v.Check(state != "", "state", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	login, err := app.models.Identities.TakeLogin(provider.Name, state)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("state", "invalid or expired state")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		app.logger.Warn("oidc login failed", "provider", provider.Name, "error", err.Error())
+		app.audit(r, data.AuditLoginFailed, 0, envelope{"method": "oidc", "provider": provider.Name})
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Identities.GetUser(provider.Name, claims.Subject)
+	if err != nil {
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		user, err = app.linkOIDCIdentity(r, provider, claims, v)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	app.startSession(w, r, user, "oidc")
+}
+
+// link a new identity to the user with the same verified email, creating the user if allowed.
+// reasons the identity can't be linked are added to the validator
+func (app *application) linkOIDCIdentity(r *http.Request, provider *oidc.Provider, claims *oidc.Claims, v *validator.Validator) (*data.User, error) {
+	if claims.Email == "" || !claims.EmailVerified {
+		v.AddError("email", "the identity provider did not return a verified email address")
+		return nil, nil
+	}
+
+	user, err := app.models.Users.GetByEmail(claims.Email)
+	switch {
+	case err == nil:
+		// whoever registered an unactivated account hasn't proven they own the email,
+		// linking it would let them log in to the account with its password later
+		if !user.Activated {
+			v.AddError("email", "an account with this email address must be activated before it can be linked")
+			return nil, nil
+		}
+	case errors.Is(err, data.ErrRecordNotFound):
+		if !provider.AllowSignup {
+			v.AddError("email", "no account with this email address exists")
+			return nil, nil
+		}
+
+		user, err = app.createOIDCUser(r, provider, claims, v)
+		if err != nil || !v.Valid() {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	identity := &data.Identity{
+		UserID:   user.ID,
+		Provider: provider.Name,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}
+
+	err = app.models.Identities.Insert(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	app.audit(r, data.AuditIdentityLinked, user.ID, envelope{"provider": provider.Name})
+
+	return user, nil
+}
+
+// create an activated user for a verified email, they can set a password with a password reset
+func (app *application) createOIDCUser(r *http.Request, provider *oidc.Provider, claims *oidc.Claims, v *validator.Validator) (*data.User, error) {
+	name := claims.Name
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+
+	user := &data.User{
+		Name:      name,
+		Email:     claims.Email,
+		Activated: true,
+	}
+
+	// nobody knows this password, so the account can only be used through the provider until it's reset
+	err := app.models.Users.SetPassword(user, rand.Text())
+	if err != nil {
+		return nil, err
+	}
+
+	// the registration mode applies to signups through a provider too
+	data.ValidateUser(v, user, app.models.Users.Hasher.MaxLength())
+	app.validateRegistration(v, user.Email)
+
+	if !v.Valid() {
+		return nil, nil
+	}
+
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		switch {
+		// the email was registered since it was looked up
+		case errors.Is(err, data.ErrDuplicateEmail):
+			return nil, data.ErrEditConflict
+		default:
+			return nil, err
+		}
+	}
+
+	err = app.models.Roles.AddForUser(user.ID, app.config.roles.defaultRole)
+	if err != nil {
+		return nil, err
+	}
+
+	app.enqueueWebhookEvent("user.created", envelope{"user": user})
+	app.audit(r, data.AuditUserRegistered, user.ID, envelope{"method": "oidc", "provider": provider.Name})
+
+	return user, nil
+}
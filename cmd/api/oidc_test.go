@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/oidc"
+	"github.com/Bekian/greenlight/internal/validator"
+)
+
+func TestLinkOIDCIdentityUnverifiedEmail(t *testing.T) {
+	app := newTestApplication(t)
+	provider := oidc.NewProvider(oidc.Config{Name: "test", AllowSignup: true}, http.DefaultClient)
+
+	for _, claims := range []*oidc.Claims{
+		{Subject: "user-1", Email: "alice@example.com"},
+		{Subject: "user-1", EmailVerified: true},
+	} {
+		v := validator.New()
+		r := httptest.NewRequest(http.MethodGet, "/v1/oidc/test/callback", nil)
+
+		user, err := app.linkOIDCIdentity(r, provider, claims, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if user != nil {
+			t.Errorf("got user %d, want none", user.ID)
+		}
+		if v.Errors["email"] == "" {
+			t.Errorf("claims %+v: expected an email error", claims)
+		}
+	}
+}
+
+func TestLinkOIDCIdentity(t *testing.T) {
+	app := newTestApplication(t)
+	app.models = data.NewModels(newTestDB(t))
+
+	unactivated := &data.User{Name: "Bob", Email: "bob@example.com"}
+	if err := app.models.Users.SetPassword(unactivated, "pa55word1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Users.Insert(unactivated); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		email       string
+		allowSignup bool
+	}{
+		{"unactivated account", "bob@example.com", true},
+		{"unknown email without signups", "carol@example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := oidc.NewProvider(oidc.Config{Name: "test", AllowSignup: tt.allowSignup}, http.DefaultClient)
+			claims := &oidc.Claims{Subject: tt.name, Email: tt.email, EmailVerified: true}
+
+			v := validator.New()
+			r := httptest.NewRequest(http.MethodGet, "/v1/oidc/test/callback", nil)
+
+			user, err := app.linkOIDCIdentity(r, provider, claims, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if user != nil {
+				t.Errorf("got user %d, want none", user.ID)
+			}
+			if v.Errors["email"] == "" {
+				t.Error("expected an email error")
+			}
+
+			// nothing was linked
+			_, err = app.models.Identities.GetUser(provider.Name, claims.Subject)
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				t.Errorf("got %v, want %v", err, data.ErrRecordNotFound)
+			}
+		})
+	}
+}
@@ -0,0 +1,1225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/validator"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// a json schema, or any other part of the openapi document
+type schema = map[string]any
+
+// a documented api operation, the spec is generated from these
+type apiOperation struct {
+	method   string
+	path     string // httprouter format, e.g. /v1/movies/:id
+	summary  string
+	tag      string
+	perm     string     // permission code required by requirePerm, if any
+	auth     bool       // requires an authenticated user but no specific permission
+	noAPIKey bool       // api keys are rejected, see rejectAPIKeys
+	query    []apiParam // query string parameters
+	body     schema     // request body schema, nil if the operation takes no body
+	status   int        // success status code
+	response schema     // success response schema
+	stream   bool       // response is a text/event-stream
+	ndjson   bool       // response is newline delimited json, one response document per line
+	// longer explanation shown under the summary
+	description string
+}
+
+// a query string parameter
+type apiParam struct {
+	name        string
+	schema      schema
+	description string
+}
+
+// schema helpers to keep the operation list readable
+func ref(name string) schema {
+	return schema{"$ref": "#/components/schemas/" + name}
+}
+
+func object(required []string, properties schema) schema {
+	s := schema{"type": "object", "properties": properties, "additionalProperties": false}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func arrayOf(items schema) schema {
+	return schema{"type": "array", "items": items}
+}
+
+func stringSchema() schema {
+	return schema{"type": "string"}
+}
+
+func integerSchema() schema {
+	return schema{"type": "integer"}
+}
+
+func booleanSchema() schema {
+	return schema{"type": "boolean"}
+}
+
+func dateTimeSchema() schema {
+	return schema{"type": "string", "format": "date-time"}
+}
+
+// an envelope with a single key, matching the envelope type used by writeResponse
+func envelopeOf(key string, value schema) schema {
+	return object([]string{key}, schema{key: value})
+}
+
+// pagination query parameters shared by list endpoints
+func paginationParams(sorts ...string) []apiParam {
+	return []apiParam{
+		{name: "page", schema: schema{"type": "integer", "minimum": 1, "maximum": 10_000_000, "default": 1}},
+		{name: "page_size", schema: schema{"type": "integer", "minimum": 1, "maximum": 100, "default": 20}},
+		{name: "sort", schema: schema{"type": "string", "enum": sorts}},
+	}
+}
+
+// filter query parameters shared by the audit log list and export
+func auditParams() []apiParam {
+	return []apiParam{
+		{name: "action", schema: stringSchema(), description: "comma separated list of actions"},
+		{name: "actor_id", schema: schema{"type": "integer", "minimum": 1}},
+		{name: "user_id", schema: schema{"type": "integer", "minimum": 1}},
+		{name: "ip", schema: stringSchema()},
+		{name: "since", schema: dateTimeSchema(), description: "only events at or after this time"},
+		{name: "until", schema: dateTimeSchema(), description: "only events before this time"},
+	}
+}
+
+// reusable schemas, referenced with ref()
+var apiSchemas = schema{
+	"Runtime": schema{
+		"type":        "string",
+		"pattern":     `^[0-9]+ mins$`,
+		"description": "movie runtime in minutes, formatted as \"<n> mins\"",
+		"examples":    []string{"102 mins"},
+	},
+	"Movie": object([]string{"id", "title", "version"}, schema{
+		"id":      integerSchema(),
+		"title":   stringSchema(),
+		"year":    integerSchema(),
+		"runtime": ref("Runtime"),
+		"genres":  arrayOf(stringSchema()),
+		"version": integerSchema(),
+		// null for movies added before this was recorded, or whose creator was deleted
+		"created_by": schema{"type": []string{"integer", "null"}},
+	}),
+	"MovieEvent": object([]string{"id", "created_at", "action", "movie_id"}, schema{
+		"id":         integerSchema(),
+		"created_at": dateTimeSchema(),
+		"action":     schema{"type": "string", "enum": []string{"created", "updated", "deleted"}},
+		"movie_id":   integerSchema(),
+		"movie":      ref("Movie"),
+	}),
+	"AuditEvent": object([]string{"id", "created_at", "action", "actor_id", "user_id", "ip", "user_agent", "details"}, schema{
+		"id":         integerSchema(),
+		"created_at": dateTimeSchema(),
+		"action":     schema{"type": "string", "enum": data.AuditActions},
+		// the authenticated user who made the request, null for anonymous requests like logins
+		"actor_id": schema{"type": []string{"integer", "null"}},
+		// the user the event is about
+		"user_id":    schema{"type": []string{"integer", "null"}},
+		"ip":         stringSchema(),
+		"user_agent": stringSchema(),
+		"details":    schema{"type": "object", "description": "depends on the action, e.g. the scope of an issued token"},
+	}),
+	"Invitation": object([]string{"id", "created_at", "email", "invited_by", "roles", "permissions", "expiry"}, schema{
+		"id":          integerSchema(),
+		"created_at":  dateTimeSchema(),
+		"email":       schema{"type": "string", "format": "email"},
+		"invited_by":  schema{"type": []string{"integer", "null"}},
+		"roles":       arrayOf(stringSchema()),
+		"permissions": arrayOf(stringSchema()),
+		"expiry":      dateTimeSchema(),
+		// only present once the invitation is accepted
+		"accepted_at": dateTimeSchema(),
+		"user_id":     integerSchema(),
+	}),
+	"Metadata": object(nil, schema{
+		"current_page":  integerSchema(),
+		"page_size":     integerSchema(),
+		"first_page":    integerSchema(),
+		"last_page":     integerSchema(),
+		"total_records": integerSchema(),
+	}),
+	"User": object([]string{"id", "created_at", "name", "email", "activated", "version"}, schema{
+		"id":         integerSchema(),
+		"created_at": dateTimeSchema(),
+		"name":       stringSchema(),
+		"email":      schema{"type": "string", "format": "email"},
+		"activated":  booleanSchema(),
+		"version":    integerSchema(),
+		// only present while the account is scheduled for deletion
+		"deletion_scheduled_at": dateTimeSchema(),
+	}),
+	"Token": object([]string{"token", "expiry"}, schema{
+		"token":  stringSchema(),
+		"expiry": dateTimeSchema(),
+	}),
+	"Webhook": object([]string{"id", "created_at", "url", "events", "active", "version"}, schema{
+		"id":         integerSchema(),
+		"created_at": dateTimeSchema(),
+		"url":        schema{"type": "string", "format": "uri"},
+		"events":     arrayOf(stringSchema()),
+		"active":     booleanSchema(),
+		"version":    integerSchema(),
+	}),
+	"WebhookDelivery": object([]string{"id", "created_at", "webhook_id", "event", "payload", "status", "attempts", "next_attempt_at"}, schema{
+		"id":               integerSchema(),
+		"created_at":       dateTimeSchema(),
+		"webhook_id":       integerSchema(),
+		"event":            stringSchema(),
+		"payload":          schema{"type": "object"},
+		"status":           schema{"type": "string", "enum": []string{"pending", "succeeded", "dead"}},
+		"attempts":         integerSchema(),
+		"next_attempt_at":  dateTimeSchema(),
+		"last_attempt_at":  dateTimeSchema(),
+		"last_status_code": integerSchema(),
+		"last_error":       stringSchema(),
+	}),
+	"Message": envelopeOf("message", stringSchema()),
+	"APIKey": object([]string{"id", "created_at", "name", "prefix", "permissions", "expiry", "last_used_at"}, schema{
+		"id":           integerSchema(),
+		"created_at":   dateTimeSchema(),
+		"name":         stringSchema(),
+		"prefix":       stringSchema(),
+		"permissions":  arrayOf(stringSchema()),
+		"expiry":       schema{"type": []string{"string", "null"}, "format": "date-time"},
+		"last_used_at": schema{"type": []string{"string", "null"}, "format": "date-time"},
+	}),
+	"SessionTokens": object([]string{"authentication_token", "refresh_token"}, schema{
+		"authentication_token": ref("Token"),
+		"refresh_token":        ref("Token"),
+	}),
+	"Session": object([]string{"id", "created_at", "last_used_at", "ip", "user_agent", "expiry", "current"}, schema{
+		"id":           integerSchema(),
+		"created_at":   dateTimeSchema(),
+		"last_used_at": schema{"type": []string{"string", "null"}, "format": "date-time"},
+		"ip":           stringSchema(),
+		"user_agent":   stringSchema(),
+		"expiry":       dateTimeSchema(),
+		"current":      booleanSchema(),
+	}),
+	"Identity": object([]string{"id", "created_at", "provider", "subject", "email"}, schema{
+		"id":         integerSchema(),
+		"created_at": dateTimeSchema(),
+		"provider":   stringSchema(),
+		"subject":    stringSchema(),
+		"email":      schema{"type": "string", "format": "email"},
+	}),
+	"Role": object([]string{"id", "name", "description", "permissions"}, schema{
+		"id":          integerSchema(),
+		"name":        stringSchema(),
+		"description": stringSchema(),
+		"permissions": arrayOf(stringSchema()),
+	}),
+	// the error envelope written by errResponse
+	"Error": envelopeOf("error", stringSchema()),
+	// the error envelope written by failedValidationResponse, keyed by field name
+	"ValidationError": envelopeOf("error", schema{"type": "object", "additionalProperties": stringSchema()}),
+}
+
+// shown on operations that change a user's permissions
+// on the totp enrolment routes
+const totpKeyNote = "Returns a 503 if the server was started without `-totp-key`."
+
+// on the admin routes that change a user's perms, see checkGrantable
+const grantableNote = "The caller must have every permission being granted or revoked, including each of a role's, or the request is rejected with a 422. "
+
+const jwtPermissionsNote = "JWTs carry the permissions they were issued with until they expire after `-token-jwt-ttl`, 5 minutes by default. " +
+	"Revoke the user's tokens for the change to apply at once."
+
+// every documented operation, TestOpenAPIDrift fails if these drift from the registered routes
+var apiOperations = []apiOperation{
+	{
+		method: http.MethodGet, path: "/v1/healthcheck", summary: "Show application status", tag: "health",
+		status: http.StatusOK,
+		response: object([]string{"status", "environment", "version"}, schema{
+			"status":      stringSchema(),
+			"environment": stringSchema(),
+			"version":     stringSchema(),
+		}),
+	},
+	{
+		method: http.MethodGet, path: "/v1/openapi.json", summary: "Show this OpenAPI document", tag: "health",
+		status: http.StatusOK, response: schema{"type": "object"},
+	},
+	{
+		method: http.MethodGet, path: "/v1/movies", summary: "List movies", tag: "movies", perm: "movies:read",
+		query: append([]apiParam{
+			{name: "title", schema: stringSchema(), description: "full text search on the title"},
+			{name: "genres", schema: stringSchema(), description: "comma separated genres the movie must have"},
+		}, paginationParams("id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime")...),
+		status: http.StatusOK,
+		response: object([]string{"movies", "metadata"}, schema{
+			"movies":   arrayOf(ref("Movie")),
+			"metadata": ref("Metadata"),
+		}),
+	},
+	{
+		method: http.MethodPost, path: "/v1/movies", summary: "Create a movie", tag: "movies", perm: "movies:write",
+		description: "`movies:write:own` is enough too, the movie is recorded as created by the user.",
+		body: object([]string{"title", "year", "runtime", "genres"}, schema{
+			"title":   stringSchema(),
+			"year":    integerSchema(),
+			"runtime": ref("Runtime"),
+			"genres":  arrayOf(stringSchema()),
+		}),
+		status: http.StatusCreated, response: envelopeOf("movie", ref("Movie")),
+	},
+	{
+		method: http.MethodGet, path: "/v1/movies/:id", summary: "Show a movie", tag: "movies", perm: "movies:read",
+		status: http.StatusOK, response: envelopeOf("movie", ref("Movie")),
+	},
+	{
+		method: http.MethodPatch, path: "/v1/movies/:id", summary: "Update a movie", tag: "movies", perm: "movies:write",
+		description: "`movies:write:own` is enough for movies the user created.",
+		body: object(nil, schema{
+			"title":   stringSchema(),
+			"year":    integerSchema(),
+			"runtime": ref("Runtime"),
+			"genres":  arrayOf(stringSchema()),
+		}),
+		status: http.StatusOK, response: envelopeOf("movie", ref("Movie")),
+	},
+	{
+		method: http.MethodDelete, path: "/v1/movies/:id", summary: "Delete a movie", tag: "movies", perm: "movies:write",
+		description: "`movies:write:own` is enough for movies the user created.",
+		status:      http.StatusOK, response: ref("Message"),
+	},
+	{
+		method: http.MethodGet, path: "/v1/events/movies", summary: "Stream movie changes as server-sent events", tag: "movies", perm: "movies:read",
+		query: []apiParam{
+			{name: "last_event_id", schema: integerSchema(), description: "resume after this event, for clients that can't send Last-Event-ID"},
+		},
+		status: http.StatusOK, response: ref("MovieEvent"), stream: true,
+		description: "Resuming replays events from shortly before the last event too, since ids can commit out of order. " +
+			"Clients should ignore event ids they've already handled. " +
+			"A client that missed more than 1000 events gets a `reset` event instead of the replay, and should fetch the movies again. " +
+			"The `movie` in an event is the movie as it is when the event is sent, not a snapshot from when it happened, " +
+			"and is left out once the movie is deleted.",
+	},
+	{
+		method: http.MethodGet, path: "/v1/webhooks", summary: "List webhooks", tag: "webhooks", perm: "webhooks:admin",
+		query:  paginationParams("id", "created_at", "url", "-id", "-created_at", "-url"),
+		status: http.StatusOK,
+		response: object([]string{"webhooks", "metadata"}, schema{
+			"webhooks": arrayOf(ref("Webhook")),
+			"metadata": ref("Metadata"),
+		}),
+	},
+	{
+		method: http.MethodPost, path: "/v1/webhooks", summary: "Create a webhook", tag: "webhooks", perm: "webhooks:admin",
+		body: object([]string{"url", "events"}, schema{
+			"url":    schema{"type": "string", "format": "uri"},
+			"events": arrayOf(stringSchema()),
+			"secret": stringSchema(),
+			"active": booleanSchema(),
+		}),
+		status: http.StatusCreated,
+		response: object([]string{"webhook", "secret"}, schema{
+			"webhook": ref("Webhook"),
+			"secret":  stringSchema(),
+		}),
+	},
+	{
+		method: http.MethodGet, path: "/v1/webhooks/:id", summary: "Show a webhook", tag: "webhooks", perm: "webhooks:admin",
+		status: http.StatusOK, response: envelopeOf("webhook", ref("Webhook")),
+	},
+	{
+		method: http.MethodPatch, path: "/v1/webhooks/:id", summary: "Update a webhook", tag: "webhooks", perm: "webhooks:admin",
+		body: object(nil, schema{
+			"url":    schema{"type": "string", "format": "uri"},
+			"events": arrayOf(stringSchema()),
+			"secret": stringSchema(),
+			"active": booleanSchema(),
+		}),
+		status: http.StatusOK, response: envelopeOf("webhook", ref("Webhook")),
+	},
+	{
+		method: http.MethodDelete, path: "/v1/webhooks/:id", summary: "Delete a webhook", tag: "webhooks", perm: "webhooks:admin",
+		status: http.StatusOK, response: ref("Message"),
+	},
+	{
+		method: http.MethodGet, path: "/v1/webhooks/:id/deliveries", summary: "List deliveries for a webhook", tag: "webhooks", perm: "webhooks:admin",
+		query: append([]apiParam{
+			{name: "status", schema: schema{"type": "string", "enum": []string{"pending", "succeeded", "dead"}}},
+		}, paginationParams("id", "next_attempt_at", "-id", "-next_attempt_at")...),
+		status: http.StatusOK,
+		response: object([]string{"deliveries", "metadata"}, schema{
+			"deliveries": arrayOf(ref("WebhookDelivery")),
+			"metadata":   ref("Metadata"),
+		}),
+	},
+	{
+		method: http.MethodPost, path: "/v1/webhooks/:id/deliveries/:delivery_id/redeliver", summary: "Queue a delivery again", tag: "webhooks", perm: "webhooks:admin",
+		status: http.StatusAccepted, response: envelopeOf("delivery", ref("WebhookDelivery")),
+	},
+	{
+		method: http.MethodGet, path: "/v1/admin/users", summary: "List and search users", tag: "admin", perm: "users:admin",
+		query: append([]apiParam{
+			{name: "search", schema: stringSchema(), description: "matches part of the name or email address"},
+			{name: "activated", schema: booleanSchema()},
+		}, paginationParams("id", "created_at", "name", "email", "-id", "-created_at", "-name", "-email")...),
+		status: http.StatusOK,
+		response: object([]string{"users", "metadata"}, schema{
+			"users":    arrayOf(ref("User")),
+			"metadata": ref("Metadata"),
+		}),
+	},
+	{
+		method: http.MethodGet, path: "/v1/admin/users/:id", summary: "Show a user, their roles and their permissions", tag: "admin", perm: "users:admin",
+		status: http.StatusOK,
+		response: object([]string{"user", "roles", "permissions", "effective_permissions"}, schema{
+			"user":                  ref("User"),
+			"roles":                 arrayOf(stringSchema()),
+			"permissions":           arrayOf(schema{"type": "string", "description": "granted directly rather than through a role"}),
+			"effective_permissions": arrayOf(schema{"type": "string", "description": "granted directly or through a role"}),
+		}),
+	},
+	{
+		method: http.MethodPatch, path: "/v1/admin/users/:id", summary: "Activate or deactivate a user", tag: "admin", perm: "users:admin",
+		description: "Deactivating a user also signs them out everywhere.",
+		body: object([]string{"activated"}, schema{
+			"activated": booleanSchema(),
+			"version":   schema{"type": "integer", "description": "the version last read, a mismatch returns 409"},
+		}),
+		status: http.StatusOK, response: envelopeOf("user", ref("User")),
+	},
+	{
+		method: http.MethodPut, path: "/v1/admin/users/:id/permissions/:code", summary: "Grant a user a permission", tag: "admin", perm: "users:admin",
+		description: grantableNote + jwtPermissionsNote,
+		status:      http.StatusOK, response: envelopeOf("permissions", arrayOf(stringSchema())),
+	},
+	{
+		method: http.MethodDelete, path: "/v1/admin/users/:id/permissions/:code", summary: "Revoke a permission granted directly to a user", tag: "admin", perm: "users:admin",
+		description: grantableNote + jwtPermissionsNote,
+		status:      http.StatusOK, response: envelopeOf("permissions", arrayOf(stringSchema())),
+	},
+	{
+		method: http.MethodPut, path: "/v1/admin/users/:id/roles/:role", summary: "Give a user a role", tag: "admin", perm: "users:admin",
+		description: grantableNote + jwtPermissionsNote,
+		status:      http.StatusOK, response: envelopeOf("roles", arrayOf(stringSchema())),
+	},
+	{
+		method: http.MethodDelete, path: "/v1/admin/users/:id/roles/:role", summary: "Take a role away from a user", tag: "admin", perm: "users:admin",
+		description: grantableNote + jwtPermissionsNote,
+		status:      http.StatusOK, response: envelopeOf("roles", arrayOf(stringSchema())),
+	},
+	{
+		method: http.MethodPost, path: "/v1/admin/users/:id/password-reset", summary: "Email a user a password reset token", tag: "admin", perm: "users:admin",
+		status: http.StatusAccepted, response: ref("Message"),
+	},
+	{
+		method: http.MethodDelete, path: "/v1/admin/users/:id/tokens", summary: "Revoke all of a user's sessions and api keys", tag: "admin", perm: "users:admin",
+		status: http.StatusOK, response: ref("Message"),
+	},
+	{
+		method: http.MethodDelete, path: "/v1/admin/users/:id/lockout", summary: "Unlock a user locked out after failed logins", tag: "admin", perm: "users:unlock",
+		status: http.StatusOK, response: ref("Message"),
+	},
+	{
+		method: http.MethodGet, path: "/v1/admin/roles", summary: "List roles and their permissions", tag: "admin", perm: "users:admin",
+		status: http.StatusOK, response: envelopeOf("roles", arrayOf(ref("Role"))),
+	},
+	{
+		method: http.MethodGet, path: "/v1/admin/invitations", summary: "List invitations that haven't been accepted yet", tag: "admin", perm: "users:admin",
+		status: http.StatusOK, response: envelopeOf("invitations", arrayOf(ref("Invitation"))),
+	},
+	{
+		method: http.MethodPost, path: "/v1/admin/invitations", summary: "Invite someone to register", tag: "admin", perm: "users:admin",
+		body: object([]string{"email"}, schema{
+			"email":       schema{"type": "string", "format": "email"},
+			"roles":       schema{"type": "array", "items": stringSchema(), "description": "defaults to the default role"},
+			"permissions": arrayOf(stringSchema()),
+		}),
+		status: http.StatusCreated, response: envelopeOf("invitation", ref("Invitation")),
+		description: "The invitation token is emailed to the address and isn't included in the response. " +
+			"The caller must have every permission given, including each of the chosen roles', or the request is rejected with a 422.",
+	},
+	{
+		method: http.MethodDelete, path: "/v1/admin/invitations/:id", summary: "Withdraw an invitation", tag: "admin", perm: "users:admin",
+		status: http.StatusOK, response: ref("Message"),
+	},
+	{
+		method: http.MethodGet, path: "/v1/admin/audit", summary: "List security events from the audit log", tag: "admin", perm: "audit:read",
+		query:  append(auditParams(), paginationParams("id", "created_at", "action", "-id", "-created_at", "-action")...),
+		status: http.StatusOK,
+		response: object([]string{"events", "metadata"}, schema{
+			"events":   arrayOf(ref("AuditEvent")),
+			"metadata": ref("Metadata"),
+		}),
+		description: "Events are listed newest first by default. " +
+			"Email addresses in `details` are recorded as the hex SHA-256 of the lower case address, in fields ending `_hash`.",
+	},
+	{
+		method: http.MethodGet, path: "/v1/admin/audit/export", summary: "Export security events from the audit log", tag: "admin", perm: "audit:read",
+		query:  auditParams(),
+		status: http.StatusOK, response: ref("AuditEvent"), ndjson: true,
+		description: "Every matching event is streamed oldest first, one per line, with no pagination.",
+	},
+	{
+		method: http.MethodPost, path: "/v1/graphql", summary: "Run a read-only GraphQL query", tag: "graphql",
+		body: object([]string{"query"}, schema{
+			"query":         stringSchema(),
+			"operationName": stringSchema(),
+			"variables":     schema{"type": "object"},
+			"extensions":    schema{"type": "object"},
+		}),
+		status: http.StatusOK,
+		response: schema{"type": "object", "properties": schema{
+			"data":   schema{"type": []string{"object", "null"}},
+			"errors": arrayOf(schema{"type": "object"}),
+		}},
+	},
+	{
+		method: http.MethodPost, path: "/v1/users", summary: "Register a user", tag: "users",
+		body: object([]string{"name", "email", "password"}, schema{
+			"name":     stringSchema(),
+			"email":    schema{"type": "string", "format": "email"},
+			"password": stringSchema(),
+		}),
+		status: http.StatusAccepted, response: envelopeOf("user", ref("User")),
+		description: "Deployments running invite-only registration respond with a 403, see `POST /v1/invitations/accept`. " +
+			"Deployments limited to some email domains reject other addresses with a 422.",
+	},
+	{
+		method: http.MethodPost, path: "/v1/invitations/accept", summary: "Register with an invitation", tag: "users",
+		body: object([]string{"token", "name", "password"}, schema{
+			"token":    stringSchema(),
+			"name":     stringSchema(),
+			"password": stringSchema(),
+		}),
+		status: http.StatusCreated, response: envelopeOf("user", ref("User")),
+		description: "This works whatever the registration mode is. The account uses the invited email address, " +
+			"is activated straight away, and gets the roles and permissions attached to the invitation.",
+	},
+	{
+		method: http.MethodPut, path: "/v1/users/activated", summary: "Activate a user", tag: "users",
+		body:   object([]string{"token"}, schema{"token": stringSchema()}),
+		status: http.StatusOK, response: envelopeOf("user", ref("User")),
+	},
+	{
+		method: http.MethodPut, path: "/v1/users/password", summary: "Reset a password with a reset token", tag: "users",
+		body:   object([]string{"password", "token"}, schema{"password": stringSchema(), "token": stringSchema()}),
+		status: http.StatusOK, response: ref("Message"),
+	},
+	{
+		method: http.MethodGet, path: "/v1/users/me", summary: "Show the current user, their roles and their permissions", tag: "account", auth: true,
+		status: http.StatusOK,
+		response: object([]string{"user", "roles", "permissions"}, schema{
+			"user":        ref("User"),
+			"roles":       arrayOf(stringSchema()),
+			"permissions": arrayOf(schema{"type": "string", "description": "granted directly or through a role, movies:* matches every movies code and * matches everything"}),
+		}),
+	},
+	{
+		method: http.MethodPatch, path: "/v1/users/me", summary: "Update the current user", tag: "account", auth: true, noAPIKey: true,
+		body: object(nil, schema{
+			"name":    stringSchema(),
+			"version": schema{"type": "integer", "description": "the version last read, a mismatch returns 409"},
+		}),
+		status: http.StatusOK, response: envelopeOf("user", ref("User")),
+	},
+	{
+		method: http.MethodDelete, path: "/v1/users/me", summary: "Schedule the current user's account for deletion after the grace period", tag: "account", auth: true, noAPIKey: true,
+		body:   object([]string{"password"}, schema{"password": stringSchema()}),
+		status: http.StatusAccepted,
+		response: object([]string{"message", "user"}, schema{
+			"message": stringSchema(),
+			"user":    ref("User"),
+		}),
+	},
+	{
+		method: http.MethodDelete, path: "/v1/users/me/deletion", summary: "Cancel a scheduled account deletion", tag: "account", auth: true, noAPIKey: true,
+		status: http.StatusOK, response: envelopeOf("user", ref("User")),
+	},
+	{
+		method: http.MethodGet, path: "/v1/users/me/export", summary: "Export the current user's personal data", tag: "account", auth: true, noAPIKey: true,
+		status: http.StatusOK,
+		response: envelopeOf("export", object([]string{"exported_at", "user", "permissions", "sessions"}, schema{
+			"exported_at":   dateTimeSchema(),
+			"user":          ref("User"),
+			"pending_email": schema{"type": []string{"string", "null"}},
+			"roles":         arrayOf(stringSchema()),
+			"permissions":   arrayOf(stringSchema()),
+			"sessions":      arrayOf(ref("Session")),
+			"api_keys":      arrayOf(ref("APIKey")),
+			"identities":    arrayOf(ref("Identity")),
+			"movies":        arrayOf(ref("Movie")),
+		})),
+	},
+	{
+		method: http.MethodGet, path: "/v1/users/me/sessions", summary: "List the current user's active sessions", tag: "account", auth: true, noAPIKey: true,
+		status: http.StatusOK, response: envelopeOf("sessions", arrayOf(ref("Session"))),
+	},
+	{
+		method: http.MethodDelete, path: "/v1/users/me/sessions/:id", summary: "Revoke one of the current user's sessions", tag: "account", auth: true, noAPIKey: true,
+		status: http.StatusOK, response: ref("Message"),
+	},
+	{
+		method: http.MethodPost, path: "/v1/users/me/api-keys", summary: "Create an api key, the key is only included in this response", tag: "account", auth: true, noAPIKey: true,
+		body: object([]string{"name", "permissions"}, schema{
+			"name":        stringSchema(),
+			"permissions": arrayOf(stringSchema()),
+			"expiry":      dateTimeSchema(),
+		}),
+		status: http.StatusCreated,
+		response: object([]string{"api_key", "key"}, schema{
+			"api_key": ref("APIKey"),
+			"key":     stringSchema(),
+		}),
+	},
+	{
+		method: http.MethodGet, path: "/v1/users/me/api-keys", summary: "List the current user's api keys", tag: "account", auth: true, noAPIKey: true,
+		status: http.StatusOK, response: envelopeOf("api_keys", arrayOf(ref("APIKey"))),
+	},
+	{
+		method: http.MethodDelete, path: "/v1/users/me/api-keys/:id", summary: "Delete one of the current user's api keys", tag: "account", auth: true, noAPIKey: true,
+		status: http.StatusOK, response: ref("Message"),
+	},
+	{
+		method: http.MethodPut, path: "/v1/users/me/password", summary: "Change the current user's password and sign out other sessions", tag: "account", auth: true, noAPIKey: true,
+		body: object([]string{"current_password", "new_password"}, schema{
+			"current_password": stringSchema(),
+			"new_password":     stringSchema(),
+		}),
+		status: http.StatusOK, response: ref("Message"),
+	},
+	{
+		method: http.MethodGet, path: "/v1/users/me/mfa", summary: "Show the current user's two-factor authentication status", tag: "account", auth: true, noAPIKey: true,
+		status: http.StatusOK,
+		response: envelopeOf("mfa", object([]string{"totp_enabled", "recovery_codes_remaining"}, schema{
+			"totp_enabled":             booleanSchema(),
+			"recovery_codes_remaining": integerSchema(),
+		})),
+	},
+	{
+		method: http.MethodPost, path: "/v1/users/me/mfa/totp", summary: "Start enrolling in totp two-factor authentication", tag: "account", auth: true, noAPIKey: true,
+		body:   object([]string{"password"}, schema{"password": stringSchema()}),
+		status: http.StatusCreated,
+		response: envelopeOf("totp", object([]string{"secret", "provisioning_uri"}, schema{
+			"secret":           stringSchema(),
+			"provisioning_uri": stringSchema(),
+		})),
+		description: totpKeyNote,
+	},
+	{
+		method: http.MethodPut, path: "/v1/users/me/mfa/totp", summary: "Confirm totp enrolment with a code, this returns the recovery codes", tag: "account", auth: true, noAPIKey: true,
+		body:   object([]string{"code"}, schema{"code": stringSchema()}),
+		status: http.StatusOK,
+		response: object([]string{"message", "recovery_codes"}, schema{
+			"message":        stringSchema(),
+			"recovery_codes": arrayOf(stringSchema()),
+		}),
+		description: totpKeyNote,
+	},
+	{
+		method: http.MethodDelete, path: "/v1/users/me/mfa/totp", summary: "Turn off two-factor authentication", tag: "account", auth: true, noAPIKey: true,
+		body: object([]string{"password"}, schema{
+			"password":      stringSchema(),
+			"code":          stringSchema(),
+			"recovery_code": stringSchema(),
+		}),
+		status: http.StatusOK, response: ref("Message"),
+		description: "Wrong passwords and codes count as failed logins, so too many get a 429 response with a Retry-After header, or a 423 once the account is locked.",
+	},
+	{
+		method: http.MethodPost, path: "/v1/users/me/email", summary: "Request an email change, a confirmation token is sent to the new address", tag: "account", auth: true, noAPIKey: true,
+		body: object([]string{"email", "password"}, schema{
+			"email":    schema{"type": "string", "format": "email"},
+			"password": stringSchema(),
+		}),
+		status: http.StatusAccepted, response: ref("Message"),
+	},
+	{
+		method: http.MethodPut, path: "/v1/users/email", summary: "Confirm an email change", tag: "account",
+		body:   object([]string{"token"}, schema{"token": stringSchema()}),
+		status: http.StatusOK, response: envelopeOf("user", ref("User")),
+	},
+	{
+		method: http.MethodPost, path: "/v1/tokens/activation", summary: "Send a new activation token", tag: "tokens",
+		body:   object([]string{"email"}, schema{"email": schema{"type": "string", "format": "email"}}),
+		status: http.StatusAccepted, response: ref("Message"),
+	},
+	{
+		method: http.MethodPost, path: "/v1/tokens/authentication", summary: "Create an authentication token", tag: "tokens",
+		body: object([]string{"email", "password"}, schema{
+			"email":    schema{"type": "string", "format": "email"},
+			"password": stringSchema(),
+		}),
+		status: http.StatusCreated, response: ref("SessionTokens"),
+		description: "Users with two-factor authentication get a 202 response with an `mfa_token` instead, see `POST /v1/tokens/mfa`. " +
+			"After a few failed attempts each login has to wait longer, and too many failures lock the account and email the user. " +
+			"Attempts that have to wait, or are made while locked, get the same 401 response as a wrong password, so it can't be used to find registered emails.",
+	},
+	{
+		method: http.MethodPost, path: "/v1/tokens/mfa", summary: "Finish logging in with a totp or recovery code", tag: "tokens",
+		body: object([]string{"mfa_token"}, schema{
+			"mfa_token":     stringSchema(),
+			"code":          stringSchema(),
+			"recovery_code": stringSchema(),
+		}),
+		status: http.StatusCreated, response: ref("SessionTokens"),
+	},
+	{
+		method: http.MethodPost, path: "/v1/tokens/magic-link", summary: "Email a one-time login link and code", tag: "tokens",
+		body:   object([]string{"email"}, schema{"email": schema{"type": "string", "format": "email"}}),
+		status: http.StatusAccepted, response: ref("Message"),
+		description: "The response is the same whether or not the email address is registered. " +
+			"The link and code expire after 15 minutes, and using either one uses up both.",
+	},
+	{
+		method: http.MethodPost, path: "/v1/tokens/login", summary: "Log in with an emailed login token or code", tag: "tokens",
+		body: object(nil, schema{
+			"token": stringSchema(),
+			"email": schema{"type": "string", "format": "email"},
+			"code":  schema{"type": "string", "pattern": `^[0-9]{6}$`},
+		}),
+		status: http.StatusCreated, response: ref("SessionTokens"),
+		description: "Send either the `token` from the link, or the `email` and 6 digit `code`. " +
+			"Users with two-factor authentication get a 202 response with an `mfa_token` instead, see `POST /v1/tokens/mfa`. " +
+			"Wrong codes count towards the same lockout as wrong passwords. " +
+			"Attempts while the account is locked get the same 401 response as a wrong code, so it can't be used to find registered emails.",
+	},
+	{
+		method: http.MethodGet, path: "/v1/oidc", summary: "List the identity providers available for single sign-on", tag: "tokens",
+		status: http.StatusOK,
+		response: envelopeOf("providers", arrayOf(object([]string{"name", "issuer"}, schema{
+			"name":   stringSchema(),
+			"issuer": schema{"type": "string", "format": "uri"},
+		}))),
+	},
+	{
+		method: http.MethodGet, path: "/v1/oidc/:provider/authorize", summary: "Start logging in with an identity provider", tag: "tokens",
+		status: http.StatusOK, response: envelopeOf("authorization_url", schema{"type": "string", "format": "uri"}),
+		description: "Send the user to `authorization_url`. The provider redirects back with a `code` and `state` to pass to the callback.",
+	},
+	{
+		method: http.MethodGet, path: "/v1/oidc/:provider/callback", summary: "Finish logging in with an identity provider", tag: "tokens",
+		query: []apiParam{
+			{name: "code", schema: stringSchema(), description: "authorization code from the identity provider"},
+			{name: "state", schema: stringSchema(), description: "state from the identity provider, each one can only be used once"},
+			{name: "error", schema: stringSchema(), description: "set by the identity provider instead of a code when logging in failed"},
+		},
+		status: http.StatusCreated, response: ref("SessionTokens"),
+		description: "The identity is linked to the user with the same verified email the first time it's used. Users with two-factor authentication get a 202 response with an `mfa_token` instead, see `POST /v1/tokens/mfa`.",
+	},
+	{
+		method: http.MethodPost, path: "/v1/tokens/refresh", summary: "Exchange a refresh token for new tokens, reusing one revokes the session", tag: "tokens",
+		body:   object([]string{"refresh_token"}, schema{"refresh_token": stringSchema()}),
+		status: http.StatusCreated, response: ref("SessionTokens"),
+	},
+	{
+		method: http.MethodDelete, path: "/v1/tokens/authentication", summary: "Revoke the authentication token used to make the request", tag: "tokens", auth: true, noAPIKey: true,
+		status: http.StatusOK, response: ref("Message"),
+	},
+	{
+		method: http.MethodPost, path: "/v1/tokens/password-reset", summary: "Send a password reset token", tag: "tokens",
+		body:   object([]string{"email"}, schema{"email": schema{"type": "string", "format": "email"}}),
+		status: http.StatusAccepted, response: ref("Message"),
+	},
+}
+
+// httprouter path params look like :id, openapi uses {id}
+var routeParamRX = regexp.MustCompile(`:([a-z_]+)`)
+
+func openAPIPath(path string) string {
+	return routeParamRX.ReplaceAllString(path, "{$1}")
+}
+
+// an error response referencing one of the error schemas
+func errorResponse(description, schemaName string) schema {
+	return schema{
+		"description": description,
+		"content":     schema{"application/json": schema{"schema": ref(schemaName)}},
+	}
+}
+
+// build the openapi document from apiOperations
+func openAPISpec() schema {
+	paths := schema{}
+
+	for _, op := range apiOperations {
+		responses := schema{
+			strconv.Itoa(op.status): schema{
+				"description": http.StatusText(op.status),
+				"content":     schema{"application/json": schema{"schema": op.response}},
+			},
+			"406": errorResponse("none of the formats in the Accept header can be produced", "Error"),
+			"429": errorResponse("rate limit exceeded", "Error"),
+			"500": errorResponse("server error", "Error"),
+		}
+
+		if op.stream {
+			responses[strconv.Itoa(op.status)] = schema{
+				"description": "a stream of server-sent events, each data line is a JSON document",
+				"content":     schema{"text/event-stream": schema{"schema": op.response}},
+			}
+		}
+
+		if op.ndjson {
+			responses[strconv.Itoa(op.status)] = schema{
+				"description": "newline delimited JSON, each line is a JSON document",
+				"content":     schema{ndjsonMediaType: schema{"schema": op.response}},
+			}
+		}
+
+		operation := schema{
+			"operationId": op.method + " " + op.path,
+			"summary":     op.summary,
+			"tags":        []string{op.tag},
+			"responses":   responses,
+		}
+
+		parameters := []schema{}
+
+		for _, match := range routeParamRX.FindAllStringSubmatch(op.path, -1) {
+			// params are ids unless they're named otherwise, like :provider
+			paramSchema := schema{"type": "integer", "minimum": 1}
+			if !strings.HasSuffix(match[1], "id") {
+				paramSchema = stringSchema()
+			}
+
+			parameters = append(parameters, schema{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   paramSchema,
+			})
+			responses["404"] = errorResponse("the resource could not be found", "Error")
+		}
+
+		for _, param := range op.query {
+			p := schema{"name": param.name, "in": "query", "schema": param.schema}
+			if param.description != "" {
+				p["description"] = param.description
+			}
+			parameters = append(parameters, p)
+		}
+
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+
+		if op.body != nil {
+			operation["requestBody"] = schema{
+				"required": true,
+				"content":  schema{"application/json": schema{"schema": op.body}},
+			}
+			responses["400"] = errorResponse("the request body could not be read", "Error")
+		}
+
+		if op.body != nil || len(op.query) > 0 {
+			responses["422"] = errorResponse("the request failed validation", "ValidationError")
+		}
+
+		if op.perm != "" || op.auth {
+			operation["security"] = []schema{{"bearerAuth": []string{}}, {"apiKeyAuth": []string{}}}
+			if op.noAPIKey {
+				operation["security"] = []schema{{"bearerAuth": []string{}}}
+			}
+			responses["401"] = errorResponse("missing or invalid authentication", "Error")
+			responses["403"] = errorResponse("the account is inactive or lacks permission", "Error")
+		}
+
+		if op.perm != "" {
+			operation["description"] = strings.TrimSpace(fmt.Sprintf("Requires an activated account with the `%s` permission. %s", op.perm, op.description))
+		} else if op.description != "" {
+			operation["description"] = op.description
+		}
+
+		if op.method == http.MethodPatch {
+			responses["409"] = errorResponse("edit conflict", "Error")
+		}
+
+		path := openAPIPath(op.path)
+		item, ok := paths[path].(schema)
+		if !ok {
+			item = schema{}
+			paths[path] = item
+		}
+		item[strings.ToLower(op.method)] = operation
+	}
+
+	return schema{
+		"openapi": "3.1.0",
+		"info": schema{
+			"title":   "Greenlight API",
+			"version": version,
+		},
+		"paths": paths,
+		"components": schema{
+			"schemas": apiSchemas,
+			"securitySchemes": schema{
+				"bearerAuth": schema{"type": "http", "scheme": "bearer"},
+				"apiKeyAuth": schema{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        "Authorization",
+					"description": "An api key sent as `Authorization: ApiKey glk_...`",
+				},
+			},
+		},
+	}
+}
+
+func (app *application) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeResponse(w, r, http.StatusOK, app.openapi, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// httprouter doesn't expose its routes, so this wrapper records them as they're registered,
+// and adds request validation when it's enabled.
+// operations that need a user or permission are validated by requireAnyPerm or rejectAPIKeys once their checks pass,
+// so a 422 never reaches a caller who'd get a 401 or 403
+type apiRouter struct {
+	*httprouter.Router
+	app        *application
+	registered []string
+}
+
+func (app *application) newAPIRouter() *apiRouter {
+	return &apiRouter{Router: httprouter.New(), app: app}
+}
+
+func (ar *apiRouter) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	ar.registered = append(ar.registered, method+" "+path)
+
+	op, found := findOperation(method, path)
+
+	if found && ar.app.config.openapi.validate {
+		if op.perm != "" || op.auth {
+			handler = ar.app.withOperation(op, handler)
+		} else {
+			handler = ar.app.validateRequest(op, handler)
+		}
+	}
+
+	// event streams and ndjson exports negotiate their own formats
+	if !op.stream && !op.ndjson && !csvOperation(op) {
+		handler = ar.app.rejectCSVOnly(handler)
+	}
+
+	ar.Router.HandlerFunc(method, path, handler)
+}
+
+func (ar *apiRouter) Handler(method, path string, handler http.Handler) {
+	ar.registered = append(ar.registered, method+" "+path)
+	ar.Router.Handler(method, path, handler)
+}
+
+func findOperation(method, path string) (apiOperation, bool) {
+	for _, op := range apiOperations {
+		if op.method == method && op.path == path {
+			return op, true
+		}
+	}
+
+	return apiOperation{}, false
+}
+
+// compare registered /v1 routes against the documented operations
+func openAPIDrift(registered []string) error {
+	documented := make(map[string]bool)
+	for _, op := range apiOperations {
+		documented[op.method+" "+op.path] = true
+	}
+
+	var undocumented, missing []string
+
+	for _, route := range registered {
+		_, path, _ := strings.Cut(route, " ")
+		if !strings.HasPrefix(path, "/v1/") {
+			continue
+		}
+
+		if !documented[route] {
+			undocumented = append(undocumented, route)
+		}
+		delete(documented, route)
+	}
+
+	missing = slices.Sorted(maps.Keys(documented))
+
+	if len(undocumented) == 0 && len(missing) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("openapi spec is out of date: undocumented routes %v, documented but not registered %v", undocumented, missing)
+}
+
+// attach the operation to the request, for validateOperation to check it against after the auth checks
+func (app *application) withOperation(op apiOperation, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, app.contextSetOperation(r, op))
+	}
+}
+
+// validate the request against the operation attached by withOperation, if there is one
+func (app *application) validateOperation(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op, found := app.contextGetOperation(r)
+		if !found {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		app.validateRequest(op, next).ServeHTTP(w, r)
+	}
+}
+
+// validate the query string and request body against the operation's schemas
+func (app *application) validateRequest(op apiOperation, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := validator.New()
+
+		qs := r.URL.Query()
+		for _, param := range op.query {
+			if !qs.Has(param.name) {
+				continue
+			}
+
+			value := qs.Get(param.name)
+
+			switch param.schema["type"] {
+			case "integer":
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					v.AddError(param.name, "must be an integer value")
+					continue
+				}
+				validateSchema(v, param.name, float64(n), param.schema)
+			default:
+				validateSchema(v, param.name, value, param.schema)
+			}
+		}
+
+		if op.body != nil {
+			// read the body so it can be checked, then put it back for the handler
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+			if err != nil {
+				app.badRequestResponse(w, r, err)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			var doc any
+			dec := json.NewDecoder(bytes.NewReader(body))
+			dec.UseNumber()
+
+			// leave malformed json for readJSON to report in its usual way
+			if dec.Decode(&doc) == nil {
+				validateSchema(v, "", normalizeJSON(doc), op.body)
+			}
+		}
+
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// convert json.Number values to float64 so numbers can be compared
+func normalizeJSON(value any) any {
+	switch value := value.(type) {
+	case json.Number:
+		f, _ := value.Float64()
+		return f
+	case []any:
+		for i := range value {
+			value[i] = normalizeJSON(value[i])
+		}
+	case map[string]any:
+		for k := range value {
+			value[k] = normalizeJSON(value[k])
+		}
+	}
+
+	return value
+}
+
+// every pattern in apiSchemas and apiOperations, compiled once rather than on each request
+var schemaPatterns = compileSchemaPatterns()
+
+func compileSchemaPatterns() map[string]*regexp.Regexp {
+	patterns := make(map[string]*regexp.Regexp)
+
+	var walk func(s schema)
+	walk = func(s schema) {
+		for key, value := range s {
+			switch value := value.(type) {
+			case schema:
+				walk(value)
+			case string:
+				if key == "pattern" {
+					patterns[value] = regexp.MustCompile(value)
+				}
+			}
+		}
+	}
+
+	walk(apiSchemas)
+	for _, op := range apiOperations {
+		walk(op.body)
+		for _, param := range op.query {
+			walk(param.schema)
+		}
+	}
+
+	return patterns
+}
+
+// check a decoded json value against the subset of json schema used in apiSchemas.
+// errors are added to the validator keyed by the field path
+func validateSchema(v *validator.Validator, key string, value any, s schema) {
+	if name, ok := s["$ref"].(string); ok {
+		s = apiSchemas[strings.TrimPrefix(name, "#/components/schemas/")].(schema)
+	}
+
+	field := key
+	if field == "" {
+		field = "body"
+	}
+
+	// nullable types are written as a list like ["integer", "null"],
+	// the value has to match one of them
+	if types, ok := s["type"].([]string); ok {
+		if value == nil && slices.Contains(types, "null") {
+			return
+		}
+
+		var errs map[string]string
+		for _, t := range types {
+			if t == "null" {
+				continue
+			}
+
+			alt := maps.Clone(s)
+			alt["type"] = t
+
+			tv := validator.New()
+			validateSchema(tv, key, value, alt)
+			if tv.Valid() {
+				return
+			}
+			errs = tv.Errors
+		}
+
+		if errs == nil {
+			v.AddError(field, "must be null")
+		}
+		for k, message := range errs {
+			v.AddError(k, message)
+		}
+		return
+	}
+
+	switch s["type"] {
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			v.AddError(field, "must be a JSON object")
+			return
+		}
+
+		properties, _ := s["properties"].(schema)
+
+		if required, ok := s["required"].([]string); ok {
+			for _, name := range required {
+				if _, found := obj[name]; !found {
+					v.AddError(joinKey(key, name), "must be provided")
+				}
+			}
+		}
+
+		for name, propValue := range obj {
+			propSchema, known := properties[name].(schema)
+			switch {
+			case known:
+				validateSchema(v, joinKey(key, name), propValue, propSchema)
+			case s["additionalProperties"] == false:
+				v.AddError(joinKey(key, name), "unknown field")
+			}
+		}
+	case "array":
+		list, ok := value.([]any)
+		if !ok {
+			v.AddError(field, "must be a JSON array")
+			return
+		}
+
+		if items, ok := s["items"].(schema); ok {
+			for i, item := range list {
+				validateSchema(v, fmt.Sprintf("%s[%d]", field, i), item, items)
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			v.AddError(field, "must be a string")
+			return
+		}
+
+		if pattern, ok := s["pattern"].(string); ok {
+			rx, found := schemaPatterns[pattern]
+			if !found {
+				// only schemas outside the operations table get here, e.g. in tests
+				rx = regexp.MustCompile(pattern)
+			}
+			v.Check(rx.MatchString(str), field, "must match the format "+pattern)
+		}
+		if enum, ok := s["enum"].([]string); ok {
+			v.Check(validator.PermittedValue(str, enum...), field, "invalid value")
+		}
+	case "integer":
+		n, ok := value.(float64)
+		if !ok || n != float64(int64(n)) {
+			v.AddError(field, "must be an integer")
+			return
+		}
+
+		if minimum, ok := s["minimum"].(int); ok {
+			v.Check(n >= float64(minimum), field, fmt.Sprintf("must be at least %d", minimum))
+		}
+		if maximum, ok := s["maximum"].(int); ok {
+			v.Check(n <= float64(maximum), field, fmt.Sprintf("must not be more than %d", maximum))
+		}
+	case "boolean":
+		_, ok := value.(bool)
+		v.Check(ok, field, "must be a boolean")
+	}
+}
+
+func joinKey(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+
+	return prefix + "." + name
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/validator"
+)
+
+func TestOpenAPIDrift(t *testing.T) {
+	app := newTestApplication(t)
+
+	// request validation wraps handlers differently, both have to register the same routes
+	for _, validate := range []bool{false, true} {
+		app.config.openapi.validate = validate
+
+		err := openAPIDrift(app.router().registered)
+		if err != nil {
+			t.Errorf("validate=%v: %v", validate, err)
+		}
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	nullableID := schema{"type": []string{"integer", "null"}}
+	body := object([]string{"name"}, schema{
+		"name":  stringSchema(),
+		"count": schema{"type": "integer", "minimum": 1, "maximum": 10},
+		"tags":  arrayOf(stringSchema()),
+		"owner": nullableID,
+	})
+
+	tests := []struct {
+		name   string
+		value  any
+		s      schema
+		errors map[string]string
+	}{
+		{"valid", map[string]any{"name": "a", "count": float64(3), "tags": []any{"x"}}, body, nil},
+		{"not an object", []any{}, body, map[string]string{"body": "must be a JSON object"}},
+		{"missing required", map[string]any{}, body, map[string]string{"name": "must be provided"}},
+		{"wrong type", map[string]any{"name": float64(1)}, body, map[string]string{"name": "must be a string"}},
+		{"not an integer", map[string]any{"name": "a", "count": 1.5}, body, map[string]string{"count": "must be an integer"}},
+		{"below minimum", map[string]any{"name": "a", "count": float64(0)}, body, map[string]string{"count": "must be at least 1"}},
+		{"above maximum", map[string]any{"name": "a", "count": float64(11)}, body, map[string]string{"count": "must not be more than 10"}},
+		{"bad array item", map[string]any{"name": "a", "tags": []any{"x", true}}, body, map[string]string{"tags[1]": "must be a string"}},
+		{"nullable null", map[string]any{"name": "a", "owner": nil}, body, nil},
+		{"nullable value", map[string]any{"name": "a", "owner": float64(7)}, body, nil},
+		{"nullable wrong type", map[string]any{"name": "a", "owner": "7"}, body, map[string]string{"owner": "must be an integer"}},
+		{"nullable not an integer", map[string]any{"name": "a", "owner": 7.5}, body, map[string]string{"owner": "must be an integer"}},
+		{"null only", "x", schema{"type": []string{"null"}}, map[string]string{"body": "must be null"}},
+		{"null for a non-nullable type", map[string]any{"name": nil}, body, map[string]string{"name": "must be a string"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			validateSchema(v, "", tt.value, tt.s)
+
+			if len(v.Errors) != len(tt.errors) {
+				t.Fatalf("got errors %v, want %v", v.Errors, tt.errors)
+			}
+			for key, want := range tt.errors {
+				if got := v.Errors[key]; got != want {
+					t.Errorf("got %s error %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestValidationAfterAuth(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.openapi.validate = true
+
+	router := app.router()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		// an anonymous caller is told to authenticate, not what's wrong with the body
+		{"needs a permission", http.MethodPost, "/v1/movies", `{"title": 1}`, http.StatusUnauthorized},
+		{"needs a user", http.MethodPost, "/v1/users/me/api-keys", `{"name": 1}`, http.StatusUnauthorized},
+		{"public", http.MethodPost, "/v1/tokens/login", `{"email": "a@example.com", "code": "abc"}`, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r = app.contextSetUser(r, data.AnonymousUser)
+
+			router.ServeHTTP(rr, r)
+
+			if rr.Code != tt.want {
+				t.Errorf("got status %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchemaPatternsCompiled(t *testing.T) {
+	for _, pattern := range []string{`^[0-9]+ mins$`, `^[0-9]{6}$`} {
+		if schemaPatterns[pattern] == nil {
+			t.Errorf("%s wasn't compiled", pattern)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/data"
+
+	"github.com/lib/pq"
+)
+
+// effective perms by user id, so authenticating a request doesn't always need the database.
+// entries are dropped when postgres reports a change, the ttl bounds how stale one can get
+// if a notification is missed
+type permissionCache struct {
+	ttl     time.Duration
+	mu      sync.RWMutex
+	entries map[int64]permissionCacheEntry
+	// bumped by every invalidation, so perms read from the db before one aren't cached after it
+	generation uint64
+	hits       atomic.Int64
+	misses     atomic.Int64
+}
+
+type permissionCacheEntry struct {
+	perms  data.Permissions
+	expiry time.Time
+}
+
+func newPermissionCache(ttl time.Duration) *permissionCache {
+	return &permissionCache{ttl: ttl, entries: make(map[int64]permissionCacheEntry)}
+}
+
+func (c *permissionCache) get(userID int64) (data.Permissions, bool) {
+	c.mu.RLock()
+	entry, found := c.entries[userID]
+	c.mu.RUnlock()
+
+	if !found || time.Now().After(entry.expiry) {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.hits.Add(1)
+	return entry.perms, true
+}
+
+// the generation to pass to set, read it before reading the perms from the db
+func (c *permissionCache) current() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.generation
+}
+
+func (c *permissionCache) set(userID int64, perms data.Permissions, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// something changed while the perms were being read, they may already be stale
+	if generation != c.generation {
+		return
+	}
+
+	c.entries[userID] = permissionCacheEntry{perms: perms, expiry: time.Now().Add(c.ttl)}
+}
+
+// forget a user's perms, safe to call when the cache is disabled
+func (c *permissionCache) invalidate(userID int64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	delete(c.entries, userID)
+}
+
+// forget everyone's perms, used when a role changes or a change may have been missed
+func (c *permissionCache) invalidateAll() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	clear(c.entries)
+}
+
+// drop expired entries so users who stopped making requests don't stay in memory
+func (c *permissionCache) prune(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, entry := range c.entries {
+		if now.After(entry.expiry) {
+			delete(c.entries, id)
+		}
+	}
+}
+
+// counts published through expvar
+func (c *permissionCache) stats() map[string]int64 {
+	c.mu.RLock()
+	size := len(c.entries)
+	c.mu.RUnlock()
+
+	return map[string]int64{
+		"hits":    c.hits.Load(),
+		"misses":  c.misses.Load(),
+		"entries": int64(size),
+	}
+}
+
+// get a user's effective perms, from the cache when it's enabled
+func (app *application) permissionsForUser(userID int64) (data.Permissions, error) {
+	var generation uint64
+
+	if app.permissions != nil {
+		if perms, found := app.permissions.get(userID); found {
+			return perms, nil
+		}
+		generation = app.permissions.current()
+	}
+
+	perms, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// return an empty list rather than null
+	if perms == nil {
+		perms = data.Permissions{}
+	}
+
+	if app.permissions != nil {
+		app.permissions.set(userID, perms, generation)
+	}
+
+	return perms, nil
+}
+
+// listen for perm changes from postgres and drop the affected cache entries,
+// this is how changes made through other api instances reach this one.
+// this blocks until the context is cancelled, so it should be run with app.background
+func (app *application) listenPermissionChanges(ctx context.Context) {
+	reportProblem := func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	}
+
+	listener := pq.NewListener(app.config.db.dsn, 10*time.Second, time.Minute, reportProblem)
+	defer listener.Close()
+
+	err := listener.Listen(data.PermissionChangesChannel)
+	if err != nil {
+		app.logger.Error(err.Error())
+		return
+	}
+
+	// anything cached before listening started may have changed since
+	app.permissions.invalidateAll()
+
+	ticker := time.NewTicker(90 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			go listener.Ping()
+			app.permissions.prune(time.Now())
+		case n := <-listener.Notify:
+			// a nil notification means the connection was re-established,
+			// changes made in the meantime weren't seen
+			if n == nil || n.Extra == data.PermissionChangesAll {
+				app.permissions.invalidateAll()
+				continue
+			}
+
+			userID, err := strconv.ParseInt(n.Extra, 10, 64)
+			if err != nil {
+				app.logger.Error("invalid permission change payload", "payload", n.Extra)
+				app.permissions.invalidateAll()
+				continue
+			}
+
+			app.permissions.invalidate(userID)
+		}
+	}
+}
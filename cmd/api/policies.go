@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/Bekian/greenlight/internal/data"
+)
+
+// perm codes that allow changing movies, the route needs one of them
+// and moviePolicy decides which movies it covers
+var movieWritePerms = []string{"movies:write", "movies:write:own"}
+
+// decides which movies the current user may change.
+// movies:write covers every movie and movies:write:own only the ones the user created.
+// it's built once per request so bulk endpoints can check each movie without going back to the db
+type moviePolicy struct {
+	userID int64
+	all    bool
+	own    bool
+}
+
+// build the movie policy for the request's user
+func (app *application) moviePolicy(r *http.Request) (moviePolicy, error) {
+	perms, err := app.userPermissions(r)
+	if err != nil {
+		return moviePolicy{}, err
+	}
+
+	policy := moviePolicy{
+		userID: app.contextGetUser(r).ID,
+		all:    perms.Include("movies:write"),
+		own:    perms.Include("movies:write:own"),
+	}
+
+	return policy, nil
+}
+
+// check the user may update or delete the movie
+func (p moviePolicy) canModify(movie *data.Movie) bool {
+	if p.all {
+		return true
+	}
+
+	return p.own && movie.CreatedBy != nil && *movie.CreatedBy == p.userID
+}
+
+// check the movie policy for a single movie, sending a 403 when it's denied.
+// ok is false when a response has already been sent
+func (app *application) authorizeMovie(w http.ResponseWriter, r *http.Request, movie *data.Movie) bool {
+	policy, err := app.moviePolicy(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !policy.canModify(movie) {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+
+	return true
+}
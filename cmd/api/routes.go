@@ -3,38 +3,115 @@ package main
 import (
 	"expvar"
 	"net/http"
-
-	"github.com/julienschmidt/httprouter"
 )
 
 func (app *application) routes() http.Handler {
-	router := httprouter.New()
+	router := app.router()
+
+	// use middleware
+	return app.metrics(app.recoverPanic(app.enableCORS(app.negotiate(app.rateLimit(app.authenticate(router))))))
+}
+
+// register every route with its handler and permission checks
+func (app *application) router() *apiRouter {
+	// this records each route so they can be checked against the openapi spec
+	router := app.newAPIRouter()
 
 	// handle 404 and 405 responses respectively
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/openapi.json", app.openAPIHandler)
 
 	// register methods on the routes
 	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePerm("movies:read", app.listMoviesHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePerm("movies:write", app.createMovieHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requireAnyPerm(movieWritePerms, app.createMovieHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePerm("movies:read", app.showMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePerm("movies:write", app.updateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePerm("movies:write", app.deleteMovieHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requireAnyPerm(movieWritePerms, app.updateMovieHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requireAnyPerm(movieWritePerms, app.deleteMovieHandler))
+
+	// server-sent event stream of movie changes
+	router.HandlerFunc(http.MethodGet, "/v1/events/movies", app.requirePerm("movies:read", app.movieEventsHandler))
+
+	// webhook endpoints
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks", app.requirePerm("webhooks:admin", app.listWebhooksHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks", app.requirePerm("webhooks:admin", app.createWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id", app.requirePerm("webhooks:admin", app.showWebhookHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/webhooks/:id", app.requirePerm("webhooks:admin", app.updateWebhookHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/webhooks/:id", app.requirePerm("webhooks:admin", app.deleteWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id/deliveries", app.requirePerm("webhooks:admin", app.listWebhookDeliveriesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks/:id/deliveries/:delivery_id/redeliver", app.requirePerm("webhooks:admin", app.redeliverWebhookHandler))
+
+	// user administration endpoints
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePerm("users:admin", app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePerm("users:admin", app.showUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/users/:id", app.requirePerm("users:admin", app.updateUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/permissions/:code", app.requirePerm("users:admin", app.grantUserPermissionHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions/:code", app.requirePerm("users:admin", app.revokeUserPermissionHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/roles/:role", app.requirePerm("users:admin", app.grantUserRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles/:role", app.requirePerm("users:admin", app.revokeUserRoleHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/password-reset", app.requirePerm("users:admin", app.createUserPasswordResetHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/tokens", app.requirePerm("users:admin", app.revokeUserTokensHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/lockout", app.requirePerm("users:unlock", app.unlockUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePerm("users:admin", app.listRolesHandler))
+
+	// invitation endpoints, accepting one doesn't need an account
+	router.HandlerFunc(http.MethodGet, "/v1/admin/invitations", app.requirePerm("users:admin", app.listInvitationsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/invitations", app.requirePerm("users:admin", app.createInvitationHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/invitations/:id", app.requirePerm("users:admin", app.deleteInvitationHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/invitations/accept", app.acceptInvitationHandler)
+
+	// audit log endpoints
+	router.HandlerFunc(http.MethodGet, "/v1/admin/audit", app.requirePerm("audit:read", app.listAuditEventsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/audit/export", app.requirePerm("audit:read", app.exportAuditEventsHandler))
+
+	// read-only graphql endpoint, permissions are checked per field by the resolvers
+	router.HandlerFunc(http.MethodPost, "/v1/graphql", app.graphqlHandler)
 
 	// user endpoints
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
 
+	// self-service account endpoints
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireAuthenticatedUser(app.showCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireActivatedUser(app.rejectAPIKeys(app.updateCurrentUserHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireAuthenticatedUser(app.rejectAPIKeys(app.deleteCurrentUserHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/deletion", app.requireAuthenticatedUser(app.rejectAPIKeys(app.cancelCurrentUserDeletionHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/export", app.requireAuthenticatedUser(app.rejectAPIKeys(app.exportCurrentUserHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireAuthenticatedUser(app.rejectAPIKeys(app.listCurrentUserSessionsHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireAuthenticatedUser(app.rejectAPIKeys(app.deleteCurrentUserSessionHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/password", app.requireActivatedUser(app.rejectAPIKeys(app.updateCurrentUserPasswordHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api-keys", app.requireActivatedUser(app.rejectAPIKeys(app.createAPIKeyHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys", app.requireAuthenticatedUser(app.rejectAPIKeys(app.listAPIKeysHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api-keys/:id", app.requireAuthenticatedUser(app.rejectAPIKeys(app.deleteAPIKeyHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/mfa", app.requireAuthenticatedUser(app.rejectAPIKeys(app.showMFAHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/mfa/totp", app.requireActivatedUser(app.rejectAPIKeys(app.createTOTPHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/mfa/totp", app.requireActivatedUser(app.rejectAPIKeys(app.confirmTOTPHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/mfa/totp", app.requireAuthenticatedUser(app.rejectAPIKeys(app.deleteTOTPHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/email", app.requireActivatedUser(app.rejectAPIKeys(app.requestEmailChangeHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmEmailChangeHandler)
+
 	// token endpoints
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.rejectAPIKeys(app.deleteAuthenticationTokenHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/mfa", app.createMFAAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link", app.createMagicLinkTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/login", app.createLoginAuthenticationTokenHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
 
+	// single sign-on through openid connect identity providers
+	router.HandlerFunc(http.MethodGet, "/v1/oidc", app.listOIDCProvidersHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/oidc/:provider/authorize", app.createOIDCAuthorizationHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/oidc/:provider/callback", app.oidcCallbackHandler)
+
+	// public keys for verifying jwt authentication tokens
+	router.HandlerFunc(http.MethodGet, "/.well-known/jwks.json", app.jwksHandler)
+
 	// expvar handler for basic app metrics
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
 
-	// use middleware
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	return router
 }
@@ -23,6 +23,16 @@ func (app *application) serve() error {
 		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
 	}
 
+	// close the event broker when shutdown starts,
+	// otherwise open event streams would keep the server from shutting down
+	server.RegisterOnShutdown(app.events.close)
+
+	// context for long running background workers, this is cancelled when shutdown starts
+	// so they stop picking up new work, then app.wg waits for their current work to finish
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server.RegisterOnShutdown(cancel)
+
 	// channel to receive any errors during shutdown function
 	shutdownError := make(chan error)
 
@@ -57,6 +67,39 @@ func (app *application) serve() error {
 		shutdownError <- nil
 	}()
 
+	// revoked jwts have to be known before any requests are served,
+	// after this they're kept up to date by the listener
+	if app.jwt != nil {
+		err := app.loadTokenRevocations()
+		if err != nil {
+			return err
+		}
+
+		app.background(func() {
+			app.listenTokenRevocations(ctx)
+		})
+	}
+
+	// cached perms are dropped when postgres reports a change
+	if app.permissions != nil {
+		app.background(func() {
+			app.listenPermissionChanges(ctx)
+		})
+	}
+
+	// listen for movie changes from postgres in the background
+	app.background(app.listenMovieEvents)
+
+	// send queued webhook deliveries in the background
+	app.background(func() {
+		app.deliverWebhooks(ctx)
+	})
+
+	// delete expired and stale rows in the background
+	app.background(func() {
+		app.runMaintenance(ctx)
+	})
+
 	// display server start
 	app.logger.Info("starting server", "addr", server.Addr, "env", app.config.env)
 
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/totp"
+)
+
+// an application with no database or mailer, for testing code that doesn't reach them
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	return &application{
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		events:  newMovieBroker(),
+		revoked: newTokenDenyList(),
+		clock:   time.Now,
+		totpKey: bytes.Repeat([]byte{1}, totp.KeySize),
+		openapi: openAPISpec(),
+	}
+}
+
+// a database with every migration applied, rolled back once the test is done.
+// tests using it are skipped unless GREENLIGHT_TEST_DB_DSN points at an empty database
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("GREENLIGHT_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("GREENLIGHT_TEST_DB_DSN isn't set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ups, err := filepath.Glob("../../migrations/*.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downs, err := filepath.Glob("../../migrations/*.down.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Reverse(downs)
+
+	t.Cleanup(func() {
+		defer db.Close()
+
+		for _, file := range downs {
+			script, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := db.Exec(string(script)); err != nil {
+				t.Fatalf("%s: %v", filepath.Base(file), err)
+			}
+		}
+	})
+
+	for _, file := range ups {
+		script, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.Exec(string(script)); err != nil {
+			t.Fatalf("%s: %v", filepath.Base(file), err)
+		}
+	}
+
+	return db
+}
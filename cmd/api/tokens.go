@@ -7,6 +7,8 @@ import (
 
 	"github.com/Bekian/greenlight/internal/data"
 	"github.com/Bekian/greenlight/internal/validator"
+
+	"github.com/tomasen/realip"
 )
 
 // this token is used in the event the user's welcome activation token expires, or they dont get their email
@@ -57,6 +59,8 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
+	app.audit(r, data.AuditTokenIssued, user.ID, envelope{"scope": data.ScopeActivation})
+
 	// send the users activation token in an email in a goroutine
 	app.background(func() {
 		data := map[string]any{
@@ -73,7 +77,7 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 	// send 202 res with confirmation message
 	env := envelope{"message": "an email will be sent to you containing activation instructions"}
 
-	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	err = app.writeResponse(w, r, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -96,27 +100,40 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	v := validator.New()
 
 	data.ValidateEmail(v, input.Email)
-	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidatePasswordPlaintext(v, input.Password, app.models.Users.Hasher.MaxLength())
 
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	// refuse ips that keep failing, whichever emails they try
+	ip := realip.FromRequest(r)
+
+	if !app.ipLoginAllowed(w, r, ip) {
+		return
+	}
+
 	// lookup user by email, otherwise send 401
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			app.invalidCredentialsResponse(w, r)
+			app.failedLoginResponse(w, r, nil, envelope{"method": "password", "email_hash": auditEmailHash(input.Email)})
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
+	// accounts with recent failures have to wait between attempts, or are locked
+	lockout, ok := app.emailLoginAllowed(w, r, user, envelope{"method": "password"})
+	if !ok {
+		return
+	}
+
 	// ensure pass is correct
-	match, err := user.Password.Matches(input.Password)
+	match, err := app.passwordMatches(user, input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -124,19 +141,183 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 
 	// if passwords dont match call invalid creds helper
 	if !match {
-		app.invalidCredentialsResponse(w, r)
+		app.failedLoginResponse(w, r, user, envelope{"method": "password"})
+		return
+	}
+
+	// the count starts again after a successful login
+	if lockout != nil {
+		err = app.models.Logins.Reset(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.startSession(w, r, user, "password")
+}
+
+// respond with a new session for a user whose password or identity was checked, method says which.
+// users with two-factor authentication get a short lived mfa token instead,
+// which is exchanged for a session along with a code at POST /v1/tokens/mfa
+func (app *application) startSession(w http.ResponseWriter, r *http.Request, user *data.User, method string) {
+	enrolment, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if enrolment != nil && enrolment.Enabled {
+		token, err := app.models.Tokens.New(user.ID, mfaTokenTTL, data.ScopeMFA)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.audit(r, data.AuditTokenIssued, user.ID, envelope{"scope": data.ScopeMFA, "method": method})
+
+		env := envelope{
+			"message":   "a code from your authenticator app is needed to finish logging in",
+			"mfa_token": token,
+		}
+
+		err = app.writeResponse(w, r, http.StatusAccepted, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	// generate new token with 24h expiry and auth scope
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// start a new session with an authentication and refresh token
+	env, err := app.newSessionTokens(r, user, data.NewTokenFamily())
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// encode the token and wrap it into the response
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	app.audit(r, data.AuditLoginSucceeded, user.ID, envelope{"method": method})
+
+	// encode the tokens and wrap them into the response
+	err = app.writeResponse(w, r, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// issue an authentication and refresh token in the given family.
+// the ip and user agent are stored so the user can recognise the session later
+func (app *application) newSessionTokens(r *http.Request, user *data.User, family string) (envelope, error) {
+	ip, userAgent := realip.FromRequest(r), r.UserAgent()
+
+	var token *data.Token
+	var err error
+
+	if app.jwt != nil {
+		token, err = app.newJWTSession(user, family, ip, userAgent)
+	} else {
+		token, err = app.models.Tokens.NewSession(user.ID, app.config.tokens.accessTTL, data.ScopeAuthentication, family, ip, userAgent)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	refresh, err := app.models.Tokens.NewSession(user.ID, app.config.tokens.refreshTTL, data.ScopeRefresh, family, ip, userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	return envelope{"authentication_token": token, "refresh_token": refresh}, nil
+}
+
+// exchange a refresh token for a new authentication and refresh token.
+// refresh tokens can only be used once, presenting one again revokes the whole session
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		// report the error under the field name the client used
+		if message, found := v.Errors["token"]; found {
+			delete(v.Errors, "token")
+			v.AddError("refresh_token", message)
+		}
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	refresh, err := app.models.Tokens.UseRefresh(input.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			// the token has probably leaked, so end the session for whoever holds it
+			app.logger.Warn("refresh token reused, revoking session", "user_id", refresh.UserId, "token_id", refresh.ID)
+
+			err = app.models.Tokens.DeleteFamily(refresh.Family)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			app.audit(r, data.AuditTokenRevoked, refresh.UserId, envelope{"scope": "session", "reason": "refresh token reused"})
+
+			v.AddError("refresh_token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("refresh_token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the user is read again so a jwt gets their current activation state
+	user, err := app.models.Users.Get(refresh.UserId)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env, err := app.newSessionTokens(r, user, refresh.Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditTokenIssued, user.ID, envelope{"scope": data.ScopeAuthentication, "method": "refresh"})
+
+	err = app.writeResponse(w, r, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revoke the authentication token used to make the request, along with its refresh token
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.models.Tokens.DeleteSession(data.ScopeAuthentication, app.contextGetToken(r))
+	if err != nil {
+		switch {
+		// the token was revoked by another request since it was authenticated
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditTokenRevoked, app.contextGetUser(r).ID, envelope{"scope": "session"})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "you have been signed out"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -188,6 +369,8 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 		return
 	}
 
+	app.audit(r, data.AuditTokenIssued, user.ID, envelope{"scope": data.ScopePasswordReset})
+
 	// email user with their password reset token
 	app.background(func() {
 		data := map[string]any{
@@ -203,7 +386,7 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 
 	// send 202 response with confirmation message
 	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
-	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	err = app.writeResponse(w, r, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -10,6 +10,12 @@ import (
 )
 
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
+	// invited users register with POST /v1/invitations/accept instead
+	if app.config.registration.mode == registrationInviteOnly {
+		app.registrationClosedResponse(w, r)
+		return
+	}
+
 	// struct to hold expected data
 	var input struct {
 		Name     string `json:"name"`
@@ -32,7 +38,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// generate and store passwords
-	err = user.Password.Set(input.Password)
+	err = app.models.Users.SetPassword(user, input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -40,8 +46,17 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	v := validator.New()
 
-	// validate user
-	if data.ValidateUser(v, user); !v.Valid() {
+	// validate user, and check the password against the password policy
+	data.ValidateUser(v, user, app.models.Users.Hasher.MaxLength())
+	app.validateRegistration(v, user.Email)
+
+	err = app.passwords.Validate(v, input.Password, input.Name, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
@@ -59,13 +74,16 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// add "movies:read" perm code for new user
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
+	// give the new user the default role
+	err = app.models.Roles.AddForUser(user.ID, app.config.roles.defaultRole)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	app.enqueueWebhookEvent("user.created", envelope{"user": user})
+	app.audit(r, data.AuditUserRegistered, user.ID, envelope{"method": "password"})
+
 	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -87,7 +105,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	})
 
 	// write the created user into the 202 response, the processing isnt done yet so 202 not 201
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
+	err = app.writeResponse(w, r, http.StatusAccepted, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -149,8 +167,11 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	app.enqueueWebhookEvent("user.activated", envelope{"user": user})
+	app.audit(r, data.AuditUserActivated, user.ID, nil)
+
 	// write the user details into the response
-	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -173,7 +194,7 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 
 	v := validator.New()
 
-	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidatePasswordPlaintext(v, input.Password, app.models.Users.Hasher.MaxLength())
 	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
 
 	if !v.Valid() {
@@ -194,8 +215,20 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 		return
 	}
 
+	// the new password has to follow the password policy
+	err = app.passwords.Validate(v, input.Password, user.Name, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// set new password
-	err = user.Password.Set(input.Password)
+	err = app.models.Users.SetPassword(user, input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -221,10 +254,38 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 		return
 	}
 
+	// resetting the password also ends a lockout
+	err = app.models.Logins.Reset(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditPasswordChanged, user.ID, envelope{"method": "reset"})
+
 	// send confirmation message
 	env := envelope{"message": "your password was successfully reset"}
-	err = app.writeJSON(w, http.StatusOK, env, nil)
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// check a user's password, hashing it again if it was stored with an old algorithm or parameters.
+// a failed rehash is only logged, it's tried again the next time the password is checked
+func (app *application) passwordMatches(user *data.User, plaintext string) (bool, error) {
+	match, err := app.models.Users.PasswordMatches(user, plaintext)
+	if err != nil || !match || !user.Password.NeedsRehash() {
+		return match, err
+	}
+
+	err = app.models.Users.SetPassword(user, plaintext)
+	if err == nil {
+		err = app.models.Users.Update(user)
+	}
+	if err != nil {
+		app.logger.Error("rehashing password failed", "user_id", user.ID, "error", err.Error())
+	}
+
+	return true, nil
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/validator"
+)
+
+// number of deliveries claimed at once by the worker
+const webhookBatchSize = 10
+
+// delay before the first retry, this doubles with every failed attempt
+const webhookRetryBase = 30 * time.Second
+
+// longest delay between retries
+const webhookRetryMax = 6 * time.Hour
+
+// queue an event for every subscribed webhook.
+// this runs after the change is committed rather than in the same transaction, so events are at most once:
+// if queueing fails, or the process dies between the commit and this, the event is lost.
+// the change has already been saved at this point, so failures are logged rather than sent to the client
+func (app *application) enqueueWebhookEvent(event string, payload envelope) {
+	js, err := json.Marshal(envelope{
+		"event":      event,
+		"created_at": time.Now().UTC(),
+		"data":       payload,
+	})
+	if err != nil {
+		app.logger.Error(err.Error(), "event", event)
+		return
+	}
+
+	err = app.models.Deliveries.Enqueue(event, js)
+	if err != nil {
+		app.logger.Error(err.Error(), "event", event)
+	}
+}
+
+// poll for due deliveries until the context is cancelled.
+// this should be run with app.background so in-flight deliveries finish during shutdown
+func (app *application) deliverWebhooks(ctx context.Context) {
+	ticker := time.NewTicker(app.config.webhooks.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// keep claiming batches until the queue is empty or shutdown starts
+			for ctx.Err() == nil {
+				n, err := app.processWebhookDeliveries()
+				if err != nil {
+					app.logger.Error(err.Error())
+					break
+				}
+				if n < webhookBatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// claim and send a batch of deliveries, returning how many were claimed
+func (app *application) processWebhookDeliveries() (int, error) {
+	// the lease must outlast the send timeout, otherwise another instance could claim it mid-delivery
+	lease := app.config.webhooks.timeout + 30*time.Second
+
+	deliveries, err := app.models.Deliveries.Claim(webhookBatchSize, lease)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			app.sendWebhookDelivery(delivery)
+		}()
+	}
+
+	wg.Wait()
+
+	return len(deliveries), nil
+}
+
+// send a single delivery and record the outcome
+func (app *application) sendWebhookDelivery(delivery *data.WebhookDelivery) {
+	// this deliberately isn't tied to the shutdown context so in-flight deliveries can finish
+	ctx, cancel := context.WithTimeout(context.Background(), app.config.webhooks.timeout)
+	defer cancel()
+
+	status, err := app.webhooks.Send(ctx, delivery.URL, delivery.Secret, delivery.Event, delivery.ID, delivery.Payload)
+
+	recordWebhookAttempt(delivery, status, err, time.Now(), app.config.webhooks.maxAttempts)
+
+	err = app.models.Deliveries.RecordAttempt(delivery)
+	if err != nil {
+		app.logger.Error(err.Error(), "delivery_id", delivery.ID)
+	}
+}
+
+// update a delivery with the outcome of an attempt, scheduling a retry
+// or giving up once it has been tried maxAttempts times
+func recordWebhookAttempt(delivery *data.WebhookDelivery, status int, err error, now time.Time, maxAttempts int) {
+	delivery.Attempts++
+	delivery.LastAttemptAt = &now
+	delivery.LastStatusCode = status
+	delivery.LastError = ""
+
+	switch {
+	case err == nil:
+		delivery.Status = data.DeliverySucceeded
+	case delivery.Attempts >= maxAttempts:
+		// give up, the delivery can still be sent again by an admin
+		delivery.Status = data.DeliveryDead
+		delivery.LastError = err.Error()
+	default:
+		delivery.Status = data.DeliveryPending
+		delivery.NextAttemptAt = now.Add(webhookRetryDelay(delivery.Attempts))
+		delivery.LastError = err.Error()
+	}
+}
+
+// exponential backoff delay after the given number of failed attempts
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookRetryBase
+	for range attempts - 1 {
+		delay *= 2
+		if delay >= webhookRetryMax {
+			return webhookRetryMax
+		}
+	}
+
+	return delay
+}
+
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Secret *string  `json:"secret"`
+		Active *bool    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	webhook := &data.Webhook{
+		URL:    input.URL,
+		Events: input.Events,
+		Active: true,
+	}
+
+	// generate a secret if one wasn't provided
+	if input.Secret != nil {
+		webhook.Secret = *input.Secret
+	} else {
+		webhook.Secret = rand.Text() + rand.Text()
+	}
+
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+
+	v := validator.New()
+
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Insert(webhook)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditWebhookCreated, 0, envelope{"webhook_id": webhook.ID, "url": webhook.URL})
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/webhooks/%d", webhook.ID))
+
+	// the secret is only included in the response when the webhook is created
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"webhook": webhook, "secret": webhook.Secret}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	webhook, err := app.models.Webhooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	webhook, err := app.models.Webhooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		URL    *string  `json:"url"`
+		Events []string `json:"events"`
+		Secret *string  `json:"secret"`
+		Active *bool    `json:"active"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.URL != nil {
+		webhook.URL = *input.URL
+	}
+	if input.Events != nil {
+		webhook.Events = input.Events
+	}
+	if input.Secret != nil {
+		webhook.Secret = *input.Secret
+	}
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+
+	v := validator.New()
+
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Update(webhook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditWebhookUpdated, 0, envelope{"webhook_id": webhook.ID, "url": webhook.URL, "secret_changed": input.Secret != nil})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Webhooks.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditWebhookDeleted, 0, envelope{"webhook_id": id})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafeList = []string{"id", "created_at", "url", "-id", "-created_at", "-url"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	webhooks, metadata, err := app.models.Webhooks.GetAll(input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"webhooks": webhooks, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// delivery log for a single webhook
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Status string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafeList = []string{"id", "next_attempt_at", "-id", "-next_attempt_at"}
+
+	if input.Status != "" {
+		v.Check(validator.PermittedValue(input.Status, data.DeliveryPending, data.DeliverySucceeded, data.DeliveryDead), "status", "invalid status value")
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// make sure the webhook exists so unknown ids get a 404 instead of an empty list
+	_, err = app.models.Webhooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	deliveries, metadata, err := app.models.Deliveries.GetAllForWebhook(id, input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// queue a new attempt of an existing delivery, this works for dead deliveries too
+func (app *application) redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	deliveryID, err := app.readNamedIDParam(r, "delivery_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	delivery, err := app.models.Deliveries.Get(id, deliveryID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	delivery, err = app.models.Deliveries.Redeliver(delivery)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusAccepted, envelope{"delivery": delivery}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/data"
+	"github.com/Bekian/greenlight/internal/webhook"
+)
+
+func TestWebhookRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{5, 8 * time.Minute},
+		{10, 256 * time.Minute},
+		{11, webhookRetryMax},
+		{100, webhookRetryMax},
+	}
+
+	for _, tt := range tests {
+		if got := webhookRetryDelay(tt.attempts); got != tt.want {
+			t.Errorf("webhookRetryDelay(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestRecordWebhookAttempt(t *testing.T) {
+	var status int
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	client := webhook.New(time.Second, "greenlight-test")
+	now := time.Now()
+
+	send := func(delivery *data.WebhookDelivery, maxAttempts int) {
+		code, err := client.Send(context.Background(), receiver.URL, "secret", delivery.Event, delivery.ID, delivery.Payload)
+		recordWebhookAttempt(delivery, code, err, now, maxAttempts)
+	}
+
+	t.Run("failures are retried with backoff", func(t *testing.T) {
+		status = http.StatusInternalServerError
+		delivery := &data.WebhookDelivery{ID: 1, Event: "movie.created", Status: data.DeliveryPending}
+
+		for attempt := 1; attempt <= 3; attempt++ {
+			send(delivery, 4)
+
+			if delivery.Status != data.DeliveryPending {
+				t.Fatalf("attempt %d: got status %q, want %q", attempt, delivery.Status, data.DeliveryPending)
+			}
+			if delivery.Attempts != attempt {
+				t.Errorf("got %d attempts, want %d", delivery.Attempts, attempt)
+			}
+			if want := now.Add(webhookRetryDelay(attempt)); !delivery.NextAttemptAt.Equal(want) {
+				t.Errorf("attempt %d: next attempt at %v, want %v", attempt, delivery.NextAttemptAt, want)
+			}
+			if delivery.LastStatusCode != http.StatusInternalServerError || delivery.LastError == "" {
+				t.Errorf("attempt %d: got status code %d and error %q", attempt, delivery.LastStatusCode, delivery.LastError)
+			}
+		}
+
+		// the last allowed attempt moves it to the dead letters without scheduling another
+		next := delivery.NextAttemptAt
+		send(delivery, 4)
+
+		if delivery.Status != data.DeliveryDead {
+			t.Errorf("got status %q, want %q", delivery.Status, data.DeliveryDead)
+		}
+		if !delivery.NextAttemptAt.Equal(next) {
+			t.Errorf("dead delivery was rescheduled for %v", delivery.NextAttemptAt)
+		}
+		if delivery.LastError == "" {
+			t.Error("expected the last error to be kept")
+		}
+	})
+
+	t.Run("success clears the last error", func(t *testing.T) {
+		status = http.StatusInternalServerError
+		delivery := &data.WebhookDelivery{ID: 2, Event: "movie.created", Status: data.DeliveryPending}
+		send(delivery, 4)
+
+		status = http.StatusOK
+		send(delivery, 4)
+
+		if delivery.Status != data.DeliverySucceeded {
+			t.Errorf("got status %q, want %q", delivery.Status, data.DeliverySucceeded)
+		}
+		if delivery.Attempts != 2 {
+			t.Errorf("got %d attempts, want 2", delivery.Attempts)
+		}
+		if delivery.LastError != "" || delivery.LastStatusCode != http.StatusOK {
+			t.Errorf("got status code %d and error %q", delivery.LastStatusCode, delivery.LastError)
+		}
+	})
+
+	t.Run("unreachable receivers count as failures", func(t *testing.T) {
+		closed := httptest.NewServer(http.NotFoundHandler())
+		closed.Close()
+
+		delivery := &data.WebhookDelivery{ID: 3, Event: "movie.created", Status: data.DeliveryPending}
+		code, err := client.Send(context.Background(), closed.URL, "secret", delivery.Event, delivery.ID, nil)
+		recordWebhookAttempt(delivery, code, err, now, 1)
+
+		if delivery.Status != data.DeliveryDead {
+			t.Errorf("got status %q, want %q", delivery.Status, data.DeliveryDead)
+		}
+		if delivery.LastStatusCode != 0 {
+			t.Errorf("got status code %d, want 0", delivery.LastStatusCode)
+		}
+	})
+}
+
+func TestClaimSkipsInactiveWebhooks(t *testing.T) {
+	models := data.NewModels(newTestDB(t))
+
+	hook := &data.Webhook{URL: "https://example.com/hook", Events: []string{"*"}, Secret: "0123456789abcdef", Active: true}
+	if err := models.Webhooks.Insert(hook); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := models.Deliveries.Enqueue("movie.created", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	hook.Active = false
+	if err := models.Webhooks.Update(hook); err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, err := models.Deliveries.Claim(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 0 {
+		t.Fatalf("claimed %d deliveries for an inactive webhook", len(claimed))
+	}
+
+	// they're sent once it's turned back on
+	hook.Active = true
+	if err := models.Webhooks.Update(hook); err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, err = models.Deliveries.Claim(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 {
+		t.Errorf("claimed %d deliveries, want 1", len(claimed))
+	}
+}
@@ -0,0 +1,247 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/validator"
+
+	"github.com/lib/pq"
+)
+
+// every api key starts with this so secret scanners can recognise leaked keys
+const APIKeyPrefix = "glk_"
+
+// number of characters of the plaintext kept so the user can tell their keys apart
+const apiKeyDisplayLength = len(APIKeyPrefix) + 6
+
+// a long lived key for machine clients, limited to a subset of its user's permissions
+type APIKey struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Prefix      string      `json:"prefix"` // the start of the key, the rest is only shown once
+	Plaintext   string      `json:"-"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      *time.Time  `json:"expiry"` // nil for keys that don't expire
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+}
+
+// generate the plaintext and hash for a new key
+func NewAPIKey(userID int64, name string, permissions Permissions, expiry *time.Time) *APIKey {
+	plaintext := APIKeyPrefix + rand.Text()
+	hash := sha256.Sum256([]byte(plaintext))
+
+	return &APIKey{
+		UserID:      userID,
+		Name:        name,
+		Prefix:      plaintext[:apiKeyDisplayLength],
+		Plaintext:   plaintext,
+		Hash:        hash[:],
+		Permissions: permissions,
+		Expiry:      expiry,
+	}
+}
+
+// the user's own permissions are needed to check the key is limited to a subset of them
+func ValidateAPIKey(v *validator.Validator, key *APIKey, userPermissions Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(key.Permissions != nil, "permissions", "must be provided")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	ValidateGrantable(v, "permissions", key.Permissions, userPermissions)
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// check the plaintext has the shape of a key before looking it up
+func ValidateAPIKeyPlaintext(v *validator.Validator, plaintext string) {
+	v.Check(strings.HasPrefix(plaintext, APIKeyPrefix), "key", "must start with "+APIKeyPrefix)
+	v.Check(len(plaintext) == len(APIKeyPrefix)+26, "key", "must be 30 bytes long")
+}
+
+// connection pool wrapper
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// insert a new key
+func (m APIKeyModel) Insert(key *APIKey) error {
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, permissions, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	args := []any{key.UserID, key.Name, key.Prefix, key.Hash, pq.Array(key.Permissions), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// get all keys belonging to a user, newest first
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+		SELECT id, created_at, user_id, name, prefix, permissions, expiry, last_used_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(
+			&key.ID,
+			&key.CreatedAt,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array(&key.Permissions),
+			&key.Expiry,
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// get an unexpired key and the user it belongs to by its plaintext
+func (m APIKeyModel) GetForPlaintext(plaintext string) (*APIKey, *User, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		SELECT api_keys.id, api_keys.created_at, api_keys.name, api_keys.prefix, api_keys.permissions,
+			api_keys.expiry, api_keys.last_used_at,
+			users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version,
+			users.pending_email, users.deletion_scheduled_at
+		FROM api_keys
+		INNER JOIN users ON users.id = api_keys.user_id
+		WHERE api_keys.hash = $1
+		AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)`
+
+	var key APIKey
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], time.Now()).Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Permissions),
+		&key.Expiry,
+		&key.LastUsedAt,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.PendingEmail,
+		&user.DeletionScheduledAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	key.UserID = user.ID
+
+	return &key, &user, nil
+}
+
+// record that a key was used, throttled like TokenModel.Touch
+func (m APIKeyModel) Touch(id int64) error {
+	query := `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - make_interval(secs => $2))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, TouchInterval.Seconds())
+	return err
+}
+
+// delete one of a user's keys
+func (m APIKeyModel) DeleteForUser(userID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM api_keys
+		WHERE user_id = $1 AND id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// delete every key a user has
+func (m APIKeyModel) DeleteAllForUser(userID int64) error {
+	query := `
+		DELETE FROM api_keys
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
@@ -0,0 +1,258 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// security event actions recorded in the audit log
+const (
+	AuditLoginSucceeded        = "login.succeeded"
+	AuditLoginFailed           = "login.failed"
+	AuditUserRegistered        = "user.registered"
+	AuditUserActivated         = "user.activated"
+	AuditUserUpdated           = "user.updated"
+	AuditUserLocked            = "user.locked"
+	AuditUserUnlocked          = "user.unlocked"
+	AuditUserDeletionScheduled = "user.deletion_scheduled"
+	AuditUserDeletionCancelled = "user.deletion_cancelled"
+	AuditPasswordChanged       = "password.changed"
+	AuditEmailChanged          = "email.changed"
+	AuditIdentityLinked        = "identity.linked"
+	AuditTokenIssued           = "token.issued"
+	AuditTokenRevoked          = "token.revoked"
+	AuditMFAEnabled            = "mfa.enabled"
+	AuditMFADisabled           = "mfa.disabled"
+	AuditPermissionGranted     = "permission.granted"
+	AuditPermissionRevoked     = "permission.revoked"
+	AuditRoleGranted           = "role.granted"
+	AuditRoleRevoked           = "role.revoked"
+	AuditWebhookCreated        = "webhook.created"
+	AuditWebhookUpdated        = "webhook.updated"
+	AuditWebhookDeleted        = "webhook.deleted"
+	AuditInvitationCreated     = "invitation.created"
+	AuditInvitationDeleted     = "invitation.deleted"
+)
+
+// every audit action, used to validate filters
+var AuditActions = []string{
+	AuditLoginSucceeded,
+	AuditLoginFailed,
+	AuditUserRegistered,
+	AuditUserActivated,
+	AuditUserUpdated,
+	AuditUserLocked,
+	AuditUserUnlocked,
+	AuditUserDeletionScheduled,
+	AuditUserDeletionCancelled,
+	AuditPasswordChanged,
+	AuditEmailChanged,
+	AuditIdentityLinked,
+	AuditTokenIssued,
+	AuditTokenRevoked,
+	AuditMFAEnabled,
+	AuditMFADisabled,
+	AuditPermissionGranted,
+	AuditPermissionRevoked,
+	AuditRoleGranted,
+	AuditRoleRevoked,
+	AuditWebhookCreated,
+	AuditWebhookUpdated,
+	AuditWebhookDeleted,
+	AuditInvitationCreated,
+	AuditInvitationDeleted,
+}
+
+// a single security event.
+// the actor is the authenticated user who made the request, nil for anonymous requests like logins,
+// and the user is the account the event is about
+type AuditEvent struct {
+	ID        int64          `json:"id"`
+	CreatedAt time.Time      `json:"created_at"`
+	Action    string         `json:"action"`
+	ActorID   *int64         `json:"actor_id"`
+	UserID    *int64         `json:"user_id"`
+	IP        string         `json:"ip"`
+	UserAgent string         `json:"user_agent"`
+	Details   map[string]any `json:"details"`
+}
+
+// filters for listing and exporting audit events, zero values match everything
+type AuditFilter struct {
+	Actions []string
+	ActorID *int64
+	UserID  *int64
+	IP      string
+	Since   *time.Time
+	Until   *time.Time
+}
+
+// connection pool wrapper
+type AuditModel struct {
+	DB *sql.DB
+}
+
+const auditEventColumns = `id, created_at, action, actor_id, user_id, ip, user_agent, details`
+
+// the where clause for an AuditFilter, its arguments start at $1 in the order of auditFilterArgs
+const auditFilterWhere = `
+	WHERE (action = ANY($1) OR cardinality($1::text[]) = 0)
+	AND (actor_id = $2 OR $2 IS NULL)
+	AND (user_id = $3 OR $3 IS NULL)
+	AND (ip = $4 OR $4 = '')
+	AND (created_at >= $5 OR $5 IS NULL)
+	AND (created_at < $6 OR $6 IS NULL)`
+
+func auditFilterArgs(filter AuditFilter) []any {
+	actions := filter.Actions
+	if actions == nil {
+		actions = []string{}
+	}
+
+	return []any{pq.Array(actions), filter.ActorID, filter.UserID, filter.IP, filter.Since, filter.Until}
+}
+
+// scan a single row selected with auditEventColumns into an event
+func scanAuditEvent(row interface{ Scan(...any) error }) (*AuditEvent, error) {
+	var (
+		event   AuditEvent
+		details []byte
+	)
+
+	err := row.Scan(
+		&event.ID,
+		&event.CreatedAt,
+		&event.Action,
+		&event.ActorID,
+		&event.UserID,
+		&event.IP,
+		&event.UserAgent,
+		&details,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(details, &event.Details)
+	if err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// append an event to the log
+func (m AuditModel) Insert(event *AuditEvent) error {
+	if event.Details == nil {
+		event.Details = map[string]any{}
+	}
+
+	event.UserAgent = truncateUserAgent(event.UserAgent)
+
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO audit_events (action, actor_id, user_id, ip, user_agent, details)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	args := []any{event.Action, event.ActorID, event.UserID, event.IP, event.UserAgent, details}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+// get a page of events matching the filter
+func (m AuditModel) GetAll(filter AuditFilter, filters Filters) ([]*AuditEvent, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), %s
+		FROM audit_events
+		%s
+		ORDER BY %s %s, id ASC
+		LIMIT $7 OFFSET $8`, auditEventColumns, auditFilterWhere, filters.sortColumn(), filters.sortDirection())
+
+	args := append(auditFilterArgs(filter), filters.limit(), filters.offset())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	events := []*AuditEvent{}
+
+	for rows.Next() {
+		var total int
+
+		// the count is scanned separately so scanAuditEvent can be shared with Export
+		event, err := scanAuditEvent(countingScanner{rows, &total})
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		totalRecords = total
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return events, metadata, nil
+}
+
+// call fn with every event matching the filter, oldest first.
+// exports can take a while, so this runs until ctx is done rather than the usual timeout
+func (m AuditModel) Export(ctx context.Context, filter AuditFilter, fn func(*AuditEvent) error) error {
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM audit_events
+		%s
+		ORDER BY id ASC`, auditEventColumns, auditFilterWhere)
+
+	rows, err := m.DB.QueryContext(ctx, query, auditFilterArgs(filter)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			return err
+		}
+
+		err = fn(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// scans a leading count(*) OVER() column before the rest of the row
+type countingScanner struct {
+	rows  *sql.Rows
+	total *int
+}
+
+func (s countingScanner) Scan(dest ...any) error {
+	return s.rows.Scan(append([]any{s.total}, dest...)...)
+}
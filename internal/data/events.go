@@ -0,0 +1,210 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// channel name used by the movies trigger with pg_notify
+const MovieEventsChannel = "movie_events"
+
+// constants for movie event actions
+const (
+	MovieCreated = "created"
+	MovieUpdated = "updated"
+	MovieDeleted = "deleted"
+)
+
+// a single change to the movies table, recorded by a trigger
+// movie is the current state of the record, or nil when it no longer exists
+type MovieEvent struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Action    string    `json:"action"`
+	MovieID   int64     `json:"movie_id"`
+	Movie     *Movie    `json:"movie,omitempty"`
+}
+
+// connection pool wrapper
+type MovieEventModel struct {
+	DB *sql.DB
+}
+
+// the movie columns are nullable here because of the left join,
+// a deleted movie wont have a matching row
+const movieEventColumns = `
+	movie_events.id, movie_events.created_at, movie_events.action, movie_events.movie_id,
+	movies.id, movies.created_at, movies.title, movies.year, movies.runtime, movies.genres, movies.version`
+
+// scan a single row selected with movieEventColumns into an event
+func scanMovieEvent(row interface{ Scan(...any) error }) (*MovieEvent, error) {
+	var (
+		event     MovieEvent
+		id        sql.NullInt64
+		createdAt sql.NullTime
+		title     sql.NullString
+		year      sql.NullInt32
+		runtime   sql.NullInt32
+		genres    []string
+		version   sql.NullInt32
+	)
+
+	err := row.Scan(
+		&event.ID,
+		&event.CreatedAt,
+		&event.Action,
+		&event.MovieID,
+		&id,
+		&createdAt,
+		&title,
+		&year,
+		&runtime,
+		pq.Array(&genres),
+		&version,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// only attach the movie if it still exists
+	if id.Valid {
+		event.Movie = &Movie{
+			ID:        id.Int64,
+			CreatedAt: createdAt.Time,
+			Title:     title.String,
+			Year:      year.Int32,
+			Runtime:   Runtime(runtime.Int32),
+			Genres:    genres,
+			Version:   version.Int32,
+		}
+	}
+
+	return &event, nil
+}
+
+// get a single event by id
+func (m MovieEventModel) Get(id int64) (*MovieEvent, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT ` + movieEventColumns + `
+		FROM movie_events
+		LEFT JOIN movies ON movies.id = movie_events.movie_id
+		WHERE movie_events.id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	event, err := scanMovieEvent(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return event, nil
+}
+
+// get up to limit events that happened after the provided event id, oldest first.
+// ids are assigned before commit, so an event with a lower id can become visible after a higher one.
+// events created within window of the provided one are included too, so callers have to skip ids they've already seen.
+// this is used to replay events a client missed while disconnected
+func (m MovieEventModel) GetAllAfter(id int64, window time.Duration, limit int) ([]*MovieEvent, error) {
+	query := `
+		SELECT ` + movieEventColumns + `
+		FROM movie_events
+		LEFT JOIN movies ON movies.id = movie_events.movie_id
+		WHERE movie_events.id > $1
+		OR (
+			movie_events.id <> $1
+			AND movie_events.created_at >= (SELECT created_at FROM movie_events WHERE id = $1) - make_interval(secs => $2)
+		)
+		ORDER BY movie_events.id ASC
+		LIMIT $3`
+
+	return m.getAll(query, id, window.Seconds(), limit)
+}
+
+// get the id of the latest event, 0 if there haven't been any
+func (m MovieEventModel) LatestID() (int64, error) {
+	query := `
+		SELECT COALESCE(max(id), 0)
+		FROM movie_events`
+
+	var id int64
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&id)
+	return id, err
+}
+
+// get up to limit events created at or after since, oldest first
+func (m MovieEventModel) GetAllSince(since time.Time, limit int) ([]*MovieEvent, error) {
+	query := `
+		SELECT ` + movieEventColumns + `
+		FROM movie_events
+		LEFT JOIN movies ON movies.id = movie_events.movie_id
+		WHERE movie_events.created_at >= $1
+		ORDER BY movie_events.id ASC
+		LIMIT $2`
+
+	return m.getAll(query, since, limit)
+}
+
+// run a query selecting movieEventColumns and scan every row
+func (m MovieEventModel) getAll(query string, args ...any) ([]*MovieEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*MovieEvent{}
+
+	for rows.Next() {
+		event, err := scanMovieEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// delete up to limit events created before the given time,
+// clients resuming from an older event id just miss them
+func (m MovieEventModel) DeleteBefore(before time.Time, limit int) (int64, error) {
+	query := `
+		DELETE FROM movie_events
+		WHERE id IN (SELECT id FROM movie_events WHERE created_at < $1 LIMIT $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, before, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,210 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// an account at an external identity provider linked to a user
+type Identity struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    int64     `json:"-"`
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"` // the email the provider reported when the identity was linked
+}
+
+// a login started at an identity provider, waiting for the provider to redirect back
+type OIDCLogin struct {
+	State        string
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	Expiry       time.Time
+}
+
+// connection pool wrapper
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// link an identity to a user
+func (m IdentityModel) Insert(identity *Identity) error {
+	query := `
+		INSERT INTO user_identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`
+
+	args := []any{identity.UserID, identity.Provider, identity.Subject, identity.Email}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&identity.ID, &identity.CreatedAt)
+	if err != nil {
+		switch {
+		// another login linked the same identity first
+		case err.Error() == `pq: duplicate key value violates unique constraint "user_identities_provider_subject_key"`:
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// get the user an identity is linked to
+func (m IdentityModel) GetUser(provider, subject string) (*User, error) {
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version,
+			users.pending_email, users.deletion_scheduled_at
+		FROM users
+		INNER JOIN user_identities ON user_identities.user_id = users.id
+		WHERE user_identities.provider = $1 AND user_identities.subject = $2`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, provider, subject).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.PendingEmail,
+		&user.DeletionScheduledAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// get all identities linked to a user
+func (m IdentityModel) GetAllForUser(userID int64) ([]*Identity, error) {
+	query := `
+		SELECT id, created_at, user_id, provider, subject, email
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []*Identity{}
+
+	for rows.Next() {
+		var identity Identity
+
+		err := rows.Scan(
+			&identity.ID,
+			&identity.CreatedAt,
+			&identity.UserID,
+			&identity.Provider,
+			&identity.Subject,
+			&identity.Email,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, &identity)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+// store a pending login, only a hash of the state is kept
+func (m IdentityModel) InsertLogin(login *OIDCLogin) error {
+	query := `
+		INSERT INTO oidc_logins (state_hash, provider, nonce, code_verifier, expiry)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	hash := sha256.Sum256([]byte(login.State))
+	args := []any{hash[:], login.Provider, login.Nonce, login.CodeVerifier, login.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// remove and return a pending login by its state, so each state can only be used once.
+// ErrRecordNotFound is returned if the state is unknown, expired or for another provider
+func (m IdentityModel) TakeLogin(provider, state string) (*OIDCLogin, error) {
+	query := `
+		DELETE FROM oidc_logins
+		WHERE state_hash = $1
+		RETURNING provider, nonce, code_verifier, expiry`
+
+	hash := sha256.Sum256([]byte(state))
+
+	login := OIDCLogin{State: state}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(
+		&login.Provider,
+		&login.Nonce,
+		&login.CodeVerifier,
+		&login.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if login.Provider != provider || time.Now().After(login.Expiry) {
+		return nil, ErrRecordNotFound
+	}
+
+	return &login, nil
+}
+
+// delete up to limit sign-ins that were started but never finished before they expired
+func (m IdentityModel) DeleteExpiredLogins(limit int) (int64, error) {
+	query := `
+		DELETE FROM oidc_logins
+		WHERE state_hash IN (SELECT state_hash FROM oidc_logins WHERE expiry < NOW() LIMIT $1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,293 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/validator"
+
+	"github.com/lib/pq"
+)
+
+// an invitation to register, the plaintext token is only known when it's created and is emailed to the invitee
+type Invitation struct {
+	ID          int64      `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Email       string     `json:"email"`
+	InvitedBy   *int64     `json:"invited_by"`
+	Roles       []string   `json:"roles"`
+	Permissions []string   `json:"permissions"`
+	Expiry      time.Time  `json:"expiry"`
+	AcceptedAt  *time.Time `json:"accepted_at,omitempty"`
+	UserID      *int64     `json:"user_id,omitempty"`
+	Plaintext   string     `json:"-"`
+	Hash        []byte     `json:"-"`
+}
+
+// generate a new invitation, it isn't saved until Insert is called
+func NewInvitation(email string, invitedBy int64, roles, permissions []string, ttl time.Duration) *Invitation {
+	plaintext := rand.Text()
+	hash := sha256.Sum256([]byte(plaintext))
+
+	// the columns can't be null
+	if roles == nil {
+		roles = []string{}
+	}
+	if permissions == nil {
+		permissions = []string{}
+	}
+
+	return &Invitation{
+		Email:       email,
+		InvitedBy:   &invitedBy,
+		Roles:       roles,
+		Permissions: permissions,
+		Expiry:      time.Now().Add(ttl),
+		Plaintext:   plaintext,
+		Hash:        hash[:],
+	}
+}
+
+// roles and perms are checked against the database by the handler
+func ValidateInvitation(v *validator.Validator, invitation *Invitation) {
+	ValidateEmail(v, invitation.Email)
+
+	v.Check(validator.Unique(invitation.Roles), "roles", "must not contain duplicate values")
+	v.Check(validator.Unique(invitation.Permissions), "permissions", "must not contain duplicate values")
+}
+
+// connection pool wrapper
+type InvitationModel struct {
+	DB *sql.DB
+}
+
+const invitationColumns = `id, created_at, email, invited_by, roles, permissions, expiry, accepted_at, user_id`
+
+// scan a single row selected with invitationColumns into an invitation
+func scanInvitation(row interface{ Scan(...any) error }) (*Invitation, error) {
+	var invitation Invitation
+
+	err := row.Scan(
+		&invitation.ID,
+		&invitation.CreatedAt,
+		&invitation.Email,
+		&invitation.InvitedBy,
+		pq.Array(&invitation.Roles),
+		pq.Array(&invitation.Permissions),
+		&invitation.Expiry,
+		&invitation.AcceptedAt,
+		&invitation.UserID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &invitation, nil
+}
+
+// save a new invitation
+func (m InvitationModel) Insert(invitation *Invitation) error {
+	query := `
+		INSERT INTO invitations (email, hash, invited_by, roles, permissions, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	args := []any{
+		invitation.Email,
+		invitation.Hash,
+		invitation.InvitedBy,
+		pq.Array(invitation.Roles),
+		pq.Array(invitation.Permissions),
+		invitation.Expiry,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&invitation.ID, &invitation.CreatedAt)
+}
+
+// get the invitation for a token, if it can still be accepted
+func (m InvitationModel) GetForToken(tokenPlaintext string) (*Invitation, error) {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		SELECT ` + invitationColumns + `
+		FROM invitations
+		WHERE hash = $1 AND accepted_at IS NULL AND expiry > $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	invitation, err := scanInvitation(m.DB.QueryRowContext(ctx, query, hash[:], time.Now()))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return invitation, nil
+}
+
+// get every invitation that can still be accepted, oldest first
+func (m InvitationModel) GetAllPending() ([]*Invitation, error) {
+	query := `
+		SELECT ` + invitationColumns + `
+		FROM invitations
+		WHERE accepted_at IS NULL AND expiry > $1
+		ORDER BY id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []*Invitation{}
+
+	for rows.Next() {
+		invitation, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		invitations = append(invitations, invitation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+// withdraw an invitation that hasn't been accepted yet
+func (m InvitationModel) DeletePending(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM invitations
+		WHERE id = $1 AND accepted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// create the user for an invitation and give them its roles and perms, all in one transaction.
+// the user is activated with the invited email, since the token was sent to it.
+// ErrRecordNotFound means the invitation was accepted, withdrawn or expired since it was read
+func (m InvitationModel) Accept(tokenPlaintext string, user *User) (*Invitation, error) {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// lock the invitation so two requests can't both accept it
+	query := `
+		SELECT ` + invitationColumns + `
+		FROM invitations
+		WHERE hash = $1 AND accepted_at IS NULL AND expiry > $2
+		FOR UPDATE`
+
+	invitation, err := scanInvitation(tx.QueryRowContext(ctx, query, hash[:], time.Now()))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	user.Email = invitation.Email
+	user.Activated = true
+
+	err = insertUser(ctx, tx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO users_roles
+		SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+		ON CONFLICT DO NOTHING`, user.ID, pq.Array(invitation.Roles))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO users_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING`, user.ID, pq.Array(invitation.Permissions))
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE invitations
+		SET accepted_at = NOW(), user_id = $2
+		WHERE id = $1
+		RETURNING accepted_at, user_id`, invitation.ID, user.ID).Scan(&invitation.AcceptedAt, &invitation.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return invitation, nil
+}
+
+// delete up to limit invitations that expired without being accepted,
+// accepted ones are kept as a record of who invited whom
+func (m InvitationModel) DeleteExpired(limit int) (int64, error) {
+	query := `
+		DELETE FROM invitations
+		WHERE id IN (SELECT id FROM invitations WHERE accepted_at IS NULL AND expiry < $1 LIMIT $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now(), limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
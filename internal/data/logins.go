@@ -0,0 +1,177 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// failed password logins for a user, used to slow down and lock out guessing
+type LoginLockout struct {
+	UserID         int64
+	FailedAttempts int        // failures since the last successful login or lockout
+	NextAttemptAt  time.Time  // logins are refused before this time
+	LockedUntil    *time.Time // set while the account is locked out
+}
+
+// check whether logins are refused at the given time
+func (l *LoginLockout) Locked(now time.Time) bool {
+	return l.LockedUntil != nil && now.Before(*l.LockedUntil)
+}
+
+// connection pool wrapper
+type LoginModel struct {
+	DB *sql.DB
+}
+
+// get a user's failed logins, ErrRecordNotFound means there haven't been any
+func (m LoginModel) GetLockout(userID int64) (*LoginLockout, error) {
+	query := `
+		SELECT user_id, failed_attempts, next_attempt_at, locked_until
+		FROM login_lockouts
+		WHERE user_id = $1`
+
+	var lockout LoginLockout
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&lockout.UserID,
+		&lockout.FailedAttempts,
+		&lockout.NextAttemptAt,
+		&lockout.LockedUntil,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &lockout, nil
+}
+
+// count a failed login, returning the number of failures since the last successful login or lockout
+func (m LoginModel) RecordFailure(userID int64) (int, error) {
+	query := `
+		INSERT INTO login_lockouts (user_id, failed_attempts)
+		VALUES ($1, 1)
+		ON CONFLICT (user_id) DO UPDATE
+		SET failed_attempts = login_lockouts.failed_attempts + 1
+		RETURNING failed_attempts`
+
+	var attempts int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&attempts)
+	return attempts, err
+}
+
+// refuse logins until the given time
+func (m LoginModel) Delay(userID int64, until time.Time) error {
+	query := `
+		UPDATE login_lockouts
+		SET next_attempt_at = $2
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, until)
+	return err
+}
+
+// lock the account until the given time, the failure count starts again afterwards.
+// it returns false if the account was already locked at now, so concurrent failures only lock it once
+func (m LoginModel) Lock(userID int64, now, until time.Time) (bool, error) {
+	query := `
+		UPDATE login_lockouts
+		SET failed_attempts = 0, next_attempt_at = $3, locked_until = $3
+		WHERE user_id = $1 AND (locked_until IS NULL OR locked_until <= $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, now, until)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// forget a user's failed logins, after a successful login, a password reset or when an admin unlocks them
+func (m LoginModel) Reset(userID int64) error {
+	query := `
+		DELETE FROM login_lockouts
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// count a failed login from an ip, this includes logins for emails that don't exist.
+// failures from the ip that are older than the window are dropped at the same time
+func (m LoginModel) RecordIPFailure(ip string, window time.Duration) error {
+	query := `
+		WITH expired AS (
+			DELETE FROM login_failures
+			WHERE ip = $1 AND created_at < $2
+		)
+		INSERT INTO login_failures (ip)
+		VALUES ($1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, ip, time.Now().Add(-window))
+	return err
+}
+
+// count the failed logins from an ip within the window
+func (m LoginModel) CountIPFailures(ip string, window time.Duration) (int, error) {
+	query := `
+		SELECT count(*)
+		FROM login_failures
+		WHERE ip = $1 AND created_at >= $2`
+
+	var failures int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, ip, time.Now().Add(-window)).Scan(&failures)
+	return failures, err
+}
+
+// delete up to limit failed logins recorded before the given time,
+// once they're older than the ip window they're no longer counted
+func (m LoginModel) DeleteFailuresBefore(before time.Time, limit int) (int64, error) {
+	query := `
+		DELETE FROM login_failures
+		WHERE id IN (SELECT id FROM login_failures WHERE created_at < $1 LIMIT $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, before, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
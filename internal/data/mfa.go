@@ -0,0 +1,292 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// number of recovery codes generated when two-factor authentication is enabled
+const RecoveryCodeCount = 10
+
+// a user's totp enrolment, it only protects the account once it's enabled
+type TOTP struct {
+	UserID         int64
+	CreatedAt      time.Time
+	Secret         string // encrypted at rest, see totp.EncryptSecret
+	Enabled        bool
+	LastStep       int64 // the last time step a code was accepted for, older steps are rejected
+	FailedAttempts int
+}
+
+// generate recovery codes in the format "abcde-fghij"
+func GenerateRecoveryCodes() []string {
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		text := strings.ToLower(rand.Text()[:10])
+		codes[i] = text[:5] + "-" + text[5:]
+	}
+
+	return codes
+}
+
+// recovery codes are compared without case or the dash
+func hashRecoveryCode(code string) []byte {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(normalized))
+	return hash[:]
+}
+
+// connection pool wrapper
+type MFAModel struct {
+	DB *sql.DB
+}
+
+// get a user's totp enrolment
+func (m MFAModel) GetTOTP(userID int64) (*TOTP, error) {
+	query := `
+		SELECT user_id, created_at, secret, enabled, last_step, failed_attempts
+		FROM user_totp
+		WHERE user_id = $1`
+
+	var totp TOTP
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&totp.UserID,
+		&totp.CreatedAt,
+		&totp.Secret,
+		&totp.Enabled,
+		&totp.LastStep,
+		&totp.FailedAttempts,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &totp, nil
+}
+
+// check whether any user has totp enabled
+func (m MFAModel) AnyTOTPEnabled() (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM user_totp WHERE enabled)`
+
+	var exists bool
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&exists)
+	return exists, err
+}
+
+// start a new enrolment, replacing any enrolment that wasn't confirmed.
+// ErrEditConflict is returned if totp is already enabled
+func (m MFAModel) StartTOTP(userID int64, secret string) error {
+	query := `
+		INSERT INTO user_totp (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, created_at = NOW(), last_step = 0, failed_attempts = 0
+		WHERE NOT user_totp.enabled`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// enable totp after the first code was confirmed, replacing any recovery codes with new ones
+func (m MFAModel) EnableTOTP(userID, step int64, recoveryCodes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE user_totp
+		SET enabled = true, last_step = $2, failed_attempts = 0
+		WHERE user_id = $1 AND NOT enabled`, userID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (user_id, hash) VALUES ($1, $2)`, userID, hashRecoveryCode(code))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// record a code was accepted for a step.
+// ErrRecordNotFound is returned if a code for this step or a later one was already used,
+// so a code can't be replayed
+func (m MFAModel) UseTOTPStep(userID, step int64) error {
+	query := `
+		UPDATE user_totp
+		SET last_step = $2, failed_attempts = 0
+		WHERE user_id = $1 AND last_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// count a wrong code, returning the number of failures since the last accepted code
+func (m MFAModel) RecordFailedAttempt(userID int64) (int, error) {
+	query := `
+		UPDATE user_totp
+		SET failed_attempts = failed_attempts + 1
+		WHERE user_id = $1
+		RETURNING failed_attempts`
+
+	var attempts int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&attempts)
+	return attempts, err
+}
+
+// reset the failed attempts counter
+func (m MFAModel) ResetFailedAttempts(userID int64) error {
+	query := `
+		UPDATE user_totp
+		SET failed_attempts = 0
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// mark a recovery code as used, ErrRecordNotFound is returned if it doesn't match an unused code
+func (m MFAModel) UseRecoveryCode(userID int64, code string) error {
+	query := `
+		UPDATE recovery_codes
+		SET used_at = NOW()
+		WHERE user_id = $1 AND hash = $2 AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// count the unused recovery codes a user has left
+func (m MFAModel) CountRecoveryCodes(userID int64) (int, error) {
+	query := `
+		SELECT count(*)
+		FROM recovery_codes
+		WHERE user_id = $1 AND used_at IS NULL`
+
+	var count int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&count)
+	return count, err
+}
+
+// turn off two-factor authentication, removing the secret and recovery codes
+func (m MFAModel) DeleteTOTP(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
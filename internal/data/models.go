@@ -3,6 +3,8 @@ package data
 import (
 	"database/sql"
 	"errors"
+
+	passwords "github.com/Bekian/greenlight/internal/password"
 )
 
 var (
@@ -13,18 +15,38 @@ var (
 
 // model wrapper for easy autocomplete access
 type Models struct {
+	APIKeys     APIKeyModel
+	Audit       AuditModel
+	Identities  IdentityModel
+	Invitations InvitationModel
+	Logins      LoginModel
 	Movies      MovieModel
+	MovieEvents MovieEventModel
+	MFA         MFAModel
 	Permissions PermissionsModel
+	Roles       RoleModel
 	Tokens      TokenModel
 	Users       UserModel
+	Webhooks    WebhookModel
+	Deliveries  WebhookDeliveryModel
 }
 
-// constructor
+// constructor, passwords are hashed with the default settings until main sets Users.Hasher from the config
 func NewModels(db *sql.DB) Models {
 	return Models{
+		APIKeys:     APIKeyModel{DB: db},
+		Audit:       AuditModel{DB: db},
+		Identities:  IdentityModel{DB: db},
+		Invitations: InvitationModel{DB: db},
+		Logins:      LoginModel{DB: db},
 		Movies:      MovieModel{DB: db},
+		MovieEvents: MovieEventModel{DB: db},
+		MFA:         MFAModel{DB: db},
 		Permissions: PermissionsModel{DB: db},
+		Roles:       RoleModel{DB: db},
 		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
+		Users:       UserModel{DB: db, Hasher: passwords.DefaultHasher()},
+		Webhooks:    WebhookModel{DB: db},
+		Deliveries:  WebhookDeliveryModel{DB: db},
 	}
 }
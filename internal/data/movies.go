@@ -22,6 +22,8 @@ type Movie struct {
 	Runtime   Runtime   `json:"runtime,omitzero"` // Add the omitzero directive
 	Genres    []string  `json:"genres,omitzero"`  // Add the omitzero directive
 	Version   int32     `json:"version"`
+	// the user who added the movie, nil if it predates this or their account was deleted
+	CreatedBy *int64 `json:"created_by"`
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
@@ -50,12 +52,12 @@ type MovieModel struct {
 func (m MovieModel) Insert(movie *Movie) error {
 	// insert statement (with weird string syntax)
 	query := `
-		INSERT INTO movies (title, year, runtime, genres)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO movies (title, year, runtime, genres, created_by)
+		VALUES ($1, $2, $3, $4, $5)
 		RETURNING id, created_at, version
 	`
 	// slice of placeholder params
-	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.CreatedBy}
 
 	// create a context with a 3 second timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -74,7 +76,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 
 	// query for retrieving the movie data
 	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
+		SELECT id, created_at, title, year, runtime, genres, version, created_by
 		FROM movies
 		WHERE id = $1
 	`
@@ -95,6 +97,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
 		&movie.Version,
+		&movie.CreatedBy,
 	)
 
 	// handle errors
@@ -120,7 +123,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	// the last condition prevents cases where movies have a same column value,
 	// e.g. both movies have the same year of 1999
 	query := fmt.Sprintf(`
-        SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+        SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version, created_by
         FROM movies
 	WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
 	AND (genres @> $2 or $2 = '{}')
@@ -162,6 +165,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&movie.CreatedBy,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -182,6 +186,52 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	return movies, metadata, nil
 }
 
+// get every movie a user added, used for their data export
+func (m MovieModel) GetAllCreatedBy(userID int64) ([]*Movie, error) {
+	query := `
+		SELECT id, created_at, title, year, runtime, genres, version, created_by
+		FROM movies
+		WHERE created_by = $1
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.CreatedBy,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
+
 // method for updating a record
 func (m MovieModel) Update(movie *Movie) error {
 	// set update query
@@ -3,18 +3,73 @@ package data
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"slices"
+	"strings"
 	"time"
 
+	"github.com/Bekian/greenlight/internal/validator"
+
 	"github.com/lib/pq"
 )
 
+// notification channel for changes to who has which perms, see migration 000021.
+// the payload is the user id, or PermissionChangesAll when a role or perm changed
+const PermissionChangesChannel = "permission_changes"
+
+const PermissionChangesAll = "*"
+
 // this holds all the perms for a user
 type Permissions []string
 
-// check if the user contains a specific perm by the perm's code
+// check if the user contains a specific perm by the perm's code.
+// "movies:*" includes every code starting with "movies:", and "*" includes everything
 func (p Permissions) Include(code string) bool {
-	return slices.Contains(p, code)
+	return slices.ContainsFunc(p, func(granted string) bool {
+		return matchPermission(granted, code)
+	})
+}
+
+// the perms included by both sets, used to limit an api key to what its user still has.
+// a wildcard on one side is narrowed down to the codes it matches on the other
+func (p Permissions) Intersect(other Permissions) Permissions {
+	both := Permissions{}
+
+	for _, code := range p {
+		if other.Include(code) {
+			if !both.Include(code) {
+				both = append(both, code)
+			}
+			continue
+		}
+		for _, otherCode := range other {
+			if matchPermission(code, otherCode) && !both.Include(otherCode) {
+				both = append(both, otherCode)
+			}
+		}
+	}
+
+	return both
+}
+
+// check every code is included in the perms of whoever is handing them out,
+// so nobody can give an api key, a user or an invitation more than they have themselves
+func ValidateGrantable(v *validator.Validator, key string, codes []string, granterPermissions Permissions) {
+	for _, code := range codes {
+		v.Check(granterPermissions.Include(code), key, fmt.Sprintf("you don't have the %q permission", code))
+	}
+}
+
+func matchPermission(granted, code string) bool {
+	switch {
+	case granted == code, granted == "*":
+		return true
+	case strings.HasSuffix(granted, ":*"):
+		return strings.HasPrefix(code, strings.TrimSuffix(granted, "*"))
+	default:
+		return false
+	}
 }
 
 // define model type
@@ -26,12 +81,18 @@ type PermissionsModel struct {
 // BEK Note: 16.3 again here i think this naming pattern is a bit odd, like why not GetAllPerms or GetUserPerms
 func (m PermissionsModel) GetAllForUser(userID int64) (Permissions, error) {
 	// pasted for correctness
+	// the codes granted directly and through the user's roles
 	query := `
         SELECT permissions.code
         FROM permissions
         INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-        INNER JOIN users ON users_permissions.user_id = users.id
-        WHERE users.id = $1`
+        WHERE users_permissions.user_id = $1
+        UNION
+        SELECT permissions.code
+        FROM permissions
+        INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+        INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+        WHERE users_roles.user_id = $1`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -64,12 +125,92 @@ func (m PermissionsModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
-// add provided perm codes for a user
+// get only the perm codes granted to a user directly, not through a role
+func (m PermissionsModel) GetDirectForUser(userID int64) (Permissions, error) {
+	query := `
+        SELECT permissions.code
+        FROM permissions
+        INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+        WHERE users_permissions.user_id = $1
+        ORDER BY permissions.code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// check a perm code exists, returning ErrRecordNotFound if it doesn't
+func (m PermissionsModel) Exists(code string) error {
+	query := `
+        SELECT id
+        FROM permissions
+        WHERE code = $1
+        LIMIT 1`
+
+	var id int64
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, code).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// add provided perm codes for a user, codes they already have are skipped
 func (m PermissionsModel) AddForUser(userID int64, codes ...string) error {
 	// pasted for safety
 	query := `
         INSERT INTO users_permissions
-        SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+        SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+        ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
+
+// take perm codes granted directly away from a user, grants through a role are left alone
+func (m PermissionsModel) RemoveForUser(userID int64, codes ...string) error {
+	query := `
+        DELETE FROM users_permissions
+        USING permissions
+        WHERE users_permissions.permission_id = permissions.id
+        AND users_permissions.user_id = $1 AND permissions.code = ANY($2)`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
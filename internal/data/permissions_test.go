@@ -0,0 +1,103 @@
+package data
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/Bekian/greenlight/internal/validator"
+)
+
+func TestMatchPermission(t *testing.T) {
+	tests := []struct {
+		granted, code string
+		want          bool
+	}{
+		{"movies:read", "movies:read", true},
+		{"movies:read", "movies:write", false},
+		{"movies:*", "movies:read", true},
+		{"movies:*", "movies:write:own", true},
+		{"movies:*", "movies:*", true},
+		{"movies:*", "users:read", false},
+		// a prefix has to end at a colon
+		{"movies:*", "moviesx:read", false},
+		{"movies:*", "movies", false},
+		{"movies:write:*", "movies:write:own", true},
+		{"movies:write:*", "movies:read", false},
+		{"movies:write:own", "movies:write", false},
+		{"movies:write", "movies:write:own", false},
+		{"movies:write:own", "movies:*", false},
+		{"*", "movies:write:own", true},
+		{"*", "*", true},
+		{"movies:read", "*", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchPermission(tt.granted, tt.code); got != tt.want {
+			t.Errorf("matchPermission(%q, %q) = %v, want %v", tt.granted, tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestPermissionsIntersect(t *testing.T) {
+	tests := []struct {
+		name string
+		p    Permissions
+		o    Permissions
+		want Permissions
+	}{
+		{"same codes", Permissions{"movies:read"}, Permissions{"movies:read"}, Permissions{"movies:read"}},
+		{"no overlap", Permissions{"movies:read"}, Permissions{"users:read"}, Permissions{}},
+		{"empty", Permissions{"movies:read"}, nil, Permissions{}},
+		{"wildcard on the other side keeps the code", Permissions{"movies:write:own"}, Permissions{"movies:*"}, Permissions{"movies:write:own"}},
+		{"wildcard on this side narrows to the other", Permissions{"movies:*"}, Permissions{"movies:write:own", "users:read"}, Permissions{"movies:write:own"}},
+		{"star narrows to the other", Permissions{"*"}, Permissions{"movies:read", "users:read"}, Permissions{"movies:read", "users:read"}},
+		{"star on the other side keeps everything", Permissions{"movies:*", "users:read"}, Permissions{"*"}, Permissions{"movies:*", "users:read"}},
+		{"narrower wildcard", Permissions{"movies:*"}, Permissions{"movies:write:*"}, Permissions{"movies:write:*"}},
+		{"specific code isn't widened", Permissions{"movies:write:own"}, Permissions{"movies:write"}, Permissions{}},
+		{"no duplicates", Permissions{"movies:*", "movies:read"}, Permissions{"movies:read"}, Permissions{"movies:read"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.p.Intersect(tt.o)
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+
+			// whatever is left is included by both sides
+			for _, code := range got {
+				if !tt.p.Include(code) || !tt.o.Include(code) {
+					t.Errorf("%q isn't included by both %q and %q", code, tt.p, tt.o)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateGrantable(t *testing.T) {
+	admin := Permissions{"movies:*", "users:admin"}
+
+	tests := []struct {
+		name  string
+		codes []string
+		want  bool
+	}{
+		{"nothing", nil, true},
+		{"own code", []string{"users:admin"}, true},
+		{"covered by a wildcard", []string{"movies:write:own", "movies:read"}, true},
+		{"the wildcard itself", []string{"movies:*"}, true},
+		{"everything", []string{"*"}, false},
+		{"code they don't have", []string{"audit:read"}, false},
+		{"one of several", []string{"movies:read", "webhooks:admin"}, false},
+	}
+
+	for _, tt := range tests {
+		v := validator.New()
+		ValidateGrantable(v, "permissions", tt.codes, admin)
+
+		if v.Valid() != tt.want {
+			t.Errorf("%s: got valid %v, want %v", tt.name, v.Valid(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// a named bundle of perm codes, users get every code of every role they hold
+type Role struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Permissions Permissions `json:"permissions"`
+}
+
+// connection pool wrapper
+type RoleModel struct {
+	DB *sql.DB
+}
+
+// get all roles along with their perm codes
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `
+		SELECT roles.id, roles.name, roles.description,
+			COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+		FROM roles
+		LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+		LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+		GROUP BY roles.id
+		ORDER BY roles.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		var role Role
+
+		err := rows.Scan(&role.ID, &role.Name, &role.Description, pq.Array(&role.Permissions))
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, &role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// check a role exists, returning ErrRecordNotFound if it doesn't
+func (m RoleModel) Exists(name string) error {
+	query := `
+		SELECT id
+		FROM roles
+		WHERE name = $1`
+
+	var id int64
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, name).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// get the perm codes of a role, returning ErrRecordNotFound if it doesn't exist
+func (m RoleModel) GetPermissions(name string) (Permissions, error) {
+	query := `
+		SELECT COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+		FROM roles
+		LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+		LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+		WHERE roles.name = $1
+		GROUP BY roles.id`
+
+	var permissions Permissions
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, name).Scan(pq.Array(&permissions))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return permissions, nil
+}
+
+// get the names of the roles a user holds
+func (m RoleModel) GetAllForUser(userID int64) ([]string, error) {
+	query := `
+		SELECT roles.name
+		FROM roles
+		INNER JOIN users_roles ON users_roles.role_id = roles.id
+		WHERE users_roles.user_id = $1
+		ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+
+	for rows.Next() {
+		var name string
+
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// give a user roles by name, roles they already hold are skipped
+func (m RoleModel) AddForUser(userID int64, names ...string) error {
+	query := `
+		INSERT INTO users_roles
+		SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	return err
+}
+
+// take roles away from a user by name
+func (m RoleModel) RemoveForUser(userID int64, names ...string) error {
+	query := `
+		DELETE FROM users_roles
+		USING roles
+		WHERE users_roles.role_id = roles.id
+		AND users_roles.user_id = $1 AND roles.name = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	return err
+}
@@ -5,7 +5,13 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Bekian/greenlight/internal/validator"
 )
@@ -15,6 +21,18 @@ const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
 	ScopePasswordReset  = "password-reset"
+	ScopeEmailChange    = "email-change"
+	ScopeRefresh        = "refresh"
+	ScopeMFA            = "mfa"   // proves the password was correct while the second factor is checked
+	ScopeLogin          = "login" // passwordless login, emailed as a link token and a one-time code
+)
+
+// notification channel for revoked stateless tokens, see migration 000013
+const TokenRevocationsChannel = "token_revocations"
+
+var (
+	// a refresh token was presented after it had already been exchanged
+	ErrTokenReused = errors.New("token reused")
 )
 
 // data relating to an individual token
@@ -24,6 +42,17 @@ type Token struct {
 	UserId    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	// non-secret id, this is how sessions are referred to
+	ID        int64     `json:"-"`
+	CreatedAt time.Time `json:"-"`
+	// where an authentication token was issued from
+	IP        string `json:"-"`
+	UserAgent string `json:"-"`
+	// tokens issued from the same login share a family, a refresh rotates within it.
+	// this is empty for tokens that don't belong to a session
+	Family string `json:"-"`
+	// the plaintext is a self contained jwt that's verified without reading this table
+	Stateless bool `json:"-"`
 }
 
 // DIFF Note: slightly different casing for userID
@@ -50,6 +79,47 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
 }
 
+// one-time login codes are 6 digits, see NewLoginCode
+var LoginCodeRX = regexp.MustCompile(`^[0-9]{6}$`)
+
+func ValidateLoginCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(validator.Matches(code, LoginCodeRX), "code", "must be 6 digits")
+}
+
+// longest user agent stored with a session, anything longer is cut off
+const maxUserAgentLength = 512
+
+// how often the last use of a session or api key is recorded, so every request doesn't cause a write
+const TouchInterval = time.Minute
+
+// make a user agent safe to store, cutting it to maxUserAgentLength bytes without splitting a character.
+// headers aren't guaranteed to be utf-8 and postgres rejects invalid text, so bad bytes are replaced
+func truncateUserAgent(userAgent string) string {
+	userAgent = strings.ToValidUTF8(userAgent, "\uFFFD")
+	if len(userAgent) <= maxUserAgentLength {
+		return userAgent
+	}
+
+	cut := maxUserAgentLength
+	for cut > 0 && !utf8.RuneStart(userAgent[cut]) {
+		cut--
+	}
+
+	return userAgent[:cut]
+}
+
+// an authentication token as seen by the user it belongs to, the hash is never exposed
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	Expiry     time.Time  `json:"expiry"`
+	Current    bool       `json:"current"` // true for the token used to make the request
+}
+
 type TokenModel struct {
 	DB *sql.DB
 }
@@ -62,18 +132,223 @@ func (m TokenModel) New(userId int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// start a new token family, all tokens from one login share it
+func NewTokenFamily() string {
+	return rand.Text()
+}
+
+// generate and insert an authentication or refresh token for a session,
+// recording where it was issued from
+func (m TokenModel) NewSession(userId int64, ttl time.Duration, scope, family, ip, userAgent string) (*Token, error) {
+	token := generateToken(userId, ttl, scope)
+	token.Family = family
+	token.IP = ip
+	token.UserAgent = truncateUserAgent(userAgent)
+
+	err := m.Insert(token)
+	return token, err
+}
+
+// insert a stateless authentication token that was generated elsewhere, so it can be listed and revoked.
+// deleting the row records a revocation, see GetRevocations
+func (m TokenModel) NewStatelessSession(plaintext string, userId int64, expiry time.Time, family, ip, userAgent string) (*Token, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	token := &Token{
+		Plaintext: plaintext,
+		Hash:      hash[:],
+		UserId:    userId,
+		Expiry:    expiry,
+		Scope:     ScopeAuthentication,
+		IP:        ip,
+		UserAgent: truncateUserAgent(userAgent),
+		Family:    family,
+		Stateless: true,
+	}
+
+	err := m.Insert(token)
+	return token, err
+}
+
 // insert token record into tokens table
 func (m TokenModel) Insert(token *Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)`
+		INSERT INTO tokens (hash, user_id, expiry, scope, ip, user_agent, family, stateless)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8)
+		RETURNING id, created_at`
+
+	args := []any{token.Hash, token.UserId, token.Expiry, token.Scope, token.IP, token.UserAgent, token.Family, token.Stateless}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&token.ID, &token.CreatedAt)
+}
+
+// record that a token was used.
+// callers should skip this when the last use is within TouchInterval, see NeedsTouch,
+// and it does nothing if another request recorded it in the meantime
+func (m TokenModel) Touch(tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		UPDATE tokens
+		SET last_used_at = NOW()
+		WHERE hash = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - make_interval(secs => $2))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], TouchInterval.Seconds())
+	return err
+}
+
+// whether a session or api key last used at lastUsedAt should be touched again
+func NeedsTouch(lastUsedAt *time.Time, now time.Time) bool {
+	return lastUsedAt == nil || now.Sub(*lastUsedAt) >= TouchInterval
+}
+
+// delete a token along with the rest of its family, this ends the whole session
+func (m TokenModel) DeleteSession(scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $2
+		OR family = (SELECT family FROM tokens WHERE scope = $1 AND hash = $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, scope, tokenHash[:])
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// delete every token in a family
+func (m TokenModel) DeleteFamily(family string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE family = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, family)
+	return err
+}
+
+// exchange a refresh token, marking it as used so it can only be exchanged once.
+// ErrTokenReused is returned, along with the token so its family can be revoked,
+// when the token was already used, this includes losing a race with a concurrent exchange
+func (m TokenModel) UseRefresh(tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	// the row is locked while the old used_at is read, so a concurrent exchange
+	// waits for this one and then sees the token as used
+	query := `
+		WITH old AS (
+			SELECT used_at FROM tokens
+			WHERE hash = $1 AND scope = $2 AND expiry > $3
+			FOR UPDATE
+		)
+		UPDATE tokens
+		SET used_at = COALESCE(tokens.used_at, NOW())
+		FROM old
+		WHERE tokens.hash = $1
+		RETURNING tokens.id, tokens.created_at, tokens.user_id, tokens.expiry, COALESCE(tokens.family, ''), old.used_at IS NOT NULL`
+
+	token := Token{
+		Plaintext: tokenPlaintext,
+		Hash:      tokenHash[:],
+		Scope:     ScopeRefresh,
+	}
+	var reused bool
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh, time.Now()).Scan(
+		&token.ID,
+		&token.CreatedAt,
+		&token.UserId,
+		&token.Expiry,
+		&token.Family,
+		&reused,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if reused {
+		return &token, ErrTokenReused
+	}
+
+	return &token, nil
+}
+
+// delete one of a user's authentication tokens by its id, along with the rest of its family
+func (m TokenModel) DeleteSessionForUser(userId, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $2
+		AND (id = $3 AND scope = $1 OR family = (SELECT family FROM tokens WHERE scope = $1 AND user_id = $2 AND id = $3))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, ScopeAuthentication, userId, id)
+	if err != nil {
+		return err
+	}
 
-	args := []any{token.Hash, token.UserId, token.Expiry, token.Scope}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// delete all tokens for a specific user and scope, except the provided token and its family.
+// this is used to sign out every other session
+func (m TokenModel) DeleteAllForUserExcept(scope string, userId int64, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND hash != $3
+		AND family IS DISTINCT FROM (SELECT family FROM tokens WHERE hash = $3)`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	_, err := m.DB.ExecContext(ctx, query, scope, userId, tokenHash[:])
 	return err
 }
 
@@ -90,3 +365,210 @@ func (m TokenModel) DeleteAllForUser(scope string, userId int64) error {
 	return err
 
 }
+
+// get the unexpired authentication tokens for a user, newest first.
+// the session for currentPlaintext is marked as current
+func (m TokenModel) GetSessionsForUser(userId int64, currentPlaintext string) ([]*Session, error) {
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+
+	query := `
+		SELECT id, created_at, last_used_at, ip, user_agent, expiry, hash = $4
+		FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND expiry > $3
+		ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, ScopeAuthentication, userId, time.Now(), currentHash[:])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.IP,
+			&session.UserAgent,
+			&session.Expiry,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// a revoked stateless token, this only needs to be kept until the token expires
+type Revocation struct {
+	Hash   [sha256.Size]byte
+	Expiry time.Time
+}
+
+// get the revocations of stateless tokens that haven't expired yet
+func (m TokenModel) GetRevocations() ([]*Revocation, error) {
+	query := `
+		SELECT hash, expiry
+		FROM token_revocations
+		WHERE expiry > $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revocations := []*Revocation{}
+
+	for rows.Next() {
+		var revocation Revocation
+		var hash []byte
+
+		err := rows.Scan(&hash, &revocation.Expiry)
+		if err != nil {
+			return nil, err
+		}
+
+		copy(revocation.Hash[:], hash)
+		revocations = append(revocations, &revocation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revocations, nil
+}
+
+// delete up to limit tokens that have expired, returning how many were deleted
+func (m TokenModel) DeleteExpired(limit int) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE hash IN (SELECT hash FROM tokens WHERE expiry < NOW() LIMIT $1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// delete up to limit revocations of tokens that have expired, they'd be rejected anyway
+func (m TokenModel) DeleteExpiredRevocations(limit int) (int64, error) {
+	query := `
+		DELETE FROM token_revocations
+		WHERE hash IN (SELECT hash FROM token_revocations WHERE expiry < NOW() LIMIT $1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// issue a 6 digit one-time login code. codes are only unique per user,
+// so the stored hash covers the user id as well as the code
+func (m TokenModel) NewLoginCode(userId int64, ttl time.Duration) (*Token, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return nil, err
+	}
+
+	code := fmt.Sprintf("%06d", n)
+	hash := loginCodeHash(userId, code)
+
+	token := &Token{
+		Plaintext: code,
+		Hash:      hash[:],
+		UserId:    userId,
+		Expiry:    time.Now().Add(ttl),
+		Scope:     ScopeLogin,
+	}
+
+	err = m.Insert(token)
+	return token, err
+}
+
+func loginCodeHash(userId int64, code string) [sha256.Size]byte {
+	return sha256.Sum256(fmt.Appendf(nil, "%d:%s", userId, code))
+}
+
+// use a login link token, returning the id of the user it was issued to
+func (m TokenModel) UseLoginToken(tokenPlaintext string) (int64, error) {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return m.useLogin(hash[:])
+}
+
+// use a user's one-time login code, returning ErrRecordNotFound if it's wrong or expired
+func (m TokenModel) UseLoginCode(userId int64, code string) error {
+	hash := loginCodeHash(userId, code)
+	_, err := m.useLogin(hash[:])
+	return err
+}
+
+// delete every login token the user of the given one has, if it's still valid.
+// the link and code are sent together, so using either uses up both,
+// and a token raced by two requests is only accepted by one of them
+func (m TokenModel) useLogin(hash []byte) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = (
+			SELECT user_id FROM tokens
+			WHERE hash = $2 AND scope = $1 AND expiry > $3
+		)
+		RETURNING user_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, ScopeLogin, hash, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var userId int64
+
+	for rows.Next() {
+		err := rows.Scan(&userId)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if userId == 0 {
+		return 0, ErrRecordNotFound
+	}
+
+	return userId, nil
+}
@@ -0,0 +1,83 @@
+package data
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Bekian/greenlight/internal/validator"
+)
+
+func TestTruncateUserAgent(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		want      string
+	}{
+		{"short", "curl/8.5.0", "curl/8.5.0"},
+		{"exactly the limit", strings.Repeat("a", maxUserAgentLength), strings.Repeat("a", maxUserAgentLength)},
+		{"over the limit", strings.Repeat("a", maxUserAgentLength+10), strings.Repeat("a", maxUserAgentLength)},
+		// "é" is 2 bytes, cutting at 512 would split the last one in half
+		{"multi-byte at the limit", "a" + strings.Repeat("é", maxUserAgentLength/2), "a" + strings.Repeat("é", maxUserAgentLength/2-1)},
+		{"invalid utf-8", "agent\xff\xfe/1.0", "agent�/1.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateUserAgent(tt.userAgent)
+
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("got invalid utf-8 %q", got)
+			}
+			if len(got) > maxUserAgentLength {
+				t.Errorf("got %d bytes, want at most %d", len(got), maxUserAgentLength)
+			}
+		})
+	}
+}
+
+func TestNeedsTouch(t *testing.T) {
+	now := time.Now()
+	recent := now.Add(-TouchInterval / 2)
+	old := now.Add(-TouchInterval)
+
+	if !NeedsTouch(nil, now) {
+		t.Error("a token that was never used should be touched")
+	}
+	if NeedsTouch(&recent, now) {
+		t.Error("a token used within the interval shouldn't be touched")
+	}
+	if !NeedsTouch(&old, now) {
+		t.Error("a token last used an interval ago should be touched")
+	}
+}
+
+func TestValidateLoginCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"012345", true},
+		{"", false},
+		{"12345", false},
+		{"1234567", false},
+		{"12345a", false},
+		{" 12345", false},
+		{"-12345", false},
+		{"１２３４５６", false}, // full-width digits
+		{"123\n456", false},
+	}
+
+	for _, tt := range tests {
+		v := validator.New()
+		ValidateLoginCode(v, tt.code)
+
+		if v.Valid() != tt.want {
+			t.Errorf("ValidateLoginCode(%q): got valid %v, want %v", tt.code, v.Valid(), tt.want)
+		}
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
+	// aliased, password is the type holding a user's password below
+	passwords "github.com/Bekian/greenlight/internal/password"
 	"github.com/Bekian/greenlight/internal/validator"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/lib/pq"
 )
 
 var (
@@ -26,7 +29,11 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	Version   int       `json:"version"`
+	// address waiting to be confirmed by an email change, see ConfirmPendingEmail
+	PendingEmail *string `json:"-"`
+	// set when the user asked for their account to be deleted, it's purged after this time
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
 }
 
 // check if user is anonymous
@@ -34,43 +41,59 @@ func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
-// UserModel connection wrapper
+// UserModel connection wrapper, the hasher hashes new passwords and checks existing ones
 type UserModel struct {
-	DB *sql.DB
+	DB     *sql.DB
+	Hasher *passwords.Hasher
 }
 
 // no notes
 type password struct {
 	plaintext *string
 	hash      []byte
+	outdated  bool // the hash was made with an old algorithm or parameters, see NeedsRehash
 }
 
 // calculate password hash and store both in the struct
-func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+func (p *password) set(hasher *passwords.Hasher, plaintextPassword string) error {
+	hash, err := hasher.Hash(plaintextPassword)
 	if err != nil {
 		return err
 	}
 
 	p.plaintext = &plaintextPassword
 	p.hash = hash
+	p.outdated = false
 
 	return nil
 }
 
 // check if provided plaintext password matches the hashed password.
-func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
+func (p *password) matches(hasher *passwords.Hasher, plaintextPassword string) (bool, error) {
+	match, rehash, err := hasher.Verify(plaintextPassword, p.hash)
 	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
+		return false, err
 	}
 
-	return true, nil
+	p.outdated = match && rehash
+
+	return match, nil
+}
+
+// hash a new password for the user with the model's hasher
+func (m UserModel) SetPassword(user *User, plaintextPassword string) error {
+	return user.Password.set(m.Hasher, plaintextPassword)
+}
+
+// check a plaintext password against the user's hash, see NeedsRehash
+func (m UserModel) PasswordMatches(user *User, plaintextPassword string) (bool, error) {
+	return user.Password.matches(m.Hasher, plaintextPassword)
+}
+
+// NeedsRehash reports whether the password that last matched should be hashed again with SetPassword
+// because the hashing algorithm or its parameters changed since it was stored
+func (p *password) NeedsRehash() bool {
+	return p.outdated
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -79,13 +102,14 @@ func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
 }
 
-func ValidatePasswordPlaintext(v *validator.Validator, password string) {
+// maxLength is the longest password the hasher can take, see UserModel.Hasher
+func ValidatePasswordPlaintext(v *validator.Validator, password string, maxLength int) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.Check(len(password) <= maxLength, "password", fmt.Sprintf("must not be more than %d bytes long", maxLength))
 }
 
-func ValidateUser(v *validator.Validator, user *User) {
+func ValidateUser(v *validator.Validator, user *User, maxPasswordLength int) {
 	v.Check(user.Name != "", "name", "must be provided")
 	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
 
@@ -94,12 +118,25 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 	// validate the password if it exists
 	if user.Password.plaintext != nil {
-		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		ValidatePasswordPlaintext(v, *user.Password.plaintext, maxPasswordLength)
 	}
 }
 
 // create new user
 func (m UserModel) Insert(user *User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertUser(ctx, m.DB, user)
+}
+
+// anything a single row can be queried from, so a db or a transaction
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// insert a user with db, this is shared with InvitationModel.Accept which does it in a transaction
+func insertUser(ctx context.Context, db rowQuerier, user *User) error {
 	query := `
 	INSERT INTO users (name, email, password_hash, activated) 
         VALUES ($1, $2, $3, $4)
@@ -108,11 +145,8 @@ func (m UserModel) Insert(user *User) error {
 
 	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
 	// execute query, and return error if the specific one we're looking for is found
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := db.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -131,7 +165,7 @@ func (m UserModel) Insert(user *User) error {
 // get user by email, this should return one User or error
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-	SELECT id, created_at, name, email, password_hash, activated, version
+	SELECT id, created_at, name, email, password_hash, activated, version, pending_email, deletion_scheduled_at
 	FROM users
 	WHERE email = $1
 	`
@@ -149,6 +183,49 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.PendingEmail,
+		&user.DeletionScheduledAt,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// get user by id
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT id, created_at, name, email, password_hash, activated, version, pending_email, deletion_scheduled_at
+	FROM users
+	WHERE id = $1
+	`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.PendingEmail,
+		&user.DeletionScheduledAt,
 	)
 
 	if err != nil {
@@ -163,6 +240,59 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
+// get a page of users for the admin api.
+// search matches part of the name or email, activated filters on the account state when it isn't nil.
+// strpos is used rather than ILIKE so % and _ in the search aren't treated as wildcards
+func (m UserModel) GetAll(search string, activated *bool, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, name, email, activated, version, deletion_scheduled_at
+		FROM users
+		WHERE (strpos(lower(name), lower($1)) > 0 OR strpos(lower(email::text), lower($1)) > 0 OR $1 = '')
+		AND (activated = $2 OR $2 IS NULL)
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, search, activated, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.Version,
+			&user.DeletionScheduledAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
 // update details for a specific user
 // checks version number to prevent race condition
 // checks email to violate users_email_key constraint
@@ -201,13 +331,189 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
+// store the address the user wants to change to, it isn't used until it's confirmed
+func (m UserModel) SetPendingEmail(id int64, email string) error {
+	query := `
+		UPDATE users
+		SET pending_email = $1
+		WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, email, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// swap the pending email in as the user's email.
+// ErrRecordNotFound is returned when there's no pending change,
+// and ErrDuplicateEmail when the address was taken since the change was requested
+func (m UserModel) ConfirmPendingEmail(user *User) error {
+	query := `
+		UPDATE users
+		SET email = pending_email, pending_email = NULL, version = version + 1
+		WHERE id = $1 AND pending_email IS NOT NULL
+		RETURNING email, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user.ID).Scan(&user.Email, &user.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// schedule the user for deletion at user.DeletionScheduledAt, or cancel it when that's nil.
+// the version is checked like Update
+func (m UserModel) SetDeletionSchedule(user *User) error {
+	query := `
+		UPDATE users
+		SET deletion_scheduled_at = $1, version = version + 1
+		WHERE id = $2 AND version = $3
+		RETURNING version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user.DeletionScheduledAt, user.ID, user.Version).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// delete up to limit users whose grace period has passed, returning their ids
+func (m UserModel) PurgeScheduledDeletions(limit int) ([]int64, error) {
+	return m.deleteUsers(`
+		DELETE FROM users
+		WHERE id IN (
+			SELECT id FROM users
+			WHERE deletion_scheduled_at <= NOW()
+			LIMIT $1
+		)
+		RETURNING id`, limit)
+}
+
+// delete up to limit accounts that were never activated and were created before the given time,
+// returning their ids. accounts deactivated after being activated are kept, see migration 000022
+func (m UserModel) DeleteUnactivated(before time.Time, limit int) ([]int64, error) {
+	return m.deleteUsers(`
+		DELETE FROM users
+		WHERE id IN (
+			SELECT id FROM users
+			WHERE NOT activated AND activated_at IS NULL AND created_at < $1
+			LIMIT $2
+		)
+		RETURNING id`, before, limit)
+}
+
+// run a "DELETE FROM users ... RETURNING id" query, returning the deleted ids.
+//
+// anonymization policy, everything happens in one transaction:
+//   - tokens and permissions are removed by the ON DELETE CASCADE on their tables
+//   - queued and logged webhook deliveries for user.* events carry the user's name and email,
+//     so the ones about a deleted user are removed
+//   - anything else a user authored is kept with its reference to the user cleared,
+//     new tables referencing users should use ON DELETE SET NULL for this
+//   - the audit log is append-only, but events that mention the user lose their id,
+//     and the ip and user agent of requests they made, see migration 000025.
+//     event details are never changed, so the log never stores their email, only a hash of it
+func (m UserModel) deleteUsers(query string, args ...any) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		return ids, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM webhook_deliveries
+		WHERE event LIKE 'user.%' AND (payload->'data'->'user'->>'id')::bigint = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `SELECT anonymize_audit_events($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, tx.Commit()
+}
+
 // get the user by token
 func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+	user, _, err := m.getForToken(tokenScope, tokenPlaintext)
+	return user, err
+}
+
+// get the user for an authentication token, along with when the token was last used
+func (m UserModel) GetForSession(tokenPlaintext string) (*User, *time.Time, error) {
+	return m.getForToken(ScopeAuthentication, tokenPlaintext)
+}
+
+func (m UserModel) getForToken(tokenScope, tokenPlaintext string) (*User, *time.Time, error) {
 	// calculate the hash using the plaintext token
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
 	query := `
-        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version,
+            users.pending_email, users.deletion_scheduled_at, tokens.last_used_at
         FROM users
         INNER JOIN tokens
         ON users.id = tokens.user_id
@@ -219,7 +525,10 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	args := []any{tokenHash[:], tokenScope, time.Now()}
 
 	// struct to write the data to, if any is found
-	var user User
+	var (
+		user     User
+		lastUsed *time.Time
+	)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -233,15 +542,18 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.PendingEmail,
+		&user.DeletionScheduledAt,
+		&lastUsed,
 	)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return nil, ErrRecordNotFound
+			return nil, nil, ErrRecordNotFound
 		default:
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
-	return &user, nil
+	return &user, lastUsed, nil
 }
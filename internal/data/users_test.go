@@ -0,0 +1,67 @@
+package data
+
+import (
+	"strings"
+	"testing"
+
+	passwords "github.com/Bekian/greenlight/internal/password"
+	"github.com/Bekian/greenlight/internal/validator"
+)
+
+func TestUserModelPasswords(t *testing.T) {
+	bcrypt := UserModel{Hasher: &passwords.Hasher{Algorithm: passwords.Bcrypt, BcryptCost: 4}}
+	argon2id := UserModel{Hasher: passwords.DefaultHasher()}
+
+	user := &User{}
+
+	if err := bcrypt.SetPassword(user, "pa55word1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	match, err := bcrypt.PasswordMatches(user, "pa55word1234")
+	if err != nil || !match {
+		t.Fatalf("got match %v and error %v", match, err)
+	}
+	if user.Password.NeedsRehash() {
+		t.Error("a hash from the model's own hasher needs rehashing")
+	}
+
+	// a model configured for argon2id still checks the old bcrypt hash, then asks for a new one
+	match, err = argon2id.PasswordMatches(user, "pa55word1234")
+	if err != nil || !match {
+		t.Fatalf("got match %v and error %v", match, err)
+	}
+	if !user.Password.NeedsRehash() {
+		t.Error("a bcrypt hash doesn't need rehashing under argon2id")
+	}
+
+	match, err = argon2id.PasswordMatches(user, "wrong password")
+	if err != nil || match {
+		t.Errorf("got match %v and error %v for a wrong password", match, err)
+	}
+}
+
+func TestValidatePasswordPlaintext(t *testing.T) {
+	tests := []struct {
+		name      string
+		password  string
+		maxLength int
+		want      bool
+	}{
+		{"ok", "pa55word1234", 72, true},
+		{"empty", "", 72, false},
+		{"too short", "pa55", 72, false},
+		{"at the limit", strings.Repeat("a", 72), 72, true},
+		{"over the limit", strings.Repeat("a", 73), 72, false},
+		{"over a lower limit", "pa55word1234", 10, false},
+	}
+
+	for _, tt := range tests {
+		v := validator.New()
+		ValidatePasswordPlaintext(v, tt.password, tt.maxLength)
+
+		if v.Valid() != tt.want {
+			t.Errorf("%s: got valid %v, want %v", tt.name, v.Valid(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,491 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Bekian/greenlight/internal/validator"
+
+	"github.com/lib/pq"
+)
+
+// events a webhook can subscribe to, "*" subscribes to all of them
+var WebhookEvents = []string{
+	"movie.created",
+	"movie.updated",
+	"movie.deleted",
+	"user.created",
+	"user.activated",
+	"user.updated",
+	"user.deleted",
+}
+
+// constants for delivery status
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryDead      = "dead" // gave up after the max number of attempts
+)
+
+// a subscription to events, the secret is used to sign each delivery
+type Webhook struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"-"`
+	Active    bool      `json:"active"`
+	Version   int32     `json:"version"`
+}
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	v.Check(webhook.URL != "", "url", "must be provided")
+	v.Check(len(webhook.URL) <= 2048, "url", "must not be more than 2048 bytes long")
+	v.Check(validator.IsHTTPURL(webhook.URL), "url", "must be an absolute http or https url")
+
+	v.Check(webhook.Events != nil, "events", "must be provided")
+	v.Check(len(webhook.Events) >= 1, "events", "must contain at least 1 event")
+	v.Check(validator.Unique(webhook.Events), "events", "must not contain duplicate values")
+
+	for _, event := range webhook.Events {
+		v.Check(event == "*" || validator.PermittedValue(event, WebhookEvents...), "events", fmt.Sprintf("unknown event %q", event))
+	}
+
+	v.Check(webhook.Secret != "", "secret", "must be provided")
+	v.Check(len(webhook.Secret) >= 16, "secret", "must be at least 16 bytes long")
+	v.Check(len(webhook.Secret) <= 256, "secret", "must not be more than 256 bytes long")
+}
+
+// connection pool wrapper
+type WebhookModel struct {
+	DB *sql.DB
+}
+
+// insert a new webhook
+func (m WebhookModel) Insert(webhook *Webhook) error {
+	query := `
+		INSERT INTO webhooks (url, events, secret, active)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version`
+
+	args := []any{webhook.URL, pq.Array(webhook.Events), webhook.Secret, webhook.Active}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.Version)
+}
+
+// get a webhook by id
+func (m WebhookModel) Get(id int64) (*Webhook, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, url, events, secret, active, version
+		FROM webhooks
+		WHERE id = $1`
+
+	var webhook Webhook
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.URL,
+		pq.Array(&webhook.Events),
+		&webhook.Secret,
+		&webhook.Active,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &webhook, nil
+}
+
+// get all webhooks, paginated with the provided filters
+func (m WebhookModel) GetAll(filters Filters) ([]*Webhook, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, url, events, secret, active, version
+		FROM webhooks
+		ORDER BY %s %s, id ASC
+		LIMIT $1 OFFSET $2`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	webhooks := []*Webhook{}
+
+	for rows.Next() {
+		var webhook Webhook
+
+		err := rows.Scan(
+			&totalRecords,
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.URL,
+			pq.Array(&webhook.Events),
+			&webhook.Secret,
+			&webhook.Active,
+			&webhook.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		webhooks = append(webhooks, &webhook)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return webhooks, metadata, nil
+}
+
+// update a webhook, checking the version to prevent edit conflicts
+func (m WebhookModel) Update(webhook *Webhook) error {
+	query := `
+		UPDATE webhooks
+		SET url = $1, events = $2, secret = $3, active = $4, version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING version`
+
+	args := []any{
+		webhook.URL,
+		pq.Array(webhook.Events),
+		webhook.Secret,
+		webhook.Active,
+		webhook.ID,
+		webhook.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// delete a webhook, its deliveries are removed by the cascade
+func (m WebhookModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM webhooks
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// a single queued event for a webhook, along with the result of the latest attempt.
+// url and secret are copied from the webhook when a delivery is claimed
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	WebhookID      int64           `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	LastAttemptAt  *time.Time      `json:"last_attempt_at,omitempty"`
+	LastStatusCode int             `json:"last_status_code,omitzero"`
+	LastError      string          `json:"last_error,omitzero"`
+	URL            string          `json:"-"`
+	Secret         string          `json:"-"`
+}
+
+// connection pool wrapper
+type WebhookDeliveryModel struct {
+	DB *sql.DB
+}
+
+// queue a delivery of the event for every active webhook subscribed to it
+func (m WebhookDeliveryModel) Enqueue(event string, payload []byte) error {
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload)
+		SELECT id, $1, $2 FROM webhooks
+		WHERE active AND ($1 = ANY(events) OR '*' = ANY(events))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, event, payload)
+	return err
+}
+
+// claim up to limit deliveries that are due.
+// claimed deliveries have their next attempt pushed back by the lease duration,
+// so other instances skip them, and they're retried if this instance dies mid-delivery.
+// deliveries for deactivated webhooks wait until the webhook is active again
+func (m WebhookDeliveryModel) Claim(limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	query := `
+		WITH claimed AS (
+			UPDATE webhook_deliveries
+			SET next_attempt_at = NOW() + make_interval(secs => $2)
+			WHERE id IN (
+				SELECT webhook_deliveries.id FROM webhook_deliveries
+				INNER JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id
+				WHERE webhook_deliveries.status = 'pending' AND webhook_deliveries.next_attempt_at <= NOW()
+				AND webhooks.active
+				ORDER BY webhook_deliveries.next_attempt_at
+				LIMIT $1
+				FOR UPDATE OF webhook_deliveries SKIP LOCKED
+			)
+			RETURNING id, created_at, webhook_id, event, payload, status, attempts, next_attempt_at
+		)
+		SELECT claimed.id, claimed.created_at, claimed.webhook_id, claimed.event, claimed.payload,
+			claimed.status, claimed.attempts, claimed.next_attempt_at, webhooks.url, webhooks.secret
+		FROM claimed
+		INNER JOIN webhooks ON webhooks.id = claimed.webhook_id
+		ORDER BY claimed.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&delivery.Payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.URL,
+			&delivery.Secret,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// record the result of a delivery attempt.
+// the status and next attempt time should be set on the delivery before calling this
+func (m WebhookDeliveryModel) RecordAttempt(delivery *WebhookDelivery) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = $2, next_attempt_at = $3, last_attempt_at = $4,
+			last_status_code = $5, last_error = $6
+		WHERE id = $7`
+
+	args := []any{
+		delivery.Status,
+		delivery.Attempts,
+		delivery.NextAttemptAt,
+		delivery.LastAttemptAt,
+		delivery.LastStatusCode,
+		delivery.LastError,
+		delivery.ID,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+const webhookDeliveryColumns = `
+	id, created_at, webhook_id, event, payload, status, attempts,
+	next_attempt_at, last_attempt_at, last_status_code, last_error`
+
+func scanWebhookDelivery(row interface{ Scan(...any) error }, dest ...any) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+
+	args := append(dest,
+		&delivery.ID,
+		&delivery.CreatedAt,
+		&delivery.WebhookID,
+		&delivery.Event,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.LastAttemptAt,
+		&delivery.LastStatusCode,
+		&delivery.LastError,
+	)
+
+	err := row.Scan(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+// get a single delivery belonging to a webhook
+func (m WebhookDeliveryModel) Get(webhookID, id int64) (*WebhookDelivery, error) {
+	if id < 1 || webhookID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT ` + webhookDeliveryColumns + `
+		FROM webhook_deliveries
+		WHERE id = $1 AND webhook_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	delivery, err := scanWebhookDelivery(m.DB.QueryRowContext(ctx, query, id, webhookID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return delivery, nil
+}
+
+// get the delivery log for a webhook, optionally filtered by status
+func (m WebhookDeliveryModel) GetAllForWebhook(webhookID int64, status string, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), `+webhookDeliveryColumns+`
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		AND (status = $2 OR $2 = '')
+		ORDER BY %s %s, id DESC
+		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, webhookID, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return deliveries, metadata, nil
+}
+
+// queue a fresh copy of an existing delivery, the original is kept in the log
+func (m WebhookDeliveryModel) Redeliver(delivery *WebhookDelivery) (*WebhookDelivery, error) {
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload)
+		VALUES ($1, $2, $3)
+		RETURNING ` + webhookDeliveryColumns
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, query, delivery.WebhookID, delivery.Event, []byte(delivery.Payload))
+	return scanWebhookDelivery(row)
+}
+
+// delete up to limit deliveries that succeeded or gave up and were created before the given time,
+// pending ones are left for the delivery worker
+func (m WebhookDeliveryModel) DeleteFinishedBefore(before time.Time, limit int) (int64, error) {
+	query := `
+		DELETE FROM webhook_deliveries
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status <> 'pending' AND created_at < $1
+			LIMIT $2
+		)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, before, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,229 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// supported signing algorithms
+const (
+	AlgEdDSA = "EdDSA"
+	AlgHS256 = "HS256"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token has expired")
+)
+
+// shorter hmac secrets are rejected, see rfc 7518 section 3.2
+const minSecretLength = 32
+
+// a signing key, the id is sent in the kid header so keys can be rotated
+type Key struct {
+	ID      string
+	Alg     string
+	secret  []byte
+	private ed25519.PrivateKey
+}
+
+// ParseKey parses a key in the format "<kid>:<alg>:<base64 key>".
+// for EdDSA the key is a 32 byte ed25519 seed, for HS256 it's the hmac secret
+func ParseKey(s string) (*Key, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, errors.New(`jwt key must be in the format "<kid>:<alg>:<base64 key>"`)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("jwt key %q: %w", parts[0], err)
+	}
+
+	key := &Key{ID: parts[0], Alg: parts[1]}
+
+	switch key.Alg {
+	case AlgEdDSA:
+		if len(raw) != ed25519.SeedSize {
+			return nil, fmt.Errorf("jwt key %q: EdDSA seed must be %d bytes", key.ID, ed25519.SeedSize)
+		}
+		key.private = ed25519.NewKeyFromSeed(raw)
+	case AlgHS256:
+		if len(raw) < minSecretLength {
+			return nil, fmt.Errorf("jwt key %q: HS256 secret must be at least %d bytes", key.ID, minSecretLength)
+		}
+		key.secret = raw
+	default:
+		return nil, fmt.Errorf("jwt key %q: unsupported algorithm %q", key.ID, key.Alg)
+	}
+
+	return key, nil
+}
+
+func (k *Key) sign(content []byte) []byte {
+	if k.Alg == AlgEdDSA {
+		return ed25519.Sign(k.private, content)
+	}
+
+	h := hmac.New(sha256.New, k.secret)
+	h.Write(content)
+	return h.Sum(nil)
+}
+
+func (k *Key) verify(content, sig []byte) bool {
+	if k.Alg == AlgEdDSA {
+		return ed25519.Verify(k.private.Public().(ed25519.PublicKey), content, sig)
+	}
+
+	return hmac.Equal(k.sign(content), sig)
+}
+
+// the claims carried by an access token
+type Claims struct {
+	Issuer      string   `json:"iss"`
+	Subject     string   `json:"sub"`
+	ID          string   `json:"jti"`
+	IssuedAt    int64    `json:"iat"`
+	ExpiresAt   int64    `json:"exp"`
+	Activated   bool     `json:"activated"`
+	Permissions []string `json:"permissions"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// signs tokens with the first key and verifies them with any key,
+// so a new key can be put first while tokens signed with the old one are still accepted
+type Signer struct {
+	issuer string
+	keys   []*Key
+	byID   map[string]*Key
+}
+
+func NewSigner(issuer string, keys []*Key) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one jwt key is required")
+	}
+
+	s := &Signer{issuer: issuer, keys: keys, byID: make(map[string]*Key)}
+
+	for _, key := range keys {
+		if _, found := s.byID[key.ID]; found {
+			return nil, fmt.Errorf("duplicate jwt key id %q", key.ID)
+		}
+		s.byID[key.ID] = key
+	}
+
+	return s, nil
+}
+
+// Sign returns a signed token for the claims, the issuer is always set by the signer
+func (s *Signer) Sign(claims Claims) (string, error) {
+	key := s.keys[0]
+	claims.Issuer = s.issuer
+
+	h, err := json.Marshal(header{Alg: key.Alg, Kid: key.ID, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	content := encode(h) + "." + encode(c)
+
+	return content + "." + encode(key.sign([]byte(content))), nil
+}
+
+// Verify checks the signature, issuer and expiry of a token and returns its claims
+func (s *Signer) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var h header
+	if err := decodeJSON(parts[0], &h); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	key, found := s.byID[h.Kid]
+	// the algorithm must match the key, otherwise a public key could be used as an hmac secret
+	if !found || h.Alg != key.Alg {
+		return nil, ErrInvalidToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := decodeJSON(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if claims.Issuer != s.issuer {
+		return nil, ErrInvalidToken
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+
+	return &claims, nil
+}
+
+// JWKS returns the public keys as a json web key set.
+// HS256 keys are shared secrets so they're never included
+func (s *Signer) JWKS() map[string]any {
+	keys := []map[string]string{}
+
+	for _, key := range s.keys {
+		if key.Alg != AlgEdDSA {
+			continue
+		}
+
+		keys = append(keys, map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"use": "sig",
+			"alg": key.Alg,
+			"kid": key.ID,
+			"x":   encode(key.private.Public().(ed25519.PublicKey)),
+		})
+	}
+
+	return map[string]any{"keys": keys}
+}
+
+// LooksLikeJWT reports whether a bearer token has the three part jwt shape,
+// opaque tokens never contain a dot
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeJSON(s string, dst any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, dst)
+}
@@ -0,0 +1,238 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newKey(t *testing.T, id, alg string, b byte) *Key {
+	t.Helper()
+
+	key, err := ParseKey(id + ":" + alg + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func newSigner(t *testing.T, issuer string, keys ...*Key) *Signer {
+	t.Helper()
+
+	s, err := NewSigner(issuer, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestParseKey(t *testing.T) {
+	seed := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+
+	tests := []struct {
+		name    string
+		s       string
+		wantErr bool
+	}{
+		{"eddsa", "k1:EdDSA:" + seed, false},
+		{"hs256", "k1:HS256:" + seed, false},
+		{"no kid", ":EdDSA:" + seed, true},
+		{"missing parts", "k1:" + seed, true},
+		{"unknown algorithm", "k1:RS256:" + seed, true},
+		{"not base64", "k1:EdDSA:not base64", true},
+		{"short seed", "k1:EdDSA:" + base64.StdEncoding.EncodeToString([]byte("short")), true},
+		{"short secret", "k1:HS256:" + base64.StdEncoding.EncodeToString([]byte("short")), true},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseKey(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	claims := Claims{Subject: "42", ExpiresAt: now.Add(time.Minute).Unix(), Permissions: []string{"movies:read"}}
+
+	for _, alg := range []string{AlgEdDSA, AlgHS256} {
+		t.Run(alg, func(t *testing.T) {
+			s := newSigner(t, "greenlight", newKey(t, "k1", alg, 1))
+
+			token, err := s.Sign(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := s.Verify(token, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Subject != "42" || got.Issuer != "greenlight" || len(got.Permissions) != 1 {
+				t.Errorf("got claims %+v", got)
+			}
+		})
+	}
+}
+
+// sign arbitrary header and claims json with the key, for tokens Sign wouldn't make
+func forge(key *Key, header, claims string) string {
+	content := encode([]byte(header)) + "." + encode([]byte(claims))
+	return content + "." + encode(key.sign([]byte(content)))
+}
+
+func TestVerifyRejects(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	exp := now.Add(time.Minute).Unix()
+
+	eddsa := newKey(t, "ed", AlgEdDSA, 1)
+	s := newSigner(t, "greenlight", eddsa)
+
+	valid, err := s.Sign(Claims{Subject: "42", ExpiresAt: exp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, ".")
+
+	// an hmac over the token using the public key as the secret, the classic algorithm confusion attack
+	mac := hmac.New(sha256.New, eddsa.private.Public().(ed25519.PublicKey))
+	confusedContent := encode([]byte(`{"alg":"HS256","kid":"ed","typ":"JWT"}`)) + "." + parts[1]
+	mac.Write([]byte(confusedContent))
+	confused := confusedContent + "." + encode(mac.Sum(nil))
+
+	other := newSigner(t, "someone-else", eddsa)
+	wrongIssuer, err := other.Sign(Claims{Subject: "42", ExpiresAt: exp})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"hs256 header on an eddsa kid", confused, ErrInvalidToken},
+		{"unknown kid", forge(eddsa, `{"alg":"EdDSA","kid":"missing","typ":"JWT"}`, `{"iss":"greenlight","exp":9999999999}`), ErrInvalidToken},
+		{"tampered payload", parts[0] + "." + encode([]byte(`{"iss":"greenlight","sub":"1","exp":9999999999}`)) + "." + parts[2], ErrInvalidToken},
+		{"tampered signature", parts[0] + "." + parts[1] + "." + encode([]byte("nope")), ErrInvalidToken},
+		{"wrong issuer", wrongIssuer, ErrInvalidToken},
+		{"two parts", parts[0] + "." + parts[1], ErrInvalidToken},
+		{"not base64", "!.!.!", ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Verify(tt.token, now)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyExpiry(t *testing.T) {
+	s := newSigner(t, "greenlight", newKey(t, "k1", AlgEdDSA, 1))
+
+	exp := time.Unix(1700000000, 0)
+
+	token, err := s.Sign(Claims{Subject: "42", ExpiresAt: exp.Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Verify(token, exp.Add(-time.Second)); err != nil {
+		t.Errorf("a second before exp: got error %v", err)
+	}
+	// exp is the first moment the token isn't valid
+	if _, err := s.Verify(token, exp); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("at exp: got error %v, want %v", err, ErrExpiredToken)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	claims := Claims{Subject: "42", ExpiresAt: now.Add(time.Minute).Unix()}
+
+	oldKey := newKey(t, "old", AlgEdDSA, 1)
+	rotated := newKey(t, "new", AlgEdDSA, 2)
+
+	before := newSigner(t, "greenlight", oldKey)
+	after := newSigner(t, "greenlight", rotated, oldKey)
+
+	oldToken, err := before.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newToken, err := after.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(mustDecode(t, strings.Split(newToken, ".")[0])), `"kid":"new"`) {
+		t.Error("the new token wasn't signed with the first key")
+	}
+
+	// tokens signed before the rotation are still accepted
+	if _, err := after.Verify(oldToken, now); err != nil {
+		t.Errorf("old token after rotation: %v", err)
+	}
+	if _, err := after.Verify(newToken, now); err != nil {
+		t.Errorf("new token after rotation: %v", err)
+	}
+
+	// and once the old key is dropped they aren't
+	dropped := newSigner(t, "greenlight", rotated)
+	if _, err := dropped.Verify(oldToken, now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("old token after the old key was dropped: got error %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestJWKSLeavesOutHS256(t *testing.T) {
+	s := newSigner(t, "greenlight",
+		newKey(t, "hmac", AlgHS256, 1),
+		newKey(t, "ed", AlgEdDSA, 2),
+	)
+
+	keys := s.JWKS()["keys"].([]map[string]string)
+
+	if len(keys) != 1 {
+		t.Fatalf("got %d keys, want 1", len(keys))
+	}
+	if keys[0]["kid"] != "ed" {
+		t.Errorf("got kid %q, want %q", keys[0]["kid"], "ed")
+	}
+	for _, key := range keys {
+		if key["alg"] == AlgHS256 {
+			t.Error("an HS256 secret was published")
+		}
+	}
+}
+
+func TestNewSignerRejectsDuplicateIDs(t *testing.T) {
+	_, err := NewSigner("greenlight", []*Key{newKey(t, "k1", AlgEdDSA, 1), newKey(t, "k1", AlgHS256, 2)})
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func mustDecode(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
@@ -0,0 +1,473 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidIDToken = errors.New("invalid id token")
+)
+
+// the keys are fetched again when a token is signed with an unknown key,
+// but not more often than this so bad tokens can't be used to hammer the provider
+const jwksRefreshInterval = time.Minute
+
+// allowed difference between our clock and the provider's
+const clockSkew = time.Minute
+
+// settings for a single identity provider
+type Config struct {
+	Name         string   `json:"name"` // used in urls, e.g. /v1/oidc/<name>/authorize
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`       // openid is always requested
+	AllowSignup  bool     `json:"allow_signup"` // create accounts for unknown users
+}
+
+// the parts of the discovery document that are used
+type discovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// a configured provider, discovery happens on first use and is cached
+type Provider struct {
+	Config
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	keys      map[string]crypto.PublicKey
+	keysAt    time.Time
+}
+
+func NewProvider(cfg Config, client *http.Client) *Provider {
+	return &Provider{Config: cfg, client: client}
+}
+
+// the claims of an id token that are used
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified flexBool `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// aud can be a single string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var list []string
+	err := json.Unmarshal(b, &list)
+	*a = list
+	return err
+}
+
+// some providers send email_verified as a string
+type flexBool bool
+
+func (f *flexBool) UnmarshalJSON(b []byte) error {
+	switch strings.Trim(string(b), `"`) {
+	case "true":
+		*f = true
+	case "false", "null":
+		*f = false
+	default:
+		return fmt.Errorf("invalid boolean %s", b)
+	}
+	return nil
+}
+
+// NewPKCE returns a code verifier and its S256 challenge, see rfc 7636
+func NewPKCE() (verifier, challenge string) {
+	b := make([]byte, 32)
+	rand.Read(b)
+	verifier = base64.RawURLEncoding.EncodeToString(b)
+
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the url to send the user to for logging in at the provider
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, challenge string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	scopes := []string{"openid"}
+	for _, scope := range p.Scopes {
+		if scope != "openid" {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("scope", strings.Join(scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", challenge)
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	return d.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange swaps an authorization code for an id token and returns its verified claims
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Claims, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", verifier)
+
+	// client_secret_basic is the default when the provider doesn't say, see openid connect discovery section 3
+	basic := len(d.TokenAuthMethods) == 0 || slices.Contains(d.TokenAuthMethods, "client_secret_basic")
+	if !basic {
+		form.Set("client_id", p.ClientID)
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	var res struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	status, err := p.doJSON(req, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	if status != http.StatusOK || res.IDToken == "" {
+		return nil, fmt.Errorf("oidc token exchange failed with status %d: %s %s", status, res.Error, res.ErrorDescription)
+	}
+
+	return p.Verify(ctx, res.IDToken, nonce, time.Now())
+}
+
+// Verify checks the signature and claims of an id token
+func (p *Provider) Verify(ctx context.Context, rawIDToken, nonce string, now time.Time) (*Claims, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	key, err := p.key(ctx, d, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, ErrInvalidIDToken
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	switch {
+	case claims.Issuer != d.Issuer:
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidIDToken, claims.Issuer)
+	case !slices.Contains(claims.Audience, p.ClientID):
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidIDToken)
+	case now.Add(-clockSkew).Unix() >= claims.ExpiresAt:
+		return nil, fmt.Errorf("%w: expired", ErrInvalidIDToken)
+	case claims.IssuedAt > now.Add(clockSkew).Unix():
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidIDToken)
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	}
+
+	return &claims, nil
+}
+
+// fetch the discovery document once, a failed fetch is retried on the next call
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	u := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var d discovery
+	status, err := p.doJSON(req, &d)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery for %s failed with status %d", p.Name, status)
+	}
+
+	// the issuer must match exactly, see openid connect discovery section 4.3
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("oidc discovery for %s returned issuer %q, expected %q", p.Name, d.Issuer, p.Issuer)
+	}
+
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// find a signing key by id, refetching the key set if it isn't known
+func (p *Provider) key(ctx context.Context, d *discovery, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, found := p.keys[kid]; found {
+		return key, nil
+	}
+
+	if time.Since(p.keysAt) < jwksRefreshInterval {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidIDToken, kid)
+	}
+
+	keys, err := p.fetchKeys(ctx, d.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+
+	p.keys = keys
+	p.keysAt = time.Now()
+
+	key, found := p.keys[kid]
+	if !found {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidIDToken, kid)
+	}
+
+	return key, nil
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (p *Provider) fetchKeys(ctx context.Context, uri string) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	status, err := p.doJSON(req, &set)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("oidc jwks for %s failed with status %d", p.Name, status)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		// keys that can't be parsed are skipped, the provider may publish types we don't use
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// check a signature, the algorithm has to match the type of key
+func verifySignature(alg string, key crypto.PublicKey, content, sig []byte) bool {
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		sum := sha256.Sum256(content)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+		sum := sha256.Sum256(content)
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, sum[:], r, s)
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return false
+		}
+		return ed25519.Verify(pub, content, sig)
+	default:
+		return false
+	}
+}
+
+// send a request and decode the json response, whatever the status
+func (p *Provider) doJSON(req *http.Request, dst any) (int, error) {
+	res, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return res.StatusCode, err
+	}
+
+	if err := json.Unmarshal(body, dst); err != nil && res.StatusCode == http.StatusOK {
+		return res.StatusCode, err
+	}
+
+	return res.StatusCode, nil
+}
+
+func decodeSegment(s string, dst any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, dst)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,399 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a mock identity provider serving discovery, a key set and a token endpoint
+type testIdP struct {
+	*httptest.Server
+	t *testing.T
+
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+	edKey  ed25519.PrivateKey
+
+	mu         sync.Mutex
+	jwksHits   int
+	extraKeys  []jwk
+	challenges map[string]string // code challenges by authorization code
+	idToken    string            // returned by the token endpoint
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &testIdP{t: t, rsaKey: rsaKey, ecKey: ecKey, edKey: edKey, challenges: make(map[string]string)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", idp.discoveryHandler)
+	mux.HandleFunc("GET /jwks", idp.jwksHandler)
+	mux.HandleFunc("POST /token", idp.tokenHandler)
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	return idp
+}
+
+func (idp *testIdP) provider() *Provider {
+	return NewProvider(Config{
+		Name:         "test",
+		Issuer:       idp.URL,
+		ClientID:     "greenlight",
+		ClientSecret: "client secret",
+		RedirectURL:  "https://greenlight.example.com/callback",
+	}, idp.Client())
+}
+
+func (idp *testIdP) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(discovery{
+		Issuer:                idp.URL,
+		AuthorizationEndpoint: idp.URL + "/authorize",
+		TokenEndpoint:         idp.URL + "/token",
+		JWKSURI:               idp.URL + "/jwks",
+	})
+}
+
+func (idp *testIdP) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	idp.jwksHits++
+
+	keys := []jwk{
+		{
+			Kid: "rsa", Kty: "RSA", Use: "sig",
+			N: b64(idp.rsaKey.N.Bytes()),
+			E: b64(big.NewInt(int64(idp.rsaKey.E)).Bytes()),
+		},
+		{
+			Kid: "ec", Kty: "EC", Crv: "P-256",
+			X: b64(idp.ecKey.X.FillBytes(make([]byte, 32))),
+			Y: b64(idp.ecKey.Y.FillBytes(make([]byte, 32))),
+		},
+		{
+			Kid: "ed", Kty: "OKP", Crv: "Ed25519",
+			X: b64(idp.edKey.Public().(ed25519.PublicKey)),
+		},
+		// encryption keys aren't used for signatures
+		{Kid: "enc", Kty: "RSA", Use: "enc", N: b64(idp.rsaKey.N.Bytes()), E: "AQAB"},
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{"keys": append(keys, idp.extraKeys...)})
+}
+
+func (idp *testIdP) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	fail := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != "greenlight" || secret != url.QueryEscape("client secret") {
+		fail("invalid_client")
+		return
+	}
+
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		fail("unsupported_grant_type")
+		return
+	}
+
+	// the verifier has to hash to the challenge sent with the authorization request
+	challenge, found := idp.challenges[r.PostFormValue("code")]
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !found || b64(sum[:]) != challenge {
+		fail("invalid_grant")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idp.idToken, "token_type": "Bearer"})
+}
+
+// claims for a valid token from this provider
+func (idp *testIdP) claims(now time.Time) map[string]any {
+	return map[string]any{
+		"iss":            idp.URL,
+		"sub":            "user-1",
+		"aud":            "greenlight",
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          "nonce",
+		"email":          "alice@example.com",
+		"email_verified": "true",
+	}
+}
+
+// sign claims with one of the provider's keys, the alg in the header doesn't have to match the key
+func (idp *testIdP) sign(alg, kid string, signer crypto.Signer, claims map[string]any) string {
+	idp.t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	content := b64(header) + "." + b64(payload)
+
+	var sig []byte
+	var err error
+
+	switch key := signer.(type) {
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(content))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		sum := sha256.Sum256([]byte(content))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, sum[:])
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, []byte(content))
+	}
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+
+	return content + "." + b64(sig)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestVerify(t *testing.T) {
+	idp := newTestIdP(t)
+	now := time.Now()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(name string, value any) map[string]any {
+		claims := idp.claims(now)
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	tampered := idp.sign("RS256", "rsa", idp.rsaKey, idp.claims(now))
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+
+	unsigned := idp.sign("none", "rsa", idp.rsaKey, idp.claims(now))
+	unsigned = unsigned[:strings.LastIndex(unsigned, ".")+1]
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"rs256", idp.sign("RS256", "rsa", idp.rsaKey, idp.claims(now)), false},
+		{"es256", idp.sign("ES256", "ec", idp.ecKey, idp.claims(now)), false},
+		{"eddsa", idp.sign("EdDSA", "ed", idp.edKey, idp.claims(now)), false},
+		{"audience list", idp.sign("RS256", "rsa", idp.rsaKey, with("aud", []string{"other", "greenlight"})), false},
+		{"within clock skew", idp.sign("RS256", "rsa", idp.rsaKey, with("exp", now.Add(-clockSkew/2).Unix())), false},
+		{"signed by another key", idp.sign("RS256", "rsa", otherKey, idp.claims(now)), true},
+		{"tampered signature", tampered, true},
+		{"es256 header on an rsa key", idp.sign("ES256", "rsa", idp.ecKey, idp.claims(now)), true},
+		{"rs256 header on an ec key", idp.sign("RS256", "ec", idp.rsaKey, idp.claims(now)), true},
+		{"hs256", idp.sign("HS256", "rsa", idp.rsaKey, idp.claims(now)), true},
+		{"none", unsigned, true},
+		{"encryption key", idp.sign("RS256", "enc", idp.rsaKey, idp.claims(now)), true},
+		{"wrong issuer", idp.sign("RS256", "rsa", idp.rsaKey, with("iss", "https://evil.example.com")), true},
+		{"wrong audience", idp.sign("RS256", "rsa", idp.rsaKey, with("aud", "other")), true},
+		{"expired", idp.sign("RS256", "rsa", idp.rsaKey, with("exp", now.Add(-2*clockSkew).Unix())), true},
+		{"issued in the future", idp.sign("RS256", "rsa", idp.rsaKey, with("iat", now.Add(2*clockSkew).Unix())), true},
+		{"nonce mismatch", idp.sign("RS256", "rsa", idp.rsaKey, with("nonce", "other")), true},
+		{"missing nonce", idp.sign("RS256", "rsa", idp.rsaKey, with("nonce", nil)), true},
+		{"missing subject", idp.sign("RS256", "rsa", idp.rsaKey, with("sub", nil)), true},
+		{"not a jwt", "not.a-jwt", true},
+	}
+
+	p := idp.provider()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := p.Verify(context.Background(), tt.token, "nonce", now)
+
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidIDToken) {
+					t.Errorf("got %v, want %v", err, ErrInvalidIDToken)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != "user-1" || claims.Email != "alice@example.com" || !claims.EmailVerified {
+				t.Errorf("got claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestVerifyUnknownKey(t *testing.T) {
+	idp := newTestIdP(t)
+	p := idp.provider()
+	now := time.Now()
+
+	rotated, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := idp.sign("ES256", "rotated", rotated, idp.claims(now))
+
+	_, err = p.Verify(context.Background(), idp.sign("RS256", "rsa", idp.rsaKey, idp.claims(now)), "nonce", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the provider starts publishing a new key
+	idp.mu.Lock()
+	idp.extraKeys = append(idp.extraKeys, jwk{
+		Kid: "rotated", Kty: "EC", Crv: "P-256",
+		X: b64(rotated.X.FillBytes(make([]byte, 32))),
+		Y: b64(rotated.Y.FillBytes(make([]byte, 32))),
+	})
+	idp.mu.Unlock()
+
+	// keys were just fetched, so unknown ones are rejected without asking the provider again
+	for range 3 {
+		_, err = p.Verify(context.Background(), token, "nonce", now)
+		if !errors.Is(err, ErrInvalidIDToken) {
+			t.Errorf("got %v, want %v", err, ErrInvalidIDToken)
+		}
+	}
+
+	if idp.jwksHits != 1 {
+		t.Errorf("got %d key set fetches, want 1", idp.jwksHits)
+	}
+
+	// once the refresh interval has passed the new key is fetched
+	p.mu.Lock()
+	p.keysAt = p.keysAt.Add(-jwksRefreshInterval)
+	p.mu.Unlock()
+
+	_, err = p.Verify(context.Background(), token, "nonce", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if idp.jwksHits != 2 {
+		t.Errorf("got %d key set fetches, want 2", idp.jwksHits)
+	}
+}
+
+func TestNewPKCE(t *testing.T) {
+	verifier, challenge := NewPKCE()
+
+	// rfc 7636 section 4.1, 43 to 128 characters
+	if len(verifier) < 43 || len(verifier) > 128 {
+		t.Errorf("got a verifier of %d characters", len(verifier))
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	if want := b64(sum[:]); challenge != want {
+		t.Errorf("got challenge %q, want %q", challenge, want)
+	}
+
+	if other, _ := NewPKCE(); other == verifier {
+		t.Error("got the same verifier twice")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	idp := newTestIdP(t)
+	p := idp.provider()
+
+	verifier, challenge := NewPKCE()
+
+	authURL, err := p.AuthCodeURL(context.Background(), "state", "nonce", challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := u.Query()
+
+	params := map[string]string{
+		"response_type":         "code",
+		"client_id":             "greenlight",
+		"redirect_uri":          "https://greenlight.example.com/callback",
+		"scope":                 "openid",
+		"state":                 "state",
+		"nonce":                 "nonce",
+		"code_challenge":        challenge,
+		"code_challenge_method": "S256",
+	}
+	for name, want := range params {
+		if got := q.Get(name); got != want {
+			t.Errorf("got %s %q, want %q", name, got, want)
+		}
+	}
+
+	// the provider remembers the challenge for the code it hands out
+	idp.mu.Lock()
+	idp.challenges["code"] = q.Get("code_challenge")
+	idp.idToken = idp.sign("RS256", "rsa", idp.rsaKey, idp.claims(time.Now()))
+	idp.mu.Unlock()
+
+	claims, err := p.Exchange(context.Background(), "code", verifier, "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "user-1" {
+		t.Errorf("got subject %q, want %q", claims.Subject, "user-1")
+	}
+
+	other, _ := NewPKCE()
+	if _, err := p.Exchange(context.Background(), "code", other, "nonce"); err == nil {
+		t.Error("expected an error exchanging with the wrong verifier")
+	}
+
+	if _, err := p.Exchange(context.Background(), "code", verifier, "other"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("got %v, want %v", err, ErrInvalidIDToken)
+	}
+}
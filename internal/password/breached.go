@@ -0,0 +1,125 @@
+package password
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// longest line expected in the file, a 40 character hash, a colon and a count
+const maxLineLength = 64
+
+// BreachedList looks passwords up in a local copy of the Have I Been Pwned password list.
+// the file is the "ordered by hash" download, one "<SHA-1 hash>:<count>" line per password sorted by hash.
+// it's searched on disk since the full list is far too big to load into memory
+type BreachedList struct {
+	file *os.File
+	size int64
+}
+
+// OpenBreachedList opens a password list and checks it looks like the expected format
+func OpenBreachedList(path string) (*BreachedList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	list := &BreachedList{file: file, size: info.Size()}
+
+	_, hash, found, err := list.lineAt(0)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if !found || len(hash) != 2*sha1.Size {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a list of sha-1 hashes", path)
+	}
+
+	return list, nil
+}
+
+// Contains reports whether a password is on the list
+func (l *BreachedList) Contains(plaintext string) (bool, error) {
+	sum := sha1.Sum([]byte(plaintext))
+	target := bytes.ToUpper([]byte(hex.EncodeToString(sum[:])))
+
+	// binary search over byte offsets, every line starting before lo has a smaller hash
+	// and every line starting at or after hi has a hash at least as big as the target
+	lo, hi := int64(0), l.size
+
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		start, hash, found, err := l.lineAt(mid)
+		if err != nil {
+			return false, err
+		}
+
+		if found && bytes.Compare(hash, target) < 0 {
+			lo = start + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	_, hash, found, err := l.lineAt(lo)
+	if err != nil {
+		return false, err
+	}
+
+	return found && bytes.Equal(hash, target), nil
+}
+
+// Close closes the list file
+func (l *BreachedList) Close() error {
+	return l.file.Close()
+}
+
+// find the first line starting at or after offset, returning where it starts and its upper case hash
+func (l *BreachedList) lineAt(offset int64) (int64, []byte, bool, error) {
+	// read from the byte before the offset, so a line starting exactly at the offset is found
+	from := max(offset-1, 0)
+
+	buf := make([]byte, 2*maxLineLength)
+
+	n, err := l.file.ReadAt(buf, from)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, nil, false, err
+	}
+	buf = buf[:n]
+
+	start := from
+	if offset > 0 {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			return 0, nil, false, nil
+		}
+		buf = buf[i+1:]
+		start += int64(i) + 1
+	}
+
+	if len(buf) == 0 {
+		return 0, nil, false, nil
+	}
+
+	line := buf
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+
+	hash, _, _ := bytes.Cut(bytes.TrimRight(line, "\r"), []byte(":"))
+
+	return start, bytes.ToUpper(hash), true, nil
+}
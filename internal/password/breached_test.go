@@ -0,0 +1,151 @@
+package password
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// write a list in the have i been pwned format for the given passwords, sorted by hash
+func writeBreachedList(t *testing.T, passwords []string, newline string, trailing bool) string {
+	t.Helper()
+
+	var lines []string
+	for i, plaintext := range passwords {
+		sum := sha1.Sum([]byte(plaintext))
+		// counts of different lengths so lines don't all start at multiples of the same size
+		lines = append(lines, fmt.Sprintf("%s:%d", strings.ToUpper(hex.EncodeToString(sum[:])), i*i*37+1))
+	}
+	slices.Sort(lines)
+
+	path := filepath.Join(t.TempDir(), "pwned-passwords.txt")
+
+	content := strings.Join(lines, newline)
+	if trailing {
+		content += newline
+	}
+
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// the password whose hash sorts first or last
+func hashExtreme(passwords []string, last bool) string {
+	hash := func(s string) string {
+		sum := sha1.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	cmp := func(a, b string) int { return strings.Compare(hash(a), hash(b)) }
+
+	if last {
+		return slices.MaxFunc(passwords, cmp)
+	}
+	return slices.MinFunc(passwords, cmp)
+}
+
+func TestBreachedListContains(t *testing.T) {
+	var breached []string
+	for i := range 500 {
+		breached = append(breached, fmt.Sprintf("password%d", i))
+	}
+
+	formats := []struct {
+		name     string
+		newline  string
+		trailing bool
+	}{
+		{"lf", "\n", true},
+		{"crlf", "\r\n", true},
+		{"no trailing newline", "\n", false},
+	}
+
+	for _, format := range formats {
+		t.Run(format.name, func(t *testing.T) {
+			list, err := OpenBreachedList(writeBreachedList(t, breached, format.newline, format.trailing))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer list.Close()
+
+			tests := []struct {
+				name      string
+				plaintext string
+				want      bool
+			}{
+				{"first line", hashExtreme(breached, false), true},
+				{"last line", hashExtreme(breached, true), true},
+				{"middle", "password250", true},
+				{"not listed", "correct horse battery staple", false},
+				{"empty", "", false},
+			}
+
+			for _, tt := range tests {
+				got, err := list.Contains(tt.plaintext)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got != tt.want {
+					t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				}
+			}
+
+			// every line can be found wherever the search happens to land
+			for _, plaintext := range breached {
+				found, err := list.Contains(plaintext)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !found {
+					t.Errorf("%q wasn't found", plaintext)
+				}
+			}
+		})
+	}
+}
+
+func TestBreachedListSingleLine(t *testing.T) {
+	list, err := OpenBreachedList(writeBreachedList(t, []string{"password"}, "\n", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+
+	for plaintext, want := range map[string]bool{"password": true, "other": false} {
+		got, err := list.Contains(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%q: got %v, want %v", plaintext, got, want)
+		}
+	}
+}
+
+func TestOpenBreachedListRejectsOtherFiles(t *testing.T) {
+	for name, content := range map[string]string{
+		"empty":     "",
+		"not sha-1": "5F4DCC3B5AA765D61D8327DEB882CF99:10\n",
+		"plaintext": "password\n",
+	} {
+		path := filepath.Join(t.TempDir(), "list.txt")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if list, err := OpenBreachedList(path); err == nil {
+			list.Close()
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
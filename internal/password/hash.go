@@ -0,0 +1,189 @@
+package password
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// hash algorithms, new passwords are hashed with the configured one
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+var (
+	ErrUnknownHash = errors.New("unknown password hash format")
+)
+
+// bcrypt ignores everything after this many bytes
+const bcryptMaxLength = 72
+
+// long enough for any passphrase, short enough that hashing it isn't a way to tie up the server
+const argon2idMaxLength = 1024
+
+// Argon2idParams are the cost parameters for argon2id, see rfc 9106
+type Argon2idParams struct {
+	Memory      uint32 // in KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// Hasher hashes new passwords with one algorithm and verifies hashes made with any of them.
+// hashes are self-describing, argon2id hashes use the PHC string format
+// and bcrypt hashes the usual $2a$ format, so the algorithm can change without breaking old ones
+type Hasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2id   Argon2idParams
+}
+
+// DefaultHasher uses argon2id with the parameters rfc 9106 recommends for memory constrained environments
+func DefaultHasher() *Hasher {
+	return &Hasher{
+		Algorithm:  Argon2id,
+		BcryptCost: 12,
+		Argon2id: Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  3,
+			Parallelism: 2,
+			SaltLength:  16,
+			KeyLength:   32,
+		},
+	}
+}
+
+// Check returns an error if the algorithm or its parameters aren't usable
+func (h *Hasher) Check() error {
+	switch {
+	case h.Algorithm != Argon2id && h.Algorithm != Bcrypt:
+		return fmt.Errorf("unknown password hash algorithm %q, must be argon2id or bcrypt", h.Algorithm)
+	case h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost:
+		return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	case h.Argon2id.Iterations < 1 || h.Argon2id.Parallelism < 1:
+		return errors.New("argon2id needs at least 1 iteration and 1 thread")
+	case h.Argon2id.Memory < 8*uint32(h.Argon2id.Parallelism):
+		return errors.New("argon2id needs at least 8 KiB of memory per thread")
+	}
+
+	return nil
+}
+
+// MaxLength is the longest password in bytes the algorithm can hash without losing part of it
+func (h *Hasher) MaxLength() int {
+	if h.Algorithm == Bcrypt {
+		return bcryptMaxLength
+	}
+	return argon2idMaxLength
+}
+
+// Hash hashes a password with the configured algorithm
+func (h *Hasher) Hash(plaintext string) ([]byte, error) {
+	switch h.Algorithm {
+	case Bcrypt:
+		return bcrypt.GenerateFromPassword([]byte(plaintext), h.BcryptCost)
+	case Argon2id:
+		p := h.Argon2id
+
+		salt := make([]byte, p.SaltLength)
+		rand.Read(salt)
+
+		key := argon2.IDKey([]byte(plaintext), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+		encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		)
+
+		return []byte(encoded), nil
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm %q", h.Algorithm)
+	}
+}
+
+// Verify checks a password against a hash made with any supported algorithm.
+// rehash is true when the password matched but the hash wasn't made with the current algorithm and parameters
+func (h *Hasher) Verify(plaintext string, hash []byte) (match, rehash bool, err error) {
+	switch {
+	case bytes.HasPrefix(hash, []byte("$argon2id$")):
+		return h.verifyArgon2id(plaintext, hash)
+	case bytes.HasPrefix(hash, []byte("$2")):
+		return h.verifyBcrypt(plaintext, hash)
+	default:
+		return false, false, ErrUnknownHash
+	}
+}
+
+func (h *Hasher) verifyBcrypt(plaintext string, hash []byte) (bool, bool, error) {
+	// bcrypt can't have hashed a longer password, and would refuse to compare it
+	if len(plaintext) > bcryptMaxLength {
+		return false, false, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword(hash, []byte(plaintext))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, false, nil
+		default:
+			return false, false, err
+		}
+	}
+
+	cost, err := bcrypt.Cost(hash)
+	if err != nil {
+		return false, false, err
+	}
+
+	return true, h.Algorithm != Bcrypt || cost != h.BcryptCost, nil
+}
+
+func (h *Hasher) verifyArgon2id(plaintext string, hash []byte) (bool, bool, error) {
+	var version int
+	var p Argon2idParams
+
+	// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+	parts := bytes.Split(hash, []byte("$"))
+	if len(parts) != 6 {
+		return false, false, ErrUnknownHash
+	}
+
+	_, err := fmt.Sscanf(string(parts[2]), "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false, false, ErrUnknownHash
+	}
+
+	_, err = fmt.Sscanf(string(parts[3]), "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism)
+	if err != nil {
+		return false, false, ErrUnknownHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(string(parts[4]))
+	if err != nil {
+		return false, false, ErrUnknownHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(string(parts[5]))
+	if err != nil {
+		return false, false, ErrUnknownHash
+	}
+
+	p.SaltLength, p.KeyLength = uint32(len(salt)), uint32(len(key))
+
+	other := argon2.IDKey([]byte(plaintext), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return false, false, nil
+	}
+
+	return true, h.Algorithm != Argon2id || p != h.Argon2id, nil
+}
@@ -0,0 +1,212 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheap parameters so the tests run quickly
+func testHasher(algorithm string) *Hasher {
+	return &Hasher{
+		Algorithm:  algorithm,
+		BcryptCost: bcrypt.MinCost,
+		Argon2id: Argon2idParams{
+			Memory:      64,
+			Iterations:  1,
+			Parallelism: 1,
+			SaltLength:  16,
+			KeyLength:   32,
+		},
+	}
+}
+
+func TestHasherRoundTrip(t *testing.T) {
+	for _, algorithm := range []string{Argon2id, Bcrypt} {
+		t.Run(algorithm, func(t *testing.T) {
+			h := testHasher(algorithm)
+
+			hash, err := h.Hash("pa55word1234")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			match, rehash, err := h.Verify("pa55word1234", hash)
+			if err != nil || !match || rehash {
+				t.Errorf("got match %v, rehash %v, err %v, want a match without a rehash", match, rehash, err)
+			}
+
+			match, rehash, err = h.Verify("pa55word12345", hash)
+			if err != nil || match || rehash {
+				t.Errorf("wrong password: got match %v, rehash %v, err %v", match, rehash, err)
+			}
+		})
+	}
+}
+
+func TestVerifyArgon2idFormat(t *testing.T) {
+	h := testHasher(Argon2id)
+
+	// made with m=64,t=1,p=1, a 16 byte salt and a 32 byte key
+	hash, err := h.Hash("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "$argon2id$v=19$m=64,t=1,p=1$"; !strings.HasPrefix(string(hash), want) {
+		t.Fatalf("got %s, want it to start with %s", hash, want)
+	}
+
+	parts := strings.Split(string(hash), "$")
+	salt, key := parts[4], parts[5]
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"missing key", "$argon2id$v=19$m=64,t=1,p=1$" + salt},
+		{"extra part", string(hash) + "$extra"},
+		{"other version", "$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key},
+		{"bad version", "$argon2id$version$m=64,t=1,p=1$" + salt + "$" + key},
+		{"bad params", "$argon2id$v=19$t=1,m=64,p=1$" + salt + "$" + key},
+		{"bad salt", "$argon2id$v=19$m=64,t=1,p=1$!!!$" + key},
+		{"bad key", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$!!!"},
+		{"argon2i", "$argon2i$v=19$m=64,t=1,p=1$" + salt + "$" + key},
+		{"plaintext", "pa55word1234"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, _, err := h.Verify("pa55word1234", []byte(tt.hash))
+			if !errors.Is(err, ErrUnknownHash) {
+				t.Errorf("got %v, want %v", err, ErrUnknownHash)
+			}
+			if match {
+				t.Error("got a match")
+			}
+		})
+	}
+
+	// the parameters come from the hash rather than the hasher
+	other := testHasher(Argon2id)
+	other.Argon2id.Iterations = 2
+
+	match, _, err := other.Verify("pa55word1234", hash)
+	if err != nil || !match {
+		t.Errorf("got match %v, err %v with different parameters", match, err)
+	}
+}
+
+func TestVerifyRehash(t *testing.T) {
+	argon2idHash, err := testHasher(Argon2id).Hash("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := testHasher(Bcrypt).Hash("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := func(algorithm string, change func(h *Hasher)) *Hasher {
+		h := testHasher(algorithm)
+		change(h)
+		return h
+	}
+
+	tests := []struct {
+		name   string
+		hasher *Hasher
+		hash   []byte
+		want   bool
+	}{
+		{"same argon2id params", testHasher(Argon2id), argon2idHash, false},
+		{"argon2id memory", changed(Argon2id, func(h *Hasher) { h.Argon2id.Memory = 128 }), argon2idHash, true},
+		{"argon2id iterations", changed(Argon2id, func(h *Hasher) { h.Argon2id.Iterations = 2 }), argon2idHash, true},
+		{"argon2id parallelism", changed(Argon2id, func(h *Hasher) { h.Argon2id.Parallelism = 2 }), argon2idHash, true},
+		{"argon2id salt length", changed(Argon2id, func(h *Hasher) { h.Argon2id.SaltLength = 32 }), argon2idHash, true},
+		{"argon2id key length", changed(Argon2id, func(h *Hasher) { h.Argon2id.KeyLength = 64 }), argon2idHash, true},
+		{"argon2id hash with bcrypt configured", testHasher(Bcrypt), argon2idHash, true},
+		{"same bcrypt cost", testHasher(Bcrypt), bcryptHash, false},
+		{"bcrypt cost", changed(Bcrypt, func(h *Hasher) { h.BcryptCost = bcrypt.MinCost + 1 }), bcryptHash, true},
+		{"bcrypt hash with argon2id configured", testHasher(Argon2id), bcryptHash, true},
+		// only the argon2id parameters matter when bcrypt isn't in use
+		{"bcrypt cost with argon2id configured", changed(Argon2id, func(h *Hasher) { h.BcryptCost = 14 }), argon2idHash, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, rehash, err := tt.hasher.Verify("pa55word1234", tt.hash)
+			if err != nil || !match {
+				t.Fatalf("got match %v, err %v", match, err)
+			}
+
+			if rehash != tt.want {
+				t.Errorf("got rehash %v, want %v", rehash, tt.want)
+			}
+
+			// a wrong password never asks for a rehash
+			_, rehash, _ = tt.hasher.Verify("wrong password", tt.hash)
+			if rehash {
+				t.Error("got rehash for a wrong password")
+			}
+		})
+	}
+}
+
+func TestBcryptLongPasswords(t *testing.T) {
+	h := testHasher(Bcrypt)
+
+	if got := h.MaxLength(); got != 72 {
+		t.Errorf("got max length %d, want 72", got)
+	}
+	if got := testHasher(Argon2id).MaxLength(); got <= 72 {
+		t.Errorf("got argon2id max length %d, want more than bcrypt's", got)
+	}
+
+	exact := strings.Repeat("a", 72)
+
+	hash, err := h.Hash(exact)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match, _, err := h.Verify(exact, hash)
+	if err != nil || !match {
+		t.Errorf("72 bytes: got match %v, err %v", match, err)
+	}
+
+	// bcrypt alone would only compare the first 72 bytes and accept these
+	for _, long := range []string{exact + "b", exact + strings.Repeat("b", 1000)} {
+		match, rehash, err := h.Verify(long, hash)
+		if err != nil || match || rehash {
+			t.Errorf("%d bytes: got match %v, rehash %v, err %v", len(long), match, rehash, err)
+		}
+	}
+}
+
+func TestHasherCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(h *Hasher)
+		wantErr bool
+	}{
+		{"valid", func(h *Hasher) {}, false},
+		{"unknown algorithm", func(h *Hasher) { h.Algorithm = "md5" }, true},
+		{"bcrypt cost too low", func(h *Hasher) { h.BcryptCost = bcrypt.MinCost - 1 }, true},
+		{"bcrypt cost too high", func(h *Hasher) { h.BcryptCost = bcrypt.MaxCost + 1 }, true},
+		{"no iterations", func(h *Hasher) { h.Argon2id.Iterations = 0 }, true},
+		{"no threads", func(h *Hasher) { h.Argon2id.Parallelism = 0 }, true},
+		{"too little memory", func(h *Hasher) { h.Argon2id.Parallelism = 16 }, true},
+	}
+
+	for _, tt := range tests {
+		h := testHasher(Argon2id)
+		tt.change(h)
+
+		if err := h.Check(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
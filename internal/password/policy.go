@@ -0,0 +1,80 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Bekian/greenlight/internal/validator"
+)
+
+// Policy is the set of rules new passwords have to follow
+type Policy struct {
+	MinLength int           // in characters
+	MinScore  int           // lowest acceptable Score, from 0 to 4
+	Breached  *BreachedList // passwords known from data breaches, nil to skip the check
+}
+
+// Validate checks a new password against each rule, adding an error for the first one it breaks.
+// personal is what the password must not contain, like the user's name and email.
+// an error is only returned if the breached password list can't be read
+func (p *Policy) Validate(v *validator.Validator, plaintext string, personal ...string) error {
+	// the basic checks in data.ValidatePasswordPlaintext failed already
+	if _, found := v.Errors["password"]; found {
+		return nil
+	}
+
+	words := personalWords(personal)
+
+	v.Check(len([]rune(plaintext)) >= p.MinLength, "password", fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	v.Check(!containsAny(plaintext, words), "password", "must not contain your name or email address")
+	v.Check(Score(plaintext, words...) >= p.MinScore, "password", "is too easy to guess, try a longer password or a few unrelated words")
+
+	if _, found := v.Errors["password"]; found || p.Breached == nil {
+		return nil
+	}
+
+	breached, err := p.Breached.Contains(plaintext)
+	if err != nil {
+		return err
+	}
+
+	v.Check(!breached, "password", "has appeared in a data breach, choose a different password")
+
+	return nil
+}
+
+// split names and email addresses into the words a password must not contain,
+// "Jane Doe" and "jane.doe+films@example.com" both give "jane" and "doe"
+func personalWords(personal []string) []string {
+	var words []string
+
+	for _, s := range personal {
+		s = strings.ToLower(s)
+		local, _, _ := strings.Cut(s, "@")
+
+		fields := strings.FieldsFunc(local, func(r rune) bool {
+			return strings.ContainsRune(" .-_+'", r)
+		})
+
+		for _, word := range append(fields, local) {
+			// shorter words turn up in too many passwords by chance
+			if len([]rune(word)) >= 3 {
+				words = append(words, word)
+			}
+		}
+	}
+
+	return words
+}
+
+func containsAny(plaintext string, words []string) bool {
+	lower := strings.ToLower(plaintext)
+
+	for _, word := range words {
+		if strings.Contains(lower, word) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,217 @@
+package password
+
+import (
+	_ "embed"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// common passwords and words, most common first.
+// a password made of these is cheap to guess however long it is
+//
+//go:embed "common.txt"
+var commonList string
+
+// rank of each common word, starting at 1
+var commonRanks = func() map[string]int {
+	ranks := make(map[string]int)
+	for i, word := range strings.Fields(commonList) {
+		if _, found := ranks[word]; !found {
+			ranks[word] = i + 1
+		}
+	}
+	return ranks
+}()
+
+// no word is looked for past this many characters
+var longestCommon = func() int {
+	longest := 0
+	for word := range commonRanks {
+		longest = max(longest, len(word))
+	}
+	return longest
+}()
+
+// rows of a qwerty keyboard, runs along these are as easy to guess as "abc"
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+// common letter substitutions, undone before looking for words
+var leet = map[rune]rune{'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '@': 'a', '$': 's', '!': 'i'}
+
+// Score estimates how hard a password is to guess on a scale of 0 to 4, like zxcvbn.
+// the password is split into common words, personal words like the user's name,
+// repeats, sequences, years and random characters, and the guesses needed for each are added up
+func Score(plaintext string, personal ...string) int {
+	return scoreFromBits(entropyBits(plaintext, personal))
+}
+
+// zxcvbn's thresholds, in log10 guesses
+func scoreFromBits(bits float64) int {
+	guesses := bits * math.Log10(2)
+
+	switch {
+	case guesses < 3:
+		return 0
+	case guesses < 6:
+		return 1
+	case guesses < 8:
+		return 2
+	case guesses < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func entropyBits(plaintext string, personal []string) float64 {
+	// mapped rune by rune so all three line up
+	runes := []rune(plaintext)
+	lower := make([]rune, len(runes))
+	plain := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+		plain[i] = lower[i]
+		if sub, found := leet[lower[i]]; found {
+			plain[i] = sub
+		}
+	}
+
+	// personal words are treated as the most common words of all
+	words := make(map[string]int, len(personal))
+	longest := longestCommon
+	for _, word := range personal {
+		if word = strings.ToLower(word); len(word) >= 3 {
+			words[word] = 1
+			longest = max(longest, len([]rune(word)))
+		}
+	}
+
+	// bits for a character that doesn't fit any pattern
+	random := math.Log2(float64(poolSize(runes)))
+
+	var bits float64
+
+	for i := 0; i < len(runes); {
+		if n, rank := longestWord(plain[i:], lower[i:], words, longest); n > 0 {
+			bits += math.Log2(float64(rank) + 1)
+			if hasUpper(runes[i : i+n]) {
+				bits++
+			}
+			if string(plain[i:i+n]) != string(lower[i:i+n]) {
+				bits++
+			}
+			i += n
+			continue
+		}
+
+		if isYear(runes[i:]) {
+			bits += math.Log2(200)
+			i += 4
+			continue
+		}
+
+		if i > 0 && (lower[i] == lower[i-1] || isSequence(lower[i-1], lower[i])) {
+			bits++
+			i++
+			continue
+		}
+
+		bits += random
+		i++
+	}
+
+	return bits
+}
+
+// find the longest common or personal word at the start of the password, returning its length and rank.
+// words are matched with and without letter substitutions
+func longestWord(plain, lower []rune, personal map[string]int, longest int) (int, int) {
+	for n := min(len(plain), longest); n >= 3; n-- {
+		for _, candidate := range []string{string(plain[:n]), string(lower[:n])} {
+			if rank, found := personal[candidate]; found {
+				return n, rank
+			}
+			// short common words are too likely to match by chance
+			if rank, found := commonRanks[candidate]; found && n >= 4 {
+				return n, rank
+			}
+		}
+	}
+
+	return 0, 0
+}
+
+// check whether b follows a in the alphabet, the digits or along a keyboard row, either way
+func isSequence(a, b rune) bool {
+	if d := b - a; (d == 1 || d == -1) && (unicode.IsLetter(a) == unicode.IsLetter(b)) {
+		return true
+	}
+
+	for _, row := range keyboardRows {
+		i, j := strings.IndexRune(row, a), strings.IndexRune(row, b)
+		if i >= 0 && j >= 0 && (i-j == 1 || j-i == 1) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 19xx and 20xx are guessed far more often than other numbers
+func isYear(s []rune) bool {
+	if len(s) < 4 {
+		return false
+	}
+
+	for _, r := range s[:4] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	prefix := string(s[:2])
+	return prefix == "19" || prefix == "20"
+}
+
+// the number of characters an attacker would have to try for each position,
+// based on the kinds of characters the password uses
+func poolSize(runes []rune) int {
+	var lower, upper, digit, symbol, other bool
+
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	size := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			size += class.size
+		}
+	}
+
+	return max(size, 2)
+}
+
+func hasUpper(runes []rune) bool {
+	for _, r := range runes {
+		if unicode.IsUpper(r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package totp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeySize is the length of the key secrets are encrypted with at rest, aes-256
+const KeySize = 32
+
+// prefix of encrypted secrets, so the format can change later
+const encryptedPrefix = "v1:"
+
+var ErrInvalidKey = fmt.Errorf("totp: encryption key must be %d bytes of base64", KeySize)
+
+// ParseKey decodes a base64 encryption key
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+
+	return key, nil
+}
+
+// EncryptSecret seals a secret for storing with aes-gcm, the result is "v1:" and the base64 nonce and ciphertext
+func EncryptSecret(key []byte, secret string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+
+	sealed := aead.Seal(nonce, nonce, []byte(secret), nil)
+
+	return encryptedPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptSecret opens a secret sealed by EncryptSecret.
+// secrets stored before encryption was added have no prefix and are returned as they are
+func DecryptSecret(key []byte, stored string) (string, error) {
+	encoded, found := strings.CutPrefix(stored, encryptedPrefix)
+	if !found {
+		return stored, nil
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("totp: malformed encrypted secret")
+	}
+
+	secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("totp: decrypting secret: %w", err)
+	}
+
+	return string(secret), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
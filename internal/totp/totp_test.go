@@ -0,0 +1,132 @@
+package totp
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the sha-1 secret from rfc 6238 appendix b, "12345678901234567890"
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// rfc 6238 appendix b vectors, cut to the last 6 of their 8 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != tt.want {
+			t.Errorf("at %d: got %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	code := func(step int64) string {
+		c, err := Code(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", code(current), current, true},
+		{"one step behind", code(current - 1), current - 1, true},
+		{"one step ahead", code(current + 1), current + 1, true},
+		{"two steps behind", code(current - 2), 0, false},
+		{"two steps ahead", code(current + 2), 0, false},
+		{"surrounding spaces", " " + code(current) + " ", current, true},
+		{"too short", code(current)[:5], 0, false},
+		{"wrong", "000000", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Validate(rfcSecret, tt.code, now)
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("got %d, %v, want %d, %v", step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestEncryptSecret(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, KeySize)
+	secret := GenerateSecret()
+
+	encrypted, err := EncryptSecret(key, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(encrypted, secret) {
+		t.Fatalf("encrypted secret %q contains the plaintext", encrypted)
+	}
+
+	got, err := DecryptSecret(key, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != secret {
+		t.Errorf("got %q, want %q", got, secret)
+	}
+
+	// a fresh nonce is used each time
+	again, _ := EncryptSecret(key, secret)
+	if again == encrypted {
+		t.Error("encrypting twice gave the same result")
+	}
+
+	if _, err := DecryptSecret(bytes.Repeat([]byte{2}, KeySize), encrypted); err == nil {
+		t.Error("expected an error decrypting with the wrong key")
+	}
+	if _, err := DecryptSecret(key, encrypted[:len(encrypted)-2]); err == nil {
+		t.Error("expected an error decrypting a truncated secret")
+	}
+
+	// secrets stored before encryption are read as they are
+	got, err = DecryptSecret(key, secret)
+	if err != nil || got != secret {
+		t.Errorf("got %q, %v, want %q", got, err, secret)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	valid := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, KeySize))
+	short := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16))
+
+	if _, err := ParseKey(valid); err != nil {
+		t.Errorf("got %v for a valid key", err)
+	}
+
+	for _, s := range []string{"", short, "not base64!"} {
+		if _, err := ParseKey(s); err != ErrInvalidKey {
+			t.Errorf("ParseKey(%q): got %v, want %v", s, err, ErrInvalidKey)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// headers set on every delivery
+const (
+	HeaderEvent     = "X-Greenlight-Event"
+	HeaderDelivery  = "X-Greenlight-Delivery"
+	HeaderSignature = "X-Greenlight-Signature"
+)
+
+// Sign returns the signature header value for a payload.
+// the timestamp is included in the signed content so receivers can reject replayed deliveries,
+// the format is "t=<unix timestamp>,v1=<hex encoded hmac-sha256>"
+func Sign(secret string, timestamp time.Time, payload []byte) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac(secret, ts, payload)))
+}
+
+// Verify checks a signature header value against a payload,
+// signatures older than the tolerance are rejected
+func Verify(secret, header string, payload []byte, tolerance time.Duration, now time.Time) bool {
+	var ts, sig string
+
+	for part := range strings.SplitSeq(header, ",") {
+		key, value, found := strings.Cut(part, "=")
+		if !found {
+			continue
+		}
+
+		switch key {
+		case "t":
+			ts = value
+		case "v1":
+			sig = value
+		}
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	if now.Sub(time.Unix(unix, 0)).Abs() > tolerance {
+		return false
+	}
+
+	expected, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(expected, mac(secret, ts, payload))
+}
+
+func mac(secret, ts string, payload []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// client struct sends signed deliveries
+type Client struct {
+	http      *http.Client
+	userAgent string
+}
+
+// client constructor
+func New(timeout time.Duration, userAgent string) *Client {
+	return &Client{
+		http:      &http.Client{Timeout: timeout},
+		userAgent: userAgent,
+	}
+}
+
+// Send posts a signed payload to the url and returns the response status code.
+// any non-2xx response is returned as an error along with the status code
+func (c *Client) Send(ctx context.Context, url, secret, event string, deliveryID int64, payload []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", c.userAgent)
+	req.Header.Set(HeaderEvent, event)
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(deliveryID, 10))
+	req.Header.Set(HeaderSignature, Sign(secret, time.Now(), payload))
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	// drain a bit of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("receiver responded with status %d", res.StatusCode)
+	}
+
+	return res.StatusCode, nil
+}
@@ -0,0 +1,119 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	payload := []byte(`{"event":"movie.created"}`)
+	header := Sign("secret", now, payload)
+
+	if want := "t=1700000000,v1="; header[:len(want)] != want {
+		t.Fatalf("got header %q, want it to start with %q", header, want)
+	}
+
+	tests := []struct {
+		name    string
+		secret  string
+		header  string
+		payload []byte
+		now     time.Time
+		want    bool
+	}{
+		{"valid", "secret", header, payload, now, true},
+		{"within tolerance", "secret", header, payload, now.Add(4 * time.Minute), true},
+		{"too old", "secret", header, payload, now.Add(6 * time.Minute), false},
+		{"from the future", "secret", header, payload, now.Add(-6 * time.Minute), false},
+		{"wrong secret", "other", header, payload, now, false},
+		{"tampered payload", "secret", header, []byte(`{"event":"movie.deleted"}`), now, false},
+		{"tampered timestamp", "secret", "t=1700000001" + header[len("t=1700000000"):], payload, now, false},
+		{"missing signature", "secret", "t=1700000000", payload, now, false},
+		{"missing timestamp", "secret", header[len("t=1700000000,"):], payload, now, false},
+		{"not hex", "secret", "t=1700000000,v1=zz", payload, now, false},
+		{"empty", "secret", "", payload, now, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Verify(tt.secret, tt.header, tt.payload, 5*time.Minute, tt.now)
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSend(t *testing.T) {
+	payload := []byte(`{"event":"movie.created"}`)
+
+	var got *http.Request
+	var body []byte
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+
+		if !Verify("secret", r.Header.Get(HeaderSignature), body, time.Minute, time.Now()) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	client := New(time.Second, "greenlight-test")
+
+	status, err := client.Send(context.Background(), receiver.URL, "secret", "movie.created", 42, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusNoContent {
+		t.Errorf("got status %d, want %d", status, http.StatusNoContent)
+	}
+
+	if string(body) != string(payload) {
+		t.Errorf("got body %q, want %q", body, payload)
+	}
+
+	headers := map[string]string{
+		"Content-Type": "application/json",
+		"User-Agent":   "greenlight-test",
+		HeaderEvent:    "movie.created",
+		HeaderDelivery: strconv.Itoa(42),
+	}
+	for name, want := range headers {
+		if value := got.Header.Get(name); value != want {
+			t.Errorf("got %s %q, want %q", name, value, want)
+		}
+	}
+
+	// the receiver rejects signatures made with another secret
+	status, err = client.Send(context.Background(), receiver.URL, "other", "movie.created", 42, payload)
+	if err == nil {
+		t.Error("expected an error for a non-2xx response")
+	}
+	if status != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestSendUnreachable(t *testing.T) {
+	receiver := httptest.NewServer(http.NotFoundHandler())
+	receiver.Close()
+
+	status, err := New(time.Second, "greenlight-test").Send(context.Background(), receiver.URL, "secret", "movie.created", 1, nil)
+	if err == nil {
+		t.Error("expected an error")
+	}
+	if status != 0 {
+		t.Errorf("got status %d, want 0", status)
+	}
+}
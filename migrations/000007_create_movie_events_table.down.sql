@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS movies_notify_event ON movies;
+DROP FUNCTION IF EXISTS movies_notify_event();
+DROP TABLE IF EXISTS movie_events;
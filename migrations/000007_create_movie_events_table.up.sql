@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS movie_events (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    movie_id bigint NOT NULL,
+    action text NOT NULL
+);
+
+-- record every change to the movies table and notify any listening api instances
+-- the payload is only the event id, listeners read the event back from the table
+CREATE OR REPLACE FUNCTION movies_notify_event() RETURNS trigger AS $$
+DECLARE
+    event_id bigint;
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        INSERT INTO movie_events (movie_id, action) VALUES (NEW.id, 'created') RETURNING id INTO event_id;
+    ELSIF TG_OP = 'UPDATE' THEN
+        INSERT INTO movie_events (movie_id, action) VALUES (NEW.id, 'updated') RETURNING id INTO event_id;
+    ELSE
+        INSERT INTO movie_events (movie_id, action) VALUES (OLD.id, 'deleted') RETURNING id INTO event_id;
+    END IF;
+
+    PERFORM pg_notify('movie_events', event_id::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER movies_notify_event
+AFTER INSERT OR UPDATE OR DELETE ON movies
+FOR EACH ROW EXECUTE FUNCTION movies_notify_event();
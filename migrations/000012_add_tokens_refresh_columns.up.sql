@@ -0,0 +1,4 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family text;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family) WHERE family IS NOT NULL;
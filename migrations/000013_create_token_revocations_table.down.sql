@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS tokens_notify_revocation ON tokens;
+DROP FUNCTION IF EXISTS tokens_notify_revocation();
+DROP TABLE IF EXISTS token_revocations;
+ALTER TABLE tokens DROP COLUMN IF EXISTS stateless;
@@ -0,0 +1,23 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS stateless bool NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS token_revocations (
+    hash bytea PRIMARY KEY,
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+-- stateless tokens are verified without reading the tokens table, so deleting the row
+-- isn't enough to revoke one. record the revocation and notify any listening api instances,
+-- the payload is "<hex hash> <unix expiry>"
+CREATE OR REPLACE FUNCTION tokens_notify_revocation() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO token_revocations (hash, expiry) VALUES (OLD.hash, OLD.expiry) ON CONFLICT DO NOTHING;
+
+    PERFORM pg_notify('token_revocations', encode(OLD.hash, 'hex') || ' ' || extract(epoch FROM OLD.expiry)::bigint::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER tokens_notify_revocation
+AFTER DELETE ON tokens
+FOR EACH ROW WHEN (OLD.stateless AND OLD.expiry > NOW())
+EXECUTE FUNCTION tokens_notify_revocation();
@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'users:unlock';
+DROP TABLE IF EXISTS login_failures;
+DROP TABLE IF EXISTS login_lockouts;
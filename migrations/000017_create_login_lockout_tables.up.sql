@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS login_lockouts (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    failed_attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    locked_until timestamp(0) with time zone
+);
+
+CREATE TABLE IF NOT EXISTS login_failures (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    ip text NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS login_failures_ip_idx ON login_failures (ip, created_at);
+
+INSERT INTO permissions (code)
+VALUES ('users:unlock');
@@ -0,0 +1,25 @@
+-- expand roles and wildcard grants back into direct grants of the plain permissions
+INSERT INTO users_permissions (user_id, permission_id)
+SELECT DISTINCT granted.user_id, permissions.id
+FROM (
+    SELECT users_roles.user_id, roles_permissions.permission_id
+    FROM users_roles
+    INNER JOIN roles_permissions ON roles_permissions.role_id = users_roles.role_id
+    UNION
+    SELECT user_id, permission_id
+    FROM users_permissions
+) AS granted
+INNER JOIN permissions AS pattern ON pattern.id = granted.permission_id
+INNER JOIN permissions ON permissions.code NOT LIKE '%*'
+AND (
+    pattern.code = permissions.code
+    OR pattern.code = '*'
+    OR (pattern.code LIKE '%:*' AND permissions.code LIKE left(pattern.code, -1) || '%')
+)
+ON CONFLICT DO NOTHING;
+
+DELETE FROM permissions WHERE code LIKE '%*';
+
+DROP TABLE IF EXISTS users_roles;
+DROP TABLE IF EXISTS roles_permissions;
+DROP TABLE IF EXISTS roles;
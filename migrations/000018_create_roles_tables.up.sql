@@ -0,0 +1,64 @@
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    name text UNIQUE NOT NULL,
+    description text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+CREATE INDEX IF NOT EXISTS users_roles_role_id_idx ON users_roles (role_id);
+
+-- wildcards match every permission with the same prefix, * matches everything
+INSERT INTO permissions (code)
+VALUES
+    ('movies:*'),
+    ('webhooks:*'),
+    ('users:*'),
+    ('*');
+
+INSERT INTO roles (name, description)
+VALUES
+    ('viewer', 'read movies'),
+    ('editor', 'read and write movies'),
+    ('admin', 'everything');
+
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles
+INNER JOIN permissions ON (roles.name, permissions.code) IN (
+    ('viewer', 'movies:read'),
+    ('editor', 'movies:read'),
+    ('editor', 'movies:write'),
+    ('admin', '*')
+);
+
+-- convert the movie grants into roles, other grants stay as they are
+INSERT INTO users_roles (user_id, role_id)
+SELECT users_permissions.user_id, roles.id
+FROM users_permissions
+INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+INNER JOIN roles ON roles.name = 'editor'
+WHERE permissions.code = 'movies:write';
+
+INSERT INTO users_roles (user_id, role_id)
+SELECT users_permissions.user_id, roles.id
+FROM users_permissions
+INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+INNER JOIN roles ON roles.name = 'viewer'
+WHERE permissions.code = 'movies:read'
+AND users_permissions.user_id NOT IN (SELECT user_id FROM users_roles);
+
+DELETE FROM users_permissions
+USING permissions
+WHERE permissions.id = users_permissions.permission_id
+AND permissions.code IN ('movies:read', 'movies:write');
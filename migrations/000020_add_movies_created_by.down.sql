@@ -0,0 +1,11 @@
+DROP TRIGGER IF EXISTS movies_notify_event ON movies;
+
+CREATE TRIGGER movies_notify_event
+AFTER INSERT OR UPDATE OR DELETE ON movies
+FOR EACH ROW EXECUTE FUNCTION movies_notify_event();
+
+DELETE FROM roles WHERE name = 'contributor';
+DELETE FROM permissions WHERE code = 'movies:write:own';
+
+DROP INDEX IF EXISTS movies_created_by_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS created_by;
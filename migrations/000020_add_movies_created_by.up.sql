@@ -0,0 +1,26 @@
+-- the user who added the movie, kept as null when their account is deleted
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS created_by bigint REFERENCES users ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS movies_created_by_idx ON movies (created_by);
+
+-- movies:write:own only allows changing the movies the user created
+INSERT INTO permissions (code)
+VALUES ('movies:write:own');
+
+INSERT INTO roles (name, description)
+VALUES ('contributor', 'read movies, write their own');
+
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles
+INNER JOIN permissions ON (roles.name, permissions.code) IN (
+    ('contributor', 'movies:read'),
+    ('contributor', 'movies:write:own')
+);
+
+-- created_by being nulled by a user deletion isn't a change anyone watching the movie needs to hear about
+DROP TRIGGER IF EXISTS movies_notify_event ON movies;
+
+CREATE TRIGGER movies_notify_event
+AFTER INSERT OR DELETE OR UPDATE OF title, year, runtime, genres, version ON movies
+FOR EACH ROW EXECUTE FUNCTION movies_notify_event();
@@ -0,0 +1,37 @@
+-- tell listening api instances whose perms changed so they can drop them from their caches.
+-- the payload is the user id for changes to a user's own grants and roles
+CREATE OR REPLACE FUNCTION users_permissions_notify_change() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP <> 'INSERT' THEN
+        PERFORM pg_notify('permission_changes', OLD.user_id::text);
+    END IF;
+    IF TG_OP <> 'DELETE' THEN
+        PERFORM pg_notify('permission_changes', NEW.user_id::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_permissions_notify_change
+AFTER INSERT OR UPDATE OR DELETE ON users_permissions
+FOR EACH ROW EXECUTE FUNCTION users_permissions_notify_change();
+
+CREATE TRIGGER users_roles_notify_change
+AFTER INSERT OR UPDATE OR DELETE ON users_roles
+FOR EACH ROW EXECUTE FUNCTION users_permissions_notify_change();
+
+-- a change to a role or a perm code can affect any number of users, so everything is dropped
+CREATE OR REPLACE FUNCTION permissions_notify_change_all() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('permission_changes', '*');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER roles_permissions_notify_change
+AFTER INSERT OR UPDATE OR DELETE ON roles_permissions
+FOR EACH STATEMENT EXECUTE FUNCTION permissions_notify_change_all();
+
+CREATE TRIGGER permissions_notify_change
+AFTER UPDATE OR DELETE ON permissions
+FOR EACH STATEMENT EXECUTE FUNCTION permissions_notify_change_all();
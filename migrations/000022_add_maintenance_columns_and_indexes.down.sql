@@ -0,0 +1,12 @@
+DROP INDEX IF EXISTS webhook_deliveries_finished_idx;
+DROP INDEX IF EXISTS movie_events_created_at_idx;
+DROP INDEX IF EXISTS login_failures_created_at_idx;
+DROP INDEX IF EXISTS oidc_logins_expiry_idx;
+DROP INDEX IF EXISTS token_revocations_expiry_idx;
+DROP INDEX IF EXISTS tokens_expiry_idx;
+DROP INDEX IF EXISTS users_unactivated_idx;
+
+DROP TRIGGER IF EXISTS users_set_activated_at ON users;
+DROP FUNCTION IF EXISTS users_set_activated_at();
+
+ALTER TABLE users DROP COLUMN IF EXISTS activated_at;
@@ -0,0 +1,27 @@
+-- set the first time an account is activated, so the reaper can tell accounts that were never
+-- activated apart from ones an admin deactivated later
+ALTER TABLE users ADD COLUMN IF NOT EXISTS activated_at timestamp(0) with time zone;
+
+UPDATE users SET activated_at = created_at WHERE activated;
+
+CREATE OR REPLACE FUNCTION users_set_activated_at() RETURNS trigger AS $$
+BEGIN
+    IF NEW.activated AND NEW.activated_at IS NULL THEN
+        NEW.activated_at = NOW();
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_set_activated_at
+BEFORE INSERT OR UPDATE OF activated ON users
+FOR EACH ROW EXECUTE FUNCTION users_set_activated_at();
+
+-- let the reaper find old rows without scanning whole tables
+CREATE INDEX IF NOT EXISTS users_unactivated_idx ON users (created_at) WHERE activated_at IS NULL;
+CREATE INDEX IF NOT EXISTS tokens_expiry_idx ON tokens (expiry);
+CREATE INDEX IF NOT EXISTS token_revocations_expiry_idx ON token_revocations (expiry);
+CREATE INDEX IF NOT EXISTS oidc_logins_expiry_idx ON oidc_logins (expiry);
+CREATE INDEX IF NOT EXISTS login_failures_created_at_idx ON login_failures (created_at);
+CREATE INDEX IF NOT EXISTS movie_events_created_at_idx ON movie_events (created_at);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_finished_idx ON webhook_deliveries (created_at) WHERE status <> 'pending';
@@ -0,0 +1,35 @@
+-- security events, see data.AuditModel.
+-- the user columns aren't foreign keys so events outlive the accounts they mention
+CREATE TABLE IF NOT EXISTS audit_events (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    action text NOT NULL,
+    actor_id bigint,
+    user_id bigint,
+    ip text NOT NULL DEFAULT '',
+    user_agent text NOT NULL DEFAULT '',
+    details jsonb NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_created_at_idx ON audit_events (created_at);
+CREATE INDEX IF NOT EXISTS audit_events_action_idx ON audit_events (action);
+CREATE INDEX IF NOT EXISTS audit_events_actor_id_idx ON audit_events (actor_id);
+CREATE INDEX IF NOT EXISTS audit_events_user_id_idx ON audit_events (user_id);
+
+-- the log is append-only, so a leaked database login can't tidy up after itself through the api's user
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_append_only
+BEFORE UPDATE OR DELETE ON audit_events
+FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+
+CREATE TRIGGER audit_events_no_truncate
+BEFORE TRUNCATE ON audit_events
+FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
+
+INSERT INTO permissions (code)
+VALUES ('audit:read');
@@ -0,0 +1,16 @@
+-- invitations to register, see data.InvitationModel.
+-- roles and permissions are granted to the new user when the invitation is accepted
+CREATE TABLE IF NOT EXISTS invitations (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    email citext NOT NULL,
+    hash bytea UNIQUE NOT NULL,
+    invited_by bigint REFERENCES users ON DELETE SET NULL,
+    roles text[] NOT NULL DEFAULT '{}',
+    permissions text[] NOT NULL DEFAULT '{}',
+    expiry timestamp(0) with time zone NOT NULL,
+    accepted_at timestamp(0) with time zone,
+    user_id bigint REFERENCES users ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS invitations_pending_idx ON invitations (expiry) WHERE accepted_at IS NULL;
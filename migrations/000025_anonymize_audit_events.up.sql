@@ -0,0 +1,40 @@
+-- the audit log stays append-only, except that events can forget a deleted user.
+-- anonymize_audit_events turns this on for its own updates, and even then an update can only
+-- clear the user ids, ip and user agent, so the flag can't be used to rewrite or delete events
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE'
+        AND current_setting('greenlight.anonymize_audit', true) = 'on'
+        AND NEW.id = OLD.id
+        AND NEW.created_at = OLD.created_at
+        AND NEW.action = OLD.action
+        AND NEW.details = OLD.details
+        AND (NEW.actor_id IS NULL OR NEW.actor_id = OLD.actor_id)
+        AND (NEW.user_id IS NULL OR NEW.user_id = OLD.user_id)
+        AND NEW.ip IN ('', OLD.ip)
+        AND NEW.user_agent IN ('', OLD.user_agent) THEN
+        RETURN NEW;
+    END IF;
+
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+-- clear the deleted users' ids from the events that mention them, along with the ip and user agent
+-- of the requests they made. requests another user made about them, e.g. an admin granting a role,
+-- keep that user's ip and user agent.
+-- it's SECURITY DEFINER so the api's database user can be denied UPDATE on audit_events
+CREATE OR REPLACE FUNCTION anonymize_audit_events(ids bigint[]) RETURNS void AS $$
+BEGIN
+    PERFORM set_config('greenlight.anonymize_audit', 'on', true);
+
+    UPDATE audit_events
+    SET ip = CASE WHEN actor_id IS NULL OR actor_id = ANY(ids) THEN '' ELSE ip END,
+        user_agent = CASE WHEN actor_id IS NULL OR actor_id = ANY(ids) THEN '' ELSE user_agent END,
+        actor_id = CASE WHEN actor_id = ANY(ids) THEN NULL ELSE actor_id END,
+        user_id = CASE WHEN user_id = ANY(ids) THEN NULL ELSE user_id END
+    WHERE actor_id = ANY(ids) OR user_id = ANY(ids);
+
+    PERFORM set_config('greenlight.anonymize_audit', 'off', true);
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER SET search_path = public;